@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fanonwue/goutils/logging"
+	"github.com/fanonwue/patreon-gobot/internal/patreon"
+	"github.com/fanonwue/patreon-gobot/internal/telegram"
+	"github.com/fanonwue/patreon-gobot/internal/util"
+)
+
+const (
+	defaultBreakerErrorRatio    = 0.5
+	defaultBreakerMinRequests   = 10
+	defaultBreakerProbeInterval = 5 * time.Minute
+	// breakerProbeSize is the number of rewards checked by a probe run
+	breakerProbeSize = 3
+)
+
+type circuitState int
+
+const (
+	// circuitClosed means Patreon works as expected and rewards are polled normally
+	circuitClosed circuitState = iota
+	// circuitOpen means Patreon is down or blocking requests, polling is paused until the next probe
+	circuitOpen
+	// circuitHalfOpen means a probe run is checking whether Patreon works again
+	circuitHalfOpen
+)
+
+func (cs circuitState) String() string {
+	switch cs {
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// circuitBreaker pauses polling while Patreon is down or blocking requests. It opens once the share of outage
+// errors among the most recent results reaches the error ratio. While open, update runs are skipped, except for
+// a small probe run every probe interval, which closes the breaker again if it succeeds.
+type circuitBreaker struct {
+	mu            sync.Mutex
+	state         circuitState
+	errorRatio    float64
+	minRequests   int
+	probeInterval time.Duration
+	// window holds the most recent results, true for outage errors
+	window    []bool
+	next      int
+	filled    int
+	openedAt  time.Time
+	nextProbe time.Time
+	// probe counts the results of the current probe run
+	probeResults, probeFailures int
+	onOpen                      func(reason string)
+	onClose                     func(outage time.Duration)
+}
+
+var breaker = newCircuitBreaker(defaultBreakerErrorRatio, defaultBreakerMinRequests, defaultBreakerProbeInterval)
+
+func newCircuitBreaker(errorRatio float64, minRequests int, probeInterval time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		errorRatio:    errorRatio,
+		minRequests:   minRequests,
+		probeInterval: probeInterval,
+		window:        make([]bool, 2*minRequests),
+	}
+}
+
+// circuitBreakerFromEnv creates the circuit breaker configured by BREAKER_ERROR_RATIO (percent),
+// BREAKER_MIN_REQUESTS and BREAKER_PROBE_INTERVAL (minutes)
+func circuitBreakerFromEnv() *circuitBreaker {
+	errorRatio := defaultBreakerErrorRatio
+	if percent, err := strconv.Atoi(os.Getenv(util.PrefixEnvVar("BREAKER_ERROR_RATIO"))); err == nil && percent > 0 && percent <= 100 {
+		errorRatio = float64(percent) / 100
+	}
+	minRequests := defaultBreakerMinRequests
+	if value, err := strconv.Atoi(os.Getenv(util.PrefixEnvVar("BREAKER_MIN_REQUESTS"))); err == nil && value > 0 {
+		minRequests = value
+	}
+	probeInterval := durationFromEnv("BREAKER_PROBE_INTERVAL", time.Minute, defaultBreakerProbeInterval)
+	return newCircuitBreaker(errorRatio, minRequests, probeInterval)
+}
+
+// isOutageStatus checks whether the status hints at Patreon being down or blocking the bot, as opposed to a
+// problem with the single reward. 403 responses are included, as Patreon blocks whole IP ranges with them,
+// as are 429 responses, which hit all rewards alike.
+func isOutageStatus(status patreon.RewardStatus) bool {
+	switch status {
+	case patreon.RewardErrorForbidden, patreon.RewardErrorRateLimit,
+		patreon.RewardErrorInternalServerError, patreon.RewardErrorGatewayError:
+		return true
+	default:
+		return false
+	}
+}
+
+// countsForBreaker checks whether the result of a check is recorded by the breaker. 403 responses for rewards
+// that already failed before are left out, as those are most likely private or removed tiers. Otherwise, a user
+// tracking several of them could pause polling for everyone.
+func countsForBreaker(status patreon.RewardStatus, knownFailing bool) bool {
+	return !knownFailing || status != patreon.RewardErrorForbidden
+}
+
+// allowRun checks whether an update run may start. While the breaker is open, only probe runs are allowed,
+// once the probe interval has passed or if the run is forced.
+func (cb *circuitBreaker) allowRun(now time.Time, force bool) (allowed bool, probe bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case circuitClosed:
+		return true, false
+	case circuitOpen:
+		if !force && now.Before(cb.nextProbe) {
+			return false, false
+		}
+		cb.state = circuitHalfOpen
+		cb.probeResults, cb.probeFailures = 0, 0
+		logging.Info("Circuit breaker half-open, probing Patreon")
+		return true, true
+	default:
+		// A probe is running already
+		return false, false
+	}
+}
+
+// record adds the result of a check. Returns true if the result opened the breaker.
+func (cb *circuitBreaker) record(status patreon.RewardStatus, now time.Time) bool {
+	reason, opened := cb.recordLocked(status, now)
+	// The callback is called without the lock, so it may query the breaker
+	if opened && cb.onOpen != nil {
+		cb.onOpen(reason)
+	}
+	return opened
+}
+
+// recordLocked adds the result under the lock and returns the reason if the breaker got opened
+func (cb *circuitBreaker) recordLocked(status patreon.RewardStatus, now time.Time) (string, bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	failed := isOutageStatus(status)
+	if cb.state == circuitHalfOpen {
+		cb.probeResults++
+		if failed {
+			cb.probeFailures++
+		}
+		return "", false
+	}
+	if cb.state != circuitClosed {
+		return "", false
+	}
+
+	cb.window[cb.next] = failed
+	cb.next = (cb.next + 1) % len(cb.window)
+	cb.filled = min(cb.filled+1, len(cb.window))
+	if cb.filled < cb.minRequests {
+		return "", false
+	}
+
+	failures := 0
+	for i := range cb.filled {
+		if cb.window[i] {
+			failures++
+		}
+	}
+	if float64(failures)/float64(cb.filled) < cb.errorRatio {
+		return "", false
+	}
+
+	reason := fmt.Sprintf("%d of the last %d requests failed", failures, cb.filled)
+	cb.open(now, reason)
+	return reason, true
+}
+
+// finishProbe closes the breaker if the probe run succeeded, otherwise it stays open until the next probe
+func (cb *circuitBreaker) finishProbe(now time.Time) {
+	outage, closed := cb.finishProbeLocked(now)
+	if closed && cb.onClose != nil {
+		cb.onClose(outage)
+	}
+}
+
+// finishProbeLocked evaluates the probe run under the lock and returns the outage duration if the breaker got closed
+func (cb *circuitBreaker) finishProbeLocked(now time.Time) (time.Duration, bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state != circuitHalfOpen {
+		return 0, false
+	}
+	if cb.probeResults == 0 || float64(cb.probeFailures)/float64(cb.probeResults) >= cb.errorRatio {
+		cb.state = circuitOpen
+		cb.nextProbe = now.Add(cb.probeInterval)
+		logging.Infof("Probe failed (%d of %d requests failed), circuit breaker stays open", cb.probeFailures, cb.probeResults)
+		return 0, false
+	}
+
+	outage := now.Sub(cb.openedAt)
+	cb.state = circuitClosed
+	clear(cb.window)
+	cb.next, cb.filled = 0, 0
+	logging.Infof("Circuit breaker closed after %s", outage.Round(time.Second))
+	return outage, true
+}
+
+// open has to be called with the lock held
+func (cb *circuitBreaker) open(now time.Time, reason string) {
+	cb.state = circuitOpen
+	cb.openedAt = now
+	cb.nextProbe = now.Add(cb.probeInterval)
+	logging.Warnf("Circuit breaker opened: %s", reason)
+}
+
+func (cb *circuitBreaker) currentState() circuitState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state
+}
+
+// notifyAdminsOnBreakerChanges alerts the admins when the breaker opens and closes
+func notifyAdminsOnBreakerChanges(cb *circuitBreaker) {
+	cb.onOpen = func(reason string) {
+		telegram.NotifyAdmins(fmt.Sprintf("Patreon seems to be down or blocking requests (%s). Polling is paused, "+
+			"probing again every %s. Missing reward notifications are suppressed in the meantime.", reason, cb.probeInterval))
+	}
+	cb.onClose = func(outage time.Duration) {
+		telegram.NotifyAdmins(fmt.Sprintf("Patreon is reachable again after %s, polling resumed.", outage.Round(time.Second)))
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/fanonwue/patreon-gobot/internal/db"
+	"github.com/fanonwue/patreon-gobot/internal/patreon"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	cb := newCircuitBreaker(0.5, 4, 5*time.Minute)
+	opened, closed := 0, 0
+	// The callbacks are called without the lock, querying the breaker must not deadlock
+	cb.onOpen = func(string) {
+		assert.Equal(t, circuitOpen, cb.currentState())
+		opened++
+	}
+	cb.onClose = func(time.Duration) {
+		assert.Equal(t, circuitClosed, cb.currentState())
+		closed++
+	}
+
+	// Not enough results to judge yet
+	assert.False(t, cb.record(patreon.RewardErrorGatewayError, now))
+	assert.False(t, cb.record(patreon.RewardFound, now))
+	// Missing rewards are no sign of an outage
+	assert.False(t, cb.record(patreon.RewardErrorNotFound, now))
+	assert.False(t, cb.record(patreon.RewardErrorNotFound, now))
+	assert.False(t, cb.record(patreon.RewardErrorForbidden, now))
+	assert.True(t, cb.record(patreon.RewardErrorInternalServerError, now))
+	assert.Equal(t, circuitOpen, cb.currentState())
+	assert.Equal(t, 1, opened)
+
+	allowed, _ := cb.allowRun(now.Add(time.Minute), false)
+	assert.False(t, allowed)
+
+	// A failed probe keeps the breaker open until the next probe
+	probeTime := now.Add(5 * time.Minute)
+	allowed, probe := cb.allowRun(probeTime, false)
+	assert.True(t, allowed)
+	assert.True(t, probe)
+	assert.Equal(t, circuitHalfOpen, cb.currentState())
+	cb.record(patreon.RewardErrorInternalServerError, probeTime)
+	cb.finishProbe(probeTime)
+	assert.Equal(t, circuitOpen, cb.currentState())
+	allowed, _ = cb.allowRun(probeTime.Add(time.Minute), false)
+	assert.False(t, allowed)
+
+	// Forced runs probe right away
+	allowed, probe = cb.allowRun(probeTime.Add(time.Minute), true)
+	assert.True(t, allowed)
+	assert.True(t, probe)
+	cb.record(patreon.RewardFound, probeTime)
+	cb.record(patreon.RewardFound, probeTime)
+	cb.record(patreon.RewardErrorGatewayError, probeTime)
+	cb.finishProbe(probeTime)
+	assert.Equal(t, circuitClosed, cb.currentState())
+	assert.Equal(t, 1, closed)
+
+	// The results from before the outage don't count anymore
+	for range 3 {
+		assert.False(t, cb.record(patreon.RewardErrorForbidden, probeTime))
+	}
+}
+
+func TestUserUpdate_OutageResultsDropped(t *testing.T) {
+	original := breaker
+	defer func() { breaker = original }()
+	breaker = newCircuitBreaker(0.5, 1, time.Minute)
+	breaker.record(patreon.RewardErrorGatewayError, time.Now())
+
+	tr := trackedReward(1, "", nil)
+	update := &userUpdate{}
+	update.process(context.Background(), &tr, patreon.RewardResult{Id: 1, Status: patreon.RewardErrorGatewayError}, nil, time.Now())
+	assert.Len(t, update.outageResults, 1)
+	assert.False(t, tr.IsMissing)
+	assert.Nil(t, tr.NextCheck)
+}
+
+func TestRunUpdate_PrivateTiersDontOpenBreaker(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	t.Cleanup(server.Close)
+	serverUrl, _ := url.Parse(server.URL)
+
+	originalBreaker, originalOptions, originalInterval := breaker, clientOptions, baseCheckInterval
+	t.Cleanup(func() { breaker, clientOptions, baseCheckInterval = originalBreaker, originalOptions, originalInterval })
+	breaker = newCircuitBreaker(0.5, 2, time.Minute)
+	clientOptions = []patreon.ClientOption{patreon.WithBaseUrl(serverUrl)}
+	baseCheckInterval = 200 * time.Millisecond
+
+	// A user tracking several tiers that are known to be private
+	user := &db.User{TelegramChatId: 5001, Role: db.RoleUser}
+	assert.NoError(t, db.Db().Create(user).Error)
+	for id := int64(5001); id <= 5004; id++ {
+		assert.NoError(t, db.Db().Create(&db.TrackedReward{UserID: user.ID, RewardId: id, ErrorCount: 1}).Error)
+	}
+	t.Cleanup(func() {
+		db.Db().Unscoped().Delete(&db.TrackedReward{}, "user_id = ?", user.ID)
+		db.Db().Unscoped().Delete(user)
+	})
+
+	summary := runUpdate(context.Background(), false)
+	assert.Equal(t, 4, summary.due)
+	assert.Equal(t, circuitClosed, breaker.currentState())
+
+	// The results are applied right away, so the rewards back off further
+	var errorCounts []int
+	db.Db().Model(&db.TrackedReward{}).Where("user_id = ?", user.ID).Pluck("error_count", &errorCounts)
+	assert.Equal(t, []int{2, 2, 2, 2}, errorCounts)
+
+}
+
+func TestCountsForBreaker(t *testing.T) {
+	assert.True(t, countsForBreaker(patreon.RewardErrorForbidden, false))
+	assert.False(t, countsForBreaker(patreon.RewardErrorForbidden, true))
+	// Outages show up for all rewards alike
+	assert.True(t, countsForBreaker(patreon.RewardErrorGatewayError, true))
+	assert.True(t, countsForBreaker(patreon.RewardErrorRateLimit, true))
+}
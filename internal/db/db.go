@@ -11,7 +11,7 @@ import (
 	"gorm.io/gorm"
 )
 
-const latestSchemaVersion = 1
+const latestSchemaVersion = 16
 
 var db *gorm.DB
 
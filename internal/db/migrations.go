@@ -1,9 +1,74 @@
 package db
 
 import (
+	"fmt"
+
+	"github.com/fanonwue/goutils/logging"
 	"gorm.io/gorm"
 )
 
+// migrationSteps contains the steps needed to upgrade the schema to the version matching the key
+var migrationSteps = map[uint]func(tx *gorm.DB) error{
+	2: func(tx *gorm.DB) error {
+		return tx.Migrator().AutoMigrate(&User{}, &CampaignBudget{})
+	},
+	3: func(tx *gorm.DB) error {
+		return tx.Migrator().AutoMigrate(&TrackedReward{})
+	},
+	4: func(tx *gorm.DB) error {
+		return tx.Migrator().AutoMigrate(&PendingMessage{})
+	},
+	5: func(tx *gorm.DB) error {
+		return tx.Migrator().AutoMigrate(&User{})
+	},
+	6: func(tx *gorm.DB) error {
+		if err := tx.Migrator().AutoMigrate(&User{}, &Invite{}); err != nil {
+			return err
+		}
+		// Existing users were allowed to use the bot before roles existed
+		return tx.Session(&gorm.Session{AllowGlobalUpdate: true}).Model(&User{}).Update("role", RoleUser).Error
+	},
+	7: func(tx *gorm.DB) error {
+		return tx.Migrator().AutoMigrate(&User{})
+	},
+	8: func(tx *gorm.DB) error {
+		return tx.Migrator().AutoMigrate(&User{})
+	},
+	9: func(tx *gorm.DB) error {
+		return tx.Migrator().AutoMigrate(&Conversation{})
+	},
+	10: func(tx *gorm.DB) error {
+		return tx.Migrator().AutoMigrate(&TrackedReward{})
+	},
+	11: func(tx *gorm.DB) error {
+		return tx.Migrator().AutoMigrate(&User{}, &TrackedReward{}, &PendingMessage{})
+	},
+	12: func(tx *gorm.DB) error {
+		return tx.Migrator().AutoMigrate(&TrackedReward{})
+	},
+	13: func(tx *gorm.DB) error {
+		return tx.Migrator().AutoMigrate(&Secret{})
+	},
+	14: func(tx *gorm.DB) error {
+		return tx.Migrator().AutoMigrate(&RewardAddition{})
+	},
+	15: func(tx *gorm.DB) error {
+		if err := tx.Migrator().AutoMigrate(&User{}); err != nil {
+			return err
+		}
+		if tx.Migrator().HasColumn(&User{}, "last_digest") {
+			return tx.Migrator().DropColumn(&User{}, "last_digest")
+		}
+		return nil
+	},
+	16: func(tx *gorm.DB) error {
+		if tx.Migrator().HasColumn(&TrackedReward{}, "is_muted") {
+			return tx.Migrator().DropColumn(&TrackedReward{}, "is_muted")
+		}
+		return nil
+	},
+}
+
 func migrate() {
 	migrator := Db().Migrator()
 
@@ -13,7 +78,7 @@ func migrate() {
 
 		if !migrator.HasTable(&User{}) {
 			// Assume this is a completely new DB
-			migrator.AutoMigrate(&User{}, &TrackedReward{})
+			migrator.AutoMigrate(allModels()...)
 			err := updateSchemaVersion(latestSchemaVersion)
 			if err != nil {
 				panic(err)
@@ -23,6 +88,24 @@ func migrate() {
 
 	schemaInfo := SchemaInfo{}
 	db.First(&schemaInfo)
+
+	for version := schemaInfo.Version + 1; version <= latestSchemaVersion; version++ {
+		step, found := migrationSteps[version]
+		if !found {
+			panic(fmt.Sprintf("no migration step found for schema version %d", version))
+		}
+		logging.Infof("Migrating database schema to version %d", version)
+		if err := step(Db()); err != nil {
+			panic(fmt.Sprintf("error migrating database schema to version %d: %v", version, err))
+		}
+		if err := updateSchemaVersion(version); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func allModels() []any {
+	return []any{&User{}, &TrackedReward{}, &CampaignBudget{}, &PendingMessage{}, &Invite{}, &Conversation{}, &Secret{}, &RewardAddition{}}
 }
 
 func updateSchemaVersion(toVersion uint) error {
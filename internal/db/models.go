@@ -3,21 +3,61 @@ package db
 import (
 	"github.com/fanonwue/patreon-gobot/internal/util"
 	"gorm.io/gorm"
+	"slices"
 	"strings"
 	"time"
 )
 
 const defaultLanguage = "EN"
 
+type Role string
+
+const (
+	RoleAdmin   Role = "admin"
+	RoleUser    Role = "user"
+	RolePending Role = "pending"
+	RoleBanned  Role = "banned"
+)
+
+// ActiveRoles are the roles that are allowed to use the bot
+var ActiveRoles = []Role{RoleAdmin, RoleUser}
+
+// Priority controls how urgently the user gets notified about a tracked reward
+type Priority string
+
+const (
+	// PriorityLow rewards are only checked every few updates and only included in digests
+	PriorityLow Priority = "low"
+	// PriorityNormal rewards are notified about as soon as they become available
+	PriorityNormal Priority = "normal"
+	// PriorityHigh rewards are notified about immediately and re-alerted until acknowledged
+	PriorityHigh Priority = "high"
+)
+
+var Priorities = []Priority{PriorityLow, PriorityNormal, PriorityHigh}
+
 type (
 	SchemaInfo struct {
 		Version uint
 	}
 	User struct {
 		gorm.Model
-		TelegramChatId int64           `gorm:"uniqueIndex"`
-		Language       string          `gorm:"default:EN;not null"`
-		Rewards        []TrackedReward `gorm:"constraint:OnDelete:CASCADE;"`
+		TelegramChatId    int64            `gorm:"uniqueIndex"`
+		Language          string           `gorm:"default:EN;not null"`
+		IsInactive        bool             `gorm:"default:false;not null"` // Set if the bot got blocked or the chat is gone
+		Role              Role             `gorm:"default:pending;not null"`
+		MaxTrackedRewards *int             // Overrides the default quota if set
+		MaxAddsPerHour    *int             // Overrides the default quota if set
+		BudgetCents       *int             // Maximum price for any tracked reward, nil if no budget has been set
+		BudgetCurrency    string           // Currency of BudgetCents, rewards priced in other currencies are not filtered
+		NotificationChat  *int64           // Chat (e.g. a channel) notifications are sent to instead, if set
+		DigestOpenedAt    *time.Time       // Time the first low priority reward of the pending digest became available
+		QuietFrom         *int             // Hour of the day quiet hours start at, nil if the user has no quiet hours
+		QuietUntil        *int             // Hour of the day quiet hours end at
+		TimeZone          string           // Time zone of the quiet hours, UTC if empty
+		Rewards           []TrackedReward  `gorm:"constraint:OnDelete:CASCADE;"`
+		CampaignBudgets   []CampaignBudget `gorm:"constraint:OnDelete:CASCADE;"`
+		Additions         []RewardAddition `gorm:"constraint:OnDelete:CASCADE;"`
 	}
 	TrackedReward struct {
 		gorm.Model
@@ -26,6 +66,63 @@ type (
 		IsMissing      bool  `gorm:"default:false;not null"`
 		AvailableSince *time.Time
 		LastNotified   *time.Time
+		Note           string
+		Tags           string     // Comma separated list of lower case tags
+		Priority       Priority   `gorm:"default:normal;not null"`
+		Acknowledged   bool       `gorm:"default:false;not null"` // Set once the user acknowledged the last notification
+		Realerts       int        `gorm:"default:0;not null"`     // Number of re-alerts sent since the last notification
+		NextCheck      *time.Time `gorm:"index"`                  // Time the reward is due to be checked again, nil if due now
+		ErrorCount     int        `gorm:"default:0;not null"`     // Number of consecutive checks failing as not found or forbidden
+		OpenCount      int        `gorm:"default:0;not null"`     // Number of times the reward became available while tracked
+	}
+	// RewardAddition records a reward being added by the user. Removing the reward keeps the record, so the
+	// additions per hour can't be bypassed by removing and adding rewards again.
+	RewardAddition struct {
+		ID        uint      `gorm:"primarykey"`
+		UserID    uint      `gorm:"index;not null"`
+		CreatedAt time.Time `gorm:"index"`
+	}
+	// CampaignBudget overrides the user's budget for a single campaign. The price is always
+	// interpreted in the currency of the campaign's rewards.
+	CampaignBudget struct {
+		gorm.Model
+		UserID        uint  `gorm:"uniqueIndex:budget_per_campaign"`
+		CampaignId    int64 `gorm:"uniqueIndex:budget_per_campaign"`
+		MaxPriceCents int   `gorm:"not null"`
+	}
+	// PendingMessage is an outgoing Telegram message that has not been delivered yet
+	PendingMessage struct {
+		gorm.Model
+		ChatId              int64 `gorm:"index;not null"`
+		Text                string
+		ParseMode           string
+		DisableLinkPreview  bool
+		DisableNotification bool
+		ReplyMarkup         string // JSON encoded inline keyboard, if any
+		Attempts            int    `gorm:"default:0;not null"`
+	}
+	// Conversation is the state of a multi-step conversation with a chat
+	Conversation struct {
+		gorm.Model
+		ChatId    int64 `gorm:"uniqueIndex;not null"`
+		Stage     int
+		Payload   string    // JSON encoded data attached to the conversation
+		ExpiresAt time.Time `gorm:"index"`
+	}
+	// Secret is a value encrypted with the key from SECRET_KEY, like the Patreon session
+	Secret struct {
+		Name      string `gorm:"primaryKey"`
+		Value     []byte `gorm:"not null"`
+		UpdatedAt time.Time
+	}
+	// Invite allows a single new user to use the bot without having to be approved by an admin
+	Invite struct {
+		gorm.Model
+		Code         string `gorm:"uniqueIndex;not null"`
+		CreatedByID  uint
+		RedeemedByID *uint
+		RedeemedAt   *time.Time
+		ExpiresAt    time.Time
 	}
 )
 
@@ -35,11 +132,128 @@ func (u *User) BeforeSave(tx *gorm.DB) error {
 	}
 
 	u.Language = strings.ToUpper(u.Language)
+	u.BudgetCurrency = strings.ToUpper(u.BudgetCurrency)
+	u.DigestOpenedAt = util.ToUTC(u.DigestOpenedAt)
 	return nil
 }
 
+// NotificationChatId returns the chat notifications for the user should be sent to
+func (u *User) NotificationChatId() int64 {
+	if u.NotificationChat != nil {
+		return *u.NotificationChat
+	}
+	return u.TelegramChatId
+}
+
+// CampaignBudget returns the budget set for the given campaign, if any. CampaignBudgets need to be preloaded.
+func (u *User) CampaignBudget(campaignId int64) *CampaignBudget {
+	for i := range u.CampaignBudgets {
+		if u.CampaignBudgets[i].CampaignId == campaignId {
+			return &u.CampaignBudgets[i]
+		}
+	}
+	return nil
+}
+
+// IsAboveBudget checks whether a reward of the given campaign exceeds the budget of the user.
+// A campaign budget takes precedence over the user's budget. The user's budget only applies to rewards
+// priced in the same currency, as there is no currency conversion. CampaignBudgets need to be preloaded.
+func (u *User) IsAboveBudget(campaignId int64, amountCents int, currency util.Currency) bool {
+	if cb := u.CampaignBudget(campaignId); cb != nil {
+		return amountCents > cb.MaxPriceCents
+	}
+
+	if u.BudgetCents == nil || u.BudgetCurrency != currency.String() {
+		return false
+	}
+	return amountCents > *u.BudgetCents
+}
+
+// HasAccess checks whether the user is allowed to use the bot
+func (u *User) HasAccess() bool {
+	return slices.Contains(ActiveRoles, u.Role)
+}
+
+func (u *User) IsAdmin() bool {
+	return u.Role == RoleAdmin
+}
+
+// IsDigestDue checks whether a digest is pending and the interval has passed since it got opened
+func (u *User) IsDigestDue(interval time.Duration) bool {
+	return u.DigestOpenedAt != nil && time.Since(*u.DigestOpenedAt) >= interval
+}
+
+// Location returns the time zone of the user, UTC if none has been set or it is unknown
+func (u *User) Location() *time.Location {
+	if u.TimeZone == "" {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(u.TimeZone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// IsQuietAt checks whether the time falls into the quiet hours of the user. Quiet hours may span midnight.
+func (u *User) IsQuietAt(t time.Time) bool {
+	if u.QuietFrom == nil || u.QuietUntil == nil || *u.QuietFrom == *u.QuietUntil {
+		return false
+	}
+	hour := t.In(u.Location()).Hour()
+	if *u.QuietFrom < *u.QuietUntil {
+		return hour >= *u.QuietFrom && hour < *u.QuietUntil
+	}
+	return hour >= *u.QuietFrom || hour < *u.QuietUntil
+}
+
+func (i *Invite) IsValid() bool {
+	return i.RedeemedByID == nil && time.Now().Before(i.ExpiresAt)
+}
+
 func (tr *TrackedReward) BeforeSave(tx *gorm.DB) error {
 	tr.AvailableSince = util.ToUTC(tr.AvailableSince)
 	tr.LastNotified = util.ToUTC(tr.LastNotified)
+	tr.NextCheck = util.ToUTC(tr.NextCheck)
+	tr.SetTags(tr.TagList())
+	if tr.Priority == "" {
+		tr.Priority = PriorityNormal
+	}
 	return nil
 }
+
+// NormalizeTag converts the tag to the format it is stored in. Commas are not allowed, as they separate the tags.
+func NormalizeTag(tag string) string {
+	return strings.ToLower(strings.TrimSpace(strings.ReplaceAll(tag, ",", "")))
+}
+
+// TagList returns the tags of the reward
+func (tr *TrackedReward) TagList() []string {
+	var tags []string
+	for _, tag := range strings.Split(tr.Tags, ",") {
+		if tag = NormalizeTag(tag); tag != "" && !slices.Contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// SetTags replaces the tags of the reward, dropping empty and duplicate tags
+func (tr *TrackedReward) SetTags(tags []string) {
+	normalized := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		if tag = NormalizeTag(tag); tag != "" && !slices.Contains(normalized, tag) {
+			normalized = append(normalized, tag)
+		}
+	}
+	tr.Tags = strings.Join(normalized, ",")
+}
+
+func (tr *TrackedReward) HasTag(tag string) bool {
+	return slices.Contains(tr.TagList(), NormalizeTag(tag))
+}
+
+// IsValid checks whether the priority is one of Priorities
+func (p Priority) IsValid() bool {
+	return slices.Contains(Priorities, p)
+}
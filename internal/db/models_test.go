@@ -0,0 +1,61 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fanonwue/patreon-gobot/internal/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUser_IsAboveBudget(t *testing.T) {
+	budget := 1000
+	user := &User{
+		BudgetCents:     &budget,
+		BudgetCurrency:  "EUR",
+		CampaignBudgets: []CampaignBudget{{CampaignId: 42, MaxPriceCents: 500}},
+	}
+
+	assert.False(t, user.IsAboveBudget(1, 1000, "EUR"))
+	assert.True(t, user.IsAboveBudget(1, 1001, "EUR"))
+	assert.True(t, user.IsAboveBudget(1, 1001, util.Currency("eur")))
+	// There is no currency conversion, so other currencies are never above the budget
+	assert.False(t, user.IsAboveBudget(1, 5000, "USD"))
+
+	// The campaign budget takes precedence, no matter the currency
+	assert.True(t, user.IsAboveBudget(42, 600, "EUR"))
+	assert.True(t, user.IsAboveBudget(42, 600, "USD"))
+	assert.False(t, user.IsAboveBudget(42, 500, "USD"))
+
+	assert.False(t, (&User{}).IsAboveBudget(1, 1000000, "EUR"))
+}
+
+func TestUser_IsQuietAt(t *testing.T) {
+	from, until := 23, 7
+	user := &User{QuietFrom: &from, QuietUntil: &until}
+	at := func(hour int) time.Time { return time.Date(2025, 1, 1, hour, 30, 0, 0, time.UTC) }
+
+	// Quiet hours spanning midnight
+	assert.True(t, user.IsQuietAt(at(23)))
+	assert.True(t, user.IsQuietAt(at(3)))
+	assert.False(t, user.IsQuietAt(at(7)))
+	assert.False(t, user.IsQuietAt(at(12)))
+
+	from, until = 1, 5
+	assert.True(t, user.IsQuietAt(at(1)))
+	assert.False(t, user.IsQuietAt(at(5)))
+
+	// Berlin is an hour ahead of UTC in winter
+	user.TimeZone = "Europe/Berlin"
+	assert.True(t, user.IsQuietAt(at(0)))
+	assert.False(t, user.IsQuietAt(at(4)))
+
+	assert.False(t, (&User{}).IsQuietAt(at(3)))
+}
+
+func TestUser_IsDigestDue(t *testing.T) {
+	assert.False(t, (&User{}).IsDigestDue(time.Hour))
+	openedAt := time.Now().Add(-2 * time.Hour)
+	assert.True(t, (&User{DigestOpenedAt: &openedAt}).IsDigestDue(time.Hour))
+	assert.False(t, (&User{DigestOpenedAt: &openedAt}).IsDigestDue(3*time.Hour))
+}
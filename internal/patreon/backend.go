@@ -0,0 +1,346 @@
+package patreon
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/fanonwue/goutils/logging"
+	"github.com/fanonwue/patreon-gobot/internal/util"
+)
+
+type BackendType string
+
+const (
+	// BackendWeb uses the unauthenticated JSON API of the Patreon website
+	BackendWeb BackendType = "web"
+	// BackendApiV2 uses the documented OAuth API v2, which requires an access token
+	BackendApiV2 BackendType = "api-v2"
+)
+
+const (
+	// apiV2DefaultCurrency is used for tiers if neither the tier nor its campaign state a currency
+	apiV2DefaultCurrency util.Currency = "USD"
+	// maxTierCampaigns limits the number of tiers whose campaign is remembered
+	maxTierCampaigns = 10000
+)
+
+const (
+	apiV2CampaignFields = "created_at,creation_name,vanity,url,image_url,is_nsfw,published_at,currency"
+	apiV2TierFields     = "amount_cents,created_at,edited_at,published_at,published,description,remaining,user_limit,title,url,image_url"
+)
+
+// Backend fetches rewards and campaigns from Patreon. Caching, stats and parallelism are handled by the Client,
+// so callers of FetchReward and FetchCampaign don't depend on the backend in use.
+type Backend interface {
+	FetchReward(id RewardId, ctx context.Context) (*Reward, error)
+	FetchCampaign(id CampaignId, ctx context.Context) (*Campaign, error)
+}
+
+type (
+	// webBackend fetches rewards and campaigns the same way the Patreon website does, retrying with the session
+	// if anonymous access is forbidden
+	webBackend struct {
+		c *Client
+	}
+
+	// apiV2Backend uses the OAuth API v2. The API has no endpoint for single tiers, so tiers are looked up through
+	// the campaigns accessible with the access token, which are usually just the campaigns of the token's owner.
+	apiV2Backend struct {
+		c           *Client
+		accessToken string
+		// tierCampaigns is shared by all clients created with the same option
+		tierCampaigns *tierCampaignCache
+	}
+
+	// tierCampaignCache remembers the campaign of every tier the API v2 returned, so a tier can be fetched with
+	// a single request to its campaign. Once full, an arbitrary entry makes room for new ones.
+	tierCampaignCache struct {
+		mu     sync.Mutex
+		size   int
+		values map[RewardId]CampaignId
+	}
+
+	apiV2Resource struct {
+		Id         string          `json:"id"`
+		Type       string          `json:"type"`
+		Attributes json.RawMessage `json:"attributes"`
+	}
+
+	apiV2Document struct {
+		Data     apiV2Resource   `json:"data"`
+		Included []apiV2Resource `json:"included"`
+	}
+
+	apiV2ListDocument struct {
+		Data []apiV2Resource `json:"data"`
+		Meta struct {
+			Pagination struct {
+				Cursors struct {
+					Next string `json:"next"`
+				} `json:"cursors"`
+			} `json:"pagination"`
+		} `json:"meta"`
+	}
+
+	apiV2CampaignAttributes struct {
+		CampaignAttributes
+		CreationName string `json:"creation_name"`
+		Vanity       string `json:"vanity"`
+	}
+)
+
+// missingTiersCache remembers tiers that none of the accessible campaigns contained, so checking them again
+// doesn't fetch every campaign each time
+var missingTiersCache = &Cache[RewardId, bool]{
+	name:   "MissingTiersCache",
+	ttl:    cacheTTL,
+	values: make(map[RewardId]CacheEntry[bool]),
+}
+
+// WithApiV2 fetches rewards and campaigns using the OAuth API v2 with the given access token
+func WithApiV2(accessToken string) ClientOption {
+	tierCampaigns := newTierCampaignCache(maxTierCampaigns)
+	return func(c *Client) {
+		c.newBackend = func(c *Client) Backend {
+			return &apiV2Backend{c: c, accessToken: accessToken, tierCampaigns: tierCampaigns}
+		}
+	}
+}
+
+func newTierCampaignCache(size int) *tierCampaignCache {
+	return &tierCampaignCache{size: size, values: make(map[RewardId]CampaignId)}
+}
+
+func (tc *tierCampaignCache) get(id RewardId) (CampaignId, bool) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	campaignId, found := tc.values[id]
+	return campaignId, found
+}
+
+func (tc *tierCampaignCache) set(id RewardId, campaignId CampaignId) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if _, found := tc.values[id]; !found && len(tc.values) >= tc.size {
+		for evicted := range tc.values {
+			delete(tc.values, evicted)
+			break
+		}
+	}
+	tc.values[id] = campaignId
+}
+
+// backendOptionFromEnv selects the backend configured by the BACKEND environment variable. The API v2 backend
+// needs the access token in API_ACCESS_TOKEN.
+func backendOptionFromEnv() ClientOption {
+	backendType := BackendType(strings.ToLower(strings.TrimSpace(os.Getenv(util.PrefixEnvVar("BACKEND")))))
+	switch backendType {
+	case "", BackendWeb:
+		return nil
+	case BackendApiV2:
+		accessToken := os.Getenv(util.PrefixEnvVar("API_ACCESS_TOKEN"))
+		if accessToken == "" {
+			logging.Errorf("The %s backend needs API_ACCESS_TOKEN to be set, using the %s backend instead", BackendApiV2, BackendWeb)
+			return nil
+		}
+		logging.Infof("Using the %s backend", BackendApiV2)
+		return WithApiV2(accessToken)
+	default:
+		logging.Errorf("Unknown backend %q, using the %s backend instead", backendType, BackendWeb)
+		return nil
+	}
+}
+
+func newWebBackend(c *Client) Backend {
+	return &webBackend{c: c}
+}
+
+func (wb *webBackend) FetchReward(id RewardId, ctx context.Context) (*Reward, error) {
+	reward := &RewardResponse{}
+	if err := wb.c.fetchWithSession(id.apiUrlAt(wb.c.baseUrl), reward, wb.c.campaignOf(id), ctx); err != nil {
+		return nil, err
+	}
+	return &reward.Data, nil
+}
+
+func (wb *webBackend) FetchCampaign(id CampaignId, ctx context.Context) (*Campaign, error) {
+	campaign := &CampaignResponse{}
+	if err := wb.c.fetchWithSession(id.apiUrlAt(wb.c.baseUrl), campaign, id, ctx); err != nil {
+		return nil, err
+	}
+	return &campaign.Data, nil
+}
+
+func (ab *apiV2Backend) fetch(path string, query url.Values, target any, campaignId CampaignId, ctx context.Context) error {
+	apiUrl, _ := ab.c.baseUrl.Parse("/api/oauth2/v2/" + path)
+	apiUrl.RawQuery = query.Encode()
+	header := http.Header{"Authorization": []string{"Bearer " + ab.accessToken}}
+	return ab.c.fetch(apiUrl, target, campaignId, header, ctx)
+}
+
+// fetchCampaignWithTiers fetches the campaign including its tiers, remembering the campaign of every tier.
+// All tiers are cached, as they came with the request anyway.
+func (ab *apiV2Backend) fetchCampaignWithTiers(id CampaignId, ctx context.Context) (*Campaign, []*Reward, error) {
+	query := url.Values{
+		"include":          {"tiers"},
+		"fields[campaign]": {apiV2CampaignFields},
+		"fields[tier]":     {apiV2TierFields},
+	}
+	document := &apiV2Document{}
+	if err := ab.fetch("campaigns/"+strconv.Itoa(int(id)), query, document, id, ctx); err != nil {
+		return nil, nil, err
+	}
+
+	campaign, err := document.Data.campaign()
+	if err != nil {
+		return nil, nil, err
+	}
+	var tiers []*Reward
+	for _, resource := range document.Included {
+		if resource.Type != "tier" {
+			continue
+		}
+		tier, err := resource.tier(campaign.Id, campaign.Attributes.Currency)
+		if err != nil {
+			return nil, nil, err
+		}
+		tiers = append(tiers, tier)
+	}
+
+	if cacheEnabled {
+		for _, tier := range tiers {
+			rewardsCache.Set(tier.Id, tier)
+		}
+	}
+
+	for _, tier := range tiers {
+		ab.tierCampaigns.set(tier.Id, campaign.Id)
+	}
+	return campaign, tiers, nil
+}
+
+// accessibleCampaigns returns the IDs of all campaigns the access token grants access to, following the
+// pagination cursors until the last page
+func (ab *apiV2Backend) accessibleCampaigns(ctx context.Context) ([]CampaignId, error) {
+	var ids []CampaignId
+	query := url.Values{}
+	for {
+		document := &apiV2ListDocument{}
+		if err := ab.fetch("campaigns", query, document, 0, ctx); err != nil {
+			return nil, err
+		}
+		for _, resource := range document.Data {
+			id, err := strconv.Atoi(resource.Id)
+			if err != nil {
+				return nil, fmt.Errorf("invalid campaign ID %q: %w", resource.Id, err)
+			}
+			ids = append(ids, CampaignId(id))
+		}
+
+		next := document.Meta.Pagination.Cursors.Next
+		if next == "" || next == query.Get("page[cursor]") {
+			return ids, nil
+		}
+		query.Set("page[cursor]", next)
+	}
+}
+
+func (ab *apiV2Backend) FetchReward(id RewardId, ctx context.Context) (*Reward, error) {
+	campaignId, known := ab.tierCampaigns.get(id)
+
+	notFound := &ResponseCodeError{
+		StatusCode: http.StatusNotFound,
+		Message:    fmt.Sprintf("tier %d not found in the campaigns accessible with the access token", id),
+	}
+	campaignIds := []CampaignId{campaignId}
+	if !known {
+		if _, missing := missingTiersCache.Get(id); missing {
+			return nil, notFound
+		}
+		var err error
+		if campaignIds, err = ab.accessibleCampaigns(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	// A campaign failing to load doesn't mean the tier is in it, so the others are checked anyway
+	var campaignErr error
+	for _, campaignId = range campaignIds {
+		_, tiers, err := ab.fetchCampaignWithTiers(campaignId, ctx)
+		if err != nil {
+			logging.Debugf("Error fetching campaign %d while looking for tier %d: %v", campaignId, id, err)
+			campaignErr = err
+			continue
+		}
+		for _, tier := range tiers {
+			if tier.Id == id {
+				return tier, nil
+			}
+		}
+	}
+	if campaignErr != nil {
+		// The tier might be in the campaign that failed to load
+		return nil, campaignErr
+	}
+	if !known {
+		missingTiersCache.Set(id, true)
+	}
+	return nil, notFound
+}
+
+func (ab *apiV2Backend) FetchCampaign(id CampaignId, ctx context.Context) (*Campaign, error) {
+	campaign, _, err := ab.fetchCampaignWithTiers(id, ctx)
+	return campaign, err
+}
+
+func (r *apiV2Resource) campaign() (*Campaign, error) {
+	id, err := strconv.Atoi(r.Id)
+	if err != nil {
+		return nil, fmt.Errorf("invalid campaign ID %q: %w", r.Id, err)
+	}
+	attributes := &apiV2CampaignAttributes{}
+	if err = json.Unmarshal(r.Attributes, attributes); err != nil {
+		return nil, err
+	}
+
+	campaign := &Campaign{Id: CampaignId(id), Type: "campaign", Attributes: attributes.CampaignAttributes}
+	// The API v2 has no display name, the vanity name is what the website shows
+	campaign.Attributes.Name = attributes.Vanity
+	if campaign.Attributes.Name == "" {
+		campaign.Attributes.Name = attributes.CreationName
+	}
+	return campaign, nil
+}
+
+// tier converts the resource to a tier of the campaign. Tiers without a currency of their own use the currency
+// of the campaign.
+func (r *apiV2Resource) tier(campaignId CampaignId, campaignCurrency util.Currency) (*Reward, error) {
+	id, err := strconv.Atoi(r.Id)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tier ID %q: %w", r.Id, err)
+	}
+	reward := &Reward{Id: RewardId(id)}
+	if err = json.Unmarshal(r.Attributes, &reward.Attributes); err != nil {
+		return nil, err
+	}
+	if reward.Attributes.Currency == "" {
+		reward.Attributes.Currency = campaignCurrency
+	}
+	if reward.Attributes.Currency == "" {
+		reward.Attributes.Currency = apiV2DefaultCurrency
+	}
+	reward.Relationships.Campaign.Data = RelationshipData{Id: int(campaignId), Type: "campaign"}
+
+	// The API v2 returns absolute URLs, the website API relative ones
+	if tierUrl, err := url.Parse(reward.Attributes.Url); err == nil && tierUrl.IsAbs() {
+		reward.Attributes.Url = tierUrl.RequestURI()
+	}
+	return reward, nil
+}
@@ -75,6 +75,13 @@ func (c *Cache[K, T]) Get(key K) (value T, found bool) {
 	return v.value, true
 }
 
+// Len returns the number of cached entries, including expired ones that haven't been cleaned up yet
+func (c *Cache[K, T]) Len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.values)
+}
+
 func (c *Cache[K, T]) Set(key K, value T) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -105,6 +112,14 @@ func init() {
 	}
 }
 
+// CacheSizes returns the number of entries per cache, keyed by the cache name
+func CacheSizes() map[string]int {
+	return map[string]int{
+		rewardsCache.Name():   rewardsCache.Len(),
+		campaignsCache.Name(): campaignsCache.Len(),
+	}
+}
+
 func OnStartup(appContext context.Context) {
 	if onStartupCalled {
 		logging.Debug("OnStartup() already called")
@@ -123,6 +138,12 @@ func OnStartup(appContext context.Context) {
 			defer cancel()
 			campaignsCache.startCleanupJob(cacheCleanup, ctx)
 		}()
+
+		go func() {
+			ctx, cancel := context.WithCancel(appContext)
+			defer cancel()
+			missingTiersCache.startCleanupJob(cacheCleanup, ctx)
+		}()
 	}
 
 	onStartupCalled = true
@@ -10,6 +10,8 @@ import (
 	"net/url"
 	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/fanonwue/goutils/logging"
 )
@@ -52,8 +54,6 @@ func (rs RewardStatus) String() string {
 	return rs.Text()
 }
 
-const userAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:146.0) Gecko/20100101 Firefox/146.0"
-
 type (
 	ResponseCodeError struct {
 		StatusCode int
@@ -63,6 +63,17 @@ type (
 	Client struct {
 		MaxParallelism int
 		httpClient     *http.Client
+		proxies        *ProxyPool
+		baseUrl        *url.URL
+		timeout        time.Duration
+		userAgents     []string
+		headers        http.Header
+		session        *Session
+		limiter        *RequestLimiter
+		backend        Backend
+		newBackend     func(*Client) Backend
+		// requestCounter rotates the user agents
+		requestCounter atomic.Uint64
 	}
 
 	RewardResult struct {
@@ -84,11 +95,24 @@ func (r *ResponseCodeError) Error() string {
 	return fmt.Sprintf("received status %d: %s", r.StatusCode, r.Message)
 }
 
-func NewClient(maxParallelism int) *Client {
-	return &Client{
+// NewClient creates a client that sends at most maxParallelism requests at once. Without options, requests are
+// sent directly to Patreon with a browser user agent and a timeout of 30 seconds.
+func NewClient(maxParallelism int, options ...ClientOption) *Client {
+	c := &Client{
 		MaxParallelism: maxParallelism,
 		httpClient:     &http.Client{},
+		baseUrl:        baseUrl,
+		timeout:        defaultTimeout,
+		userAgents:     []string{defaultUserAgent},
+	}
+	for _, option := range options {
+		option(c)
+	}
+	if c.newBackend == nil {
+		c.newBackend = newWebBackend
 	}
+	c.backend = c.newBackend(c)
+	return c
 }
 
 func (c *Client) CheckAvailability(rewardIds []RewardId, ctx context.Context) <-chan RewardResult {
@@ -112,7 +136,7 @@ func (c *Client) CheckAvailability(rewardIds []RewardId, ctx context.Context) <-
 	return rewardResults
 }
 
-func (c *Client) fetchRewardInternal(id RewardId, rewardChannel chan<- RewardResult, forceRefresh bool, callback func()) {
+func (c *Client) fetchRewardInternal(id RewardId, rewardChannel chan<- RewardResult, forceRefresh bool, ctx context.Context, callback func()) {
 	defer callback()
 	putInChannel := false
 	ra := RewardResult{
@@ -123,7 +147,7 @@ func (c *Client) fetchRewardInternal(id RewardId, rewardChannel chan<- RewardRes
 			rewardChannel <- ra
 		}
 	}()
-	reward, err := c.FetchReward(id, forceRefresh)
+	reward, err := c.FetchReward(id, forceRefresh, ctx)
 
 	if err == nil {
 		ra.Reward = reward
@@ -132,19 +156,8 @@ func (c *Client) fetchRewardInternal(id RewardId, rewardChannel chan<- RewardRes
 		var responseCodeError *ResponseCodeError
 		if errors.As(err, &responseCodeError) {
 			putInChannel = true
-			switch responseCodeError.StatusCode {
-			case http.StatusForbidden:
-				ra.Status = RewardErrorForbidden
-			case http.StatusNotFound:
-				ra.Status = RewardErrorNotFound
-			case http.StatusTooManyRequests:
-				ra.Status = RewardErrorRateLimit
-			case http.StatusInternalServerError:
-				ra.Status = RewardErrorInternalServerError
-			case http.StatusGatewayTimeout, http.StatusBadGateway:
-				ra.Status = RewardErrorGatewayError
-			default:
-				ra.Status = RewardErrorUnknown
+			ra.Status = statusFromError(err)
+			if ra.Status == RewardErrorUnknown {
 				logging.Errorf("unknown error fetching reward: %v", err)
 			}
 		} else {
@@ -153,6 +166,33 @@ func (c *Client) fetchRewardInternal(id RewardId, rewardChannel chan<- RewardRes
 	}
 }
 
+// statusFromError maps the error returned by a fetch to the matching RewardStatus
+func statusFromError(err error) RewardStatus {
+	if err == nil {
+		return RewardFound
+	}
+
+	var responseCodeError *ResponseCodeError
+	if !errors.As(err, &responseCodeError) {
+		return RewardErrorUnknown
+	}
+
+	switch responseCodeError.StatusCode {
+	case http.StatusForbidden:
+		return RewardErrorForbidden
+	case http.StatusNotFound:
+		return RewardErrorNotFound
+	case http.StatusTooManyRequests:
+		return RewardErrorRateLimit
+	case http.StatusInternalServerError:
+		return RewardErrorInternalServerError
+	case http.StatusGatewayTimeout, http.StatusBadGateway:
+		return RewardErrorGatewayError
+	default:
+		return RewardErrorUnknown
+	}
+}
+
 func (c *Client) FetchRewardsSlice(rewardIds []RewardId, forceRefresh bool, ctx context.Context) <-chan RewardResult {
 	return c.FetchRewards(slices.Values(rewardIds), forceRefresh, ctx)
 }
@@ -176,7 +216,7 @@ func (c *Client) FetchRewards(idIter iter.Seq[RewardId], forceRefresh bool, ctx
 			}
 			jobCounter += 1
 			wg.Add(1)
-			go c.fetchRewardInternal(id, rewardResults, forceRefresh, func() {
+			go c.fetchRewardInternal(id, rewardResults, forceRefresh, ctx, func() {
 				<-jobs
 				wg.Done()
 			})
@@ -186,7 +226,7 @@ func (c *Client) FetchRewards(idIter iter.Seq[RewardId], forceRefresh bool, ctx
 	return rewardResults
 }
 
-func (c *Client) FetchReward(id RewardId, forceRefresh bool) (*Reward, error) {
+func (c *Client) FetchReward(id RewardId, forceRefresh bool, ctx context.Context) (*Reward, error) {
 	if cacheEnabled && !forceRefresh {
 		cached, found := rewardsCache.Get(id)
 		if found && cached != nil {
@@ -194,11 +234,12 @@ func (c *Client) FetchReward(id RewardId, forceRefresh bool) (*Reward, error) {
 		}
 	}
 	logging.Debugf("Fetching reward %d", id)
-	reward := &RewardResponse{}
-	err := c.fetch(id.ApiUrl(), reward)
-	var rewardData *Reward
-	if err == nil && reward != nil {
-		rewardData = &reward.Data
+	rewardData, err := c.backend.FetchReward(id, ctx)
+	requestStats.record(statusFromError(err))
+	if err == nil && rewardData != nil {
+		if rewardCampaignId, campaignErr := rewardData.CampaignId(); c.proxies != nil && campaignErr == nil {
+			c.proxies.rememberCampaign(id, rewardCampaignId)
+		}
 		// Make sure the reward actually got found before caching it
 		if cacheEnabled && rewardData.Id != 0 {
 			rewardsCache.Set(id, rewardData)
@@ -207,7 +248,7 @@ func (c *Client) FetchReward(id RewardId, forceRefresh bool) (*Reward, error) {
 	return rewardData, err
 }
 
-func (c *Client) FetchCampaign(id CampaignId, forceRefresh bool) (*Campaign, error) {
+func (c *Client) FetchCampaign(id CampaignId, forceRefresh bool, ctx context.Context) (*Campaign, error) {
 	if cacheEnabled && !forceRefresh {
 		cached, found := campaignsCache.Get(id)
 		if found && cached != nil {
@@ -215,11 +256,8 @@ func (c *Client) FetchCampaign(id CampaignId, forceRefresh bool) (*Campaign, err
 		}
 	}
 	logging.Debugf("Fetching campaign %d", id)
-	campaign := &CampaignResponse{}
-	err := c.fetch(id.ApiUrl(), campaign)
-	var campaignData *Campaign
-	if err == nil && campaign != nil {
-		campaignData = &campaign.Data
+	campaignData, err := c.backend.FetchCampaign(id, ctx)
+	if err == nil && campaignData != nil {
 		// Make sure the campaign actually got found before caching it
 		if cacheEnabled && campaignData.Id != 0 {
 			campaignsCache.Set(id, campaignData)
@@ -228,13 +266,89 @@ func (c *Client) FetchCampaign(id CampaignId, forceRefresh bool) (*Campaign, err
 	return campaignData, err
 }
 
-//goland:noinspection GoBoolExpressions
-func (c *Client) fetch(url *url.URL, target any) error {
-	req, _ := http.NewRequest("GET", url.String(), nil)
-	if userAgent != "" {
-		req.Header.Add("User-Agent", userAgent)
+// campaignOf returns the campaign the reward is known to belong to, 0 if it is unknown
+func (c *Client) campaignOf(id RewardId) CampaignId {
+	if c.proxies != nil {
+		return c.proxies.campaignOf(id)
+	}
+	return 0
+}
+
+// nextUserAgent returns the user agent for the next request, rotating through the configured ones
+func (c *Client) nextUserAgent() string {
+	if len(c.userAgents) == 0 {
+		return ""
+	}
+	return c.userAgents[(c.requestCounter.Add(1)-1)%uint64(len(c.userAgents))]
+}
+
+// fetchWithSession requests the URL anonymously, retrying with the session if anonymous access is forbidden.
+// If Patreon rejects the session, it gets marked as expired. If the retry is forbidden as well, the session is
+// validated right away, as the session may have lost its access or the reward may be restricted.
+func (c *Client) fetchWithSession(url *url.URL, target any, campaignId CampaignId, ctx context.Context) error {
+	err := c.fetch(url, target, campaignId, nil, ctx)
+	if statusFromError(err) != RewardErrorForbidden {
+		return err
+	}
+	cookie, active := c.session.activeCookie()
+	if !active {
+		return err
+	}
+
+	logging.Debugf("Anonymous access to %s forbidden, retrying with session", url.String())
+	err = c.fetch(url, target, campaignId, sessionHeader(cookie), ctx)
+	switch {
+	case err == nil:
+		c.session.markValid(cookie)
+	case statusFromError(err) == RewardErrorForbidden:
+		if c.session.markSuspect(cookie) {
+			logging.Infof("Access to %s forbidden with session, validating the session", url.String())
+			if validateErr := c.ValidateSession(ctx); validateErr != nil && !errors.Is(validateErr, ErrSessionExpired) {
+				logging.Warnf("Error validating the Patreon session: %v", validateErr)
+			}
+			c.session.clearSuspect()
+		}
+	case isSessionRejected(err):
+		c.session.markExpired(cookie)
+	}
+	return err
+}
+
+// fetch requests the URL, routing the request through a proxy if a pool is configured. The campaign the request
+// belongs to is used to select the proxy, pass 0 if it is not known. The header is added to the request.
+// The request is aborted once the context is done.
+func (c *Client) fetch(url *url.URL, target any, campaignId CampaignId, header http.Header, ctx context.Context) error {
+	if c.proxies == nil {
+		return c.fetchWith(c.httpClient, url, target, header, ctx)
+	}
+	p := c.proxies.pick(campaignId, time.Now())
+	err := c.fetchWith(p.httpClient, url, target, header, ctx)
+	c.proxies.record(p, err, time.Now())
+	return err
+}
+
+func (c *Client) fetchWith(httpClient *http.Client, url *url.URL, target any, header http.Header, ctx context.Context) error {
+	if c.limiter != nil {
+		if err := c.limiter.wait(ctx); err != nil {
+			return err
+		}
+	}
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	req, _ := http.NewRequestWithContext(ctx, "GET", url.String(), nil)
+	if userAgent := c.nextUserAgent(); userAgent != "" {
+		req.Header.Set("User-Agent", userAgent)
+	}
+	for name, values := range c.headers {
+		req.Header[name] = values
+	}
+	for name, values := range header {
+		req.Header[name] = values
 	}
-	resp, err := c.httpClient.Do(req)
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		return err
 	}
@@ -246,6 +360,8 @@ func (c *Client) fetch(url *url.URL, target any) error {
 		return json.NewDecoder(resp.Body).Decode(target)
 	case http.StatusNotFound:
 		return &ResponseCodeError{StatusCode: resp.StatusCode, Message: fmt.Sprintf("URL not found: %s", url.String())}
+	case http.StatusUnauthorized:
+		return &ResponseCodeError{StatusCode: resp.StatusCode, Message: fmt.Sprintf("unauthorized for URL: %s", url.String())}
 	case http.StatusForbidden:
 		return &ResponseCodeError{StatusCode: resp.StatusCode, Message: fmt.Sprintf("access forbidden for URL: %s", url.String())}
 	case http.StatusTooManyRequests:
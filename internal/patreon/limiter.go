@@ -0,0 +1,92 @@
+package patreon
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RequestLimiter is a token bucket limiting the number of requests sent to Patreon per minute. All clients sharing
+// a limiter draw from the same budget, so requests sent for commands count towards it as well as update runs.
+// The bucket holds at most a minute worth of requests, which allows short bursts.
+type RequestLimiter struct {
+	mu        sync.Mutex
+	perMinute int
+	tokens    float64
+	updated   time.Time
+}
+
+// NewRequestLimiter creates a limiter allowing perMinute requests per minute, starting with a full bucket
+func NewRequestLimiter(perMinute int) *RequestLimiter {
+	return &RequestLimiter{
+		perMinute: perMinute,
+		tokens:    float64(perMinute),
+		updated:   time.Now(),
+	}
+}
+
+// refill adds the tokens accumulated since the last update. The caller has to hold the lock.
+func (rl *RequestLimiter) refill(now time.Time) {
+	if elapsed := now.Sub(rl.updated); elapsed > 0 {
+		rl.tokens = min(float64(rl.perMinute), rl.tokens+elapsed.Minutes()*float64(rl.perMinute))
+		rl.updated = now
+	}
+}
+
+// reserve takes a token, returning the time to wait until it is available. Tokens are taken even if they are not
+// available yet, so waiting requests are served in order.
+func (rl *RequestLimiter) reserve(now time.Time) time.Duration {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.refill(now)
+	rl.tokens--
+	if rl.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-rl.tokens / float64(rl.perMinute) * float64(time.Minute))
+}
+
+// release returns a token taken by reserve that didn't get used
+func (rl *RequestLimiter) release() {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.tokens = min(float64(rl.perMinute), rl.tokens+1)
+}
+
+// wait blocks until a request may be sent. Returns the error of the context if it is done before.
+func (rl *RequestLimiter) wait(ctx context.Context) error {
+	delay := rl.reserve(time.Now())
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		rl.release()
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Available returns the number of requests that can be sent within the given duration without waiting, counting
+// the requests available right now and the ones becoming available during the duration
+func (rl *RequestLimiter) Available(within time.Duration) int {
+	return rl.availableAt(time.Now(), within)
+}
+
+func (rl *RequestLimiter) availableAt(now time.Time, within time.Duration) int {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.refill(now)
+	return max(0, int(rl.tokens+within.Minutes()*float64(rl.perMinute)))
+}
+
+// PerMinute returns the number of requests allowed per minute
+func (rl *RequestLimiter) PerMinute() int {
+	return rl.perMinute
+}
@@ -55,12 +55,13 @@ type (
 	}
 
 	CampaignAttributes struct {
-		Name        string    `json:"name"`
-		Url         string    `json:"url"`
-		ImageUrl    string    `json:"image_url"`
-		CreatedAt   time.Time `json:"created_at"`
-		PublishedAt time.Time `json:"published_at"`
-		Nsfw        bool      `json:"is_nsfw"`
+		Name        string        `json:"name"`
+		Url         string        `json:"url"`
+		ImageUrl    string        `json:"image_url"`
+		CreatedAt   time.Time     `json:"created_at"`
+		PublishedAt time.Time     `json:"published_at"`
+		Nsfw        bool          `json:"is_nsfw"`
+		Currency    util.Currency `json:"currency"`
 	}
 
 	Campaign struct {
@@ -151,12 +152,20 @@ func (id *CampaignId) UnmarshalJSON(buf []byte) error {
 }
 
 func (id *RewardId) ApiUrl() *url.URL {
-	apiUrl, _ := baseUrl.Parse("/api/rewards/" + strconv.Itoa(int(*id)))
+	return id.apiUrlAt(baseUrl)
+}
+
+func (id *RewardId) apiUrlAt(base *url.URL) *url.URL {
+	apiUrl, _ := base.Parse("/api/rewards/" + strconv.Itoa(int(*id)))
 	return apiUrl
 }
 
 func (id *CampaignId) ApiUrl() *url.URL {
-	apiUrl, _ := baseUrl.Parse("/api/campaigns/" + strconv.Itoa(int(*id)))
+	return id.apiUrlAt(baseUrl)
+}
+
+func (id *CampaignId) apiUrlAt(base *url.URL) *url.URL {
+	apiUrl, _ := base.Parse("/api/campaigns/" + strconv.Itoa(int(*id)))
 	return apiUrl
 }
 
@@ -167,3 +176,19 @@ func (id *RewardId) Compare(b *RewardId) int {
 func (id *CampaignId) Compare(b *CampaignId) int {
 	return int(*id) - int(*b)
 }
+
+// RewardIdFromUrl extracts the reward ID from a Patreon checkout link, which carries it in the "rid" parameter
+func RewardIdFromUrl(rawUrl string) (RewardId, bool) {
+	parsedUrl, err := url.Parse(rawUrl)
+	if err != nil {
+		return 0, false
+	}
+	if host := strings.ToLower(parsedUrl.Hostname()); host != baseUrl.Hostname() && host != "patreon.com" {
+		return 0, false
+	}
+	id, err := strconv.Atoi(parsedUrl.Query().Get("rid"))
+	if err != nil || id <= 0 {
+		return 0, false
+	}
+	return RewardId(id), true
+}
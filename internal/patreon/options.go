@@ -0,0 +1,128 @@
+package patreon
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fanonwue/goutils/logging"
+	"github.com/fanonwue/patreon-gobot/internal/util"
+)
+
+const (
+	defaultUserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:146.0) Gecko/20100101 Firefox/146.0"
+	defaultTimeout   = 30 * time.Second
+	// envListSeparator separates entries of list environment variables, as user agents commonly contain commas
+	envListSeparator = "|"
+)
+
+// ClientOption configures a Client created by NewClient
+type ClientOption func(*Client)
+
+// WithTimeout limits the time a single request may take, including reading the response. Zero disables the timeout.
+func WithTimeout(timeout time.Duration) ClientOption {
+	return func(c *Client) {
+		c.timeout = timeout
+	}
+}
+
+// WithUserAgent sets the user agent sent with every request. An empty user agent omits the header.
+func WithUserAgent(userAgent string) ClientOption {
+	return WithUserAgents([]string{userAgent})
+}
+
+// WithUserAgents rotates through the given user agents request by request
+func WithUserAgents(userAgents []string) ClientOption {
+	return func(c *Client) {
+		c.userAgents = userAgents
+	}
+}
+
+// WithHeaders adds the headers to every request, overriding the user agent if the headers contain one
+func WithHeaders(headers http.Header) ClientOption {
+	return func(c *Client) {
+		c.headers = headers.Clone()
+	}
+}
+
+// WithTransport sets the RoundTripper used for requests that are not routed through a proxy
+func WithTransport(transport http.RoundTripper) ClientOption {
+	return func(c *Client) {
+		c.httpClient.Transport = transport
+	}
+}
+
+// WithBaseUrl sends API requests to the given base URL instead of Patreon
+func WithBaseUrl(baseUrl *url.URL) ClientOption {
+	return func(c *Client) {
+		c.baseUrl = baseUrl
+	}
+}
+
+// WithProxyPool routes requests through the proxies of the pool. A nil pool sends requests directly.
+func WithProxyPool(proxies *ProxyPool) ClientOption {
+	return func(c *Client) {
+		c.proxies = proxies
+	}
+}
+
+// WithRequestLimiter makes every request wait for the limiter, so the requests of all clients sharing it stay
+// within its budget. A nil limiter doesn't limit requests.
+func WithRequestLimiter(limiter *RequestLimiter) ClientOption {
+	return func(c *Client) {
+		c.limiter = limiter
+	}
+}
+
+// ClientOptionsFromEnv reads client options from the environment:
+//   - HTTP_TIMEOUT: request timeout in seconds
+//   - USER_AGENTS: user agents to rotate through, separated by "|"
+//   - HTTP_HEADERS: extra headers in the form "Name: value", separated by "|"
+//   - BACKEND: "web" (default) or "api-v2", which needs the access token in API_ACCESS_TOKEN
+func ClientOptionsFromEnv() []ClientOption {
+	var options []ClientOption
+
+	if backendOption := backendOptionFromEnv(); backendOption != nil {
+		options = append(options, backendOption)
+	}
+
+	if rawTimeout := os.Getenv(util.PrefixEnvVar("HTTP_TIMEOUT")); rawTimeout != "" {
+		if seconds, err := strconv.Atoi(rawTimeout); err == nil && seconds >= 0 {
+			options = append(options, WithTimeout(time.Duration(seconds)*time.Second))
+		} else {
+			logging.Warnf("Invalid value for HTTP_TIMEOUT, using the default of %s", defaultTimeout)
+		}
+	}
+
+	if userAgents := splitEnvList(os.Getenv(util.PrefixEnvVar("USER_AGENTS"))); len(userAgents) > 0 {
+		options = append(options, WithUserAgents(userAgents))
+	}
+
+	if rawHeaders := splitEnvList(os.Getenv(util.PrefixEnvVar("HTTP_HEADERS"))); len(rawHeaders) > 0 {
+		headers := make(http.Header)
+		for _, rawHeader := range rawHeaders {
+			name, value, found := strings.Cut(rawHeader, ":")
+			if !found || strings.TrimSpace(name) == "" {
+				logging.Warnf("Ignoring invalid header in HTTP_HEADERS: %s", rawHeader)
+				continue
+			}
+			headers.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+		}
+		options = append(options, WithHeaders(headers))
+	}
+
+	return options
+}
+
+func splitEnvList(raw string) []string {
+	var values []string
+	for _, value := range strings.Split(raw, envListSeparator) {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
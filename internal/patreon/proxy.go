@@ -0,0 +1,302 @@
+package patreon
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fanonwue/goutils/logging"
+	"github.com/fanonwue/patreon-gobot/internal/util"
+)
+
+type ProxyStrategy string
+
+const (
+	// ProxyRoundRobin rotates through the available proxies request by request
+	ProxyRoundRobin ProxyStrategy = "round-robin"
+	// ProxySticky routes all requests belonging to the same campaign through the same proxy, as long as it is available
+	ProxySticky ProxyStrategy = "sticky"
+)
+
+const (
+	defaultProxyMaxFailures   = 5
+	defaultProxyEjectDuration = 10 * time.Minute
+	// maxProxyEjectDuration caps the ejection of proxies that keep failing their probes
+	maxProxyEjectDuration = 6 * time.Hour
+)
+
+type (
+	// ProxyStats describes the requests sent through a single proxy
+	ProxyStats struct {
+		Url          string
+		Requests     int
+		Succeeded    int
+		Forbidden    int
+		RateLimited  int
+		Errors       int
+		Ejected      bool
+		EjectedUntil time.Time
+	}
+
+	proxy struct {
+		url        *url.URL
+		httpClient *http.Client
+		stats      ProxyStats
+		// failures counts the consecutive failed requests
+		failures      int
+		ejectDuration time.Duration
+		ejectedUntil  time.Time
+		probing       bool
+	}
+
+	// ProxyPool distributes requests to Patreon across a set of HTTP or SOCKS5 proxies. Proxies that keep failing
+	// with 403 or 429 responses are ejected for a while. Once the ejection is over, a single request probes the
+	// proxy, restoring it on success and ejecting it for twice as long on failure. Probes are sent by
+	// Client.ProbeProxies, or by the next request if that comes first.
+	ProxyPool struct {
+		mu           sync.Mutex
+		proxies      []*proxy
+		strategy     ProxyStrategy
+		maxFailures  int
+		ejectionTime time.Duration
+		next         int
+		// campaigns remembers the campaign of each reward, so requests for rewards can be sticky as well
+		campaigns map[RewardId]CampaignId
+	}
+)
+
+// NewProxyPool creates a pool of the given proxy URLs, or returns nil if there are none. Supported schemes are
+// http, https and socks5.
+func NewProxyPool(rawUrls []string, strategy ProxyStrategy) (*ProxyPool, error) {
+	if strategy != ProxyRoundRobin && strategy != ProxySticky {
+		return nil, fmt.Errorf("unknown proxy strategy %q", strategy)
+	}
+
+	pool := &ProxyPool{
+		strategy:     strategy,
+		maxFailures:  defaultProxyMaxFailures,
+		ejectionTime: defaultProxyEjectDuration,
+		campaigns:    make(map[RewardId]CampaignId),
+	}
+	for _, rawUrl := range rawUrls {
+		rawUrl = strings.TrimSpace(rawUrl)
+		if rawUrl == "" {
+			continue
+		}
+		proxyUrl, err := url.Parse(rawUrl)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL %q: %w", rawUrl, err)
+		}
+		switch proxyUrl.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return nil, fmt.Errorf("unsupported proxy scheme %q", proxyUrl.Scheme)
+		}
+
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.Proxy = http.ProxyURL(proxyUrl)
+		pool.proxies = append(pool.proxies, &proxy{
+			url:        proxyUrl,
+			httpClient: &http.Client{Transport: transport},
+			stats:      ProxyStats{Url: redactedProxyUrl(proxyUrl)},
+		})
+	}
+	if len(pool.proxies) == 0 {
+		return nil, nil
+	}
+	return pool, nil
+}
+
+// ProxyPoolFromEnv creates the proxy pool configured by the PROXIES environment variable, a comma separated
+// list of proxy URLs. Returns nil if no proxies are configured, which means requests are sent directly.
+func ProxyPoolFromEnv() (*ProxyPool, error) {
+	rawUrls := os.Getenv(util.PrefixEnvVar("PROXIES"))
+	if strings.TrimSpace(rawUrls) == "" {
+		return nil, nil
+	}
+
+	strategy := ProxyStrategy(strings.ToLower(os.Getenv(util.PrefixEnvVar("PROXY_STRATEGY"))))
+	if strategy == "" {
+		strategy = ProxyRoundRobin
+	}
+	pool, err := NewProxyPool(strings.Split(rawUrls, ","), strategy)
+	if err != nil || pool == nil {
+		return pool, err
+	}
+
+	if maxFailures, err := strconv.Atoi(os.Getenv(util.PrefixEnvVar("PROXY_MAX_FAILURES"))); err == nil && maxFailures > 0 {
+		pool.maxFailures = maxFailures
+	}
+	if ejectMinutes, err := strconv.Atoi(os.Getenv(util.PrefixEnvVar("PROXY_EJECT_DURATION"))); err == nil && ejectMinutes > 0 {
+		pool.ejectionTime = time.Duration(ejectMinutes) * time.Minute
+	}
+	logging.Infof("Using %d proxies (%s)", len(pool.proxies), pool.strategy)
+	return pool, nil
+}
+
+// redactedProxyUrl hides the credentials of the proxy, so the URL can be shown in stats and logs
+func redactedProxyUrl(proxyUrl *url.URL) string {
+	redacted := *proxyUrl
+	if redacted.User != nil {
+		redacted.User = url.User(redacted.User.Username())
+	}
+	return redacted.String()
+}
+
+// pick returns the proxy the next request should be sent through. The campaign is used by the sticky strategy,
+// pass 0 if it is not known. Ejected proxies are skipped, unless they are due to be probed. If all proxies are
+// ejected, the one whose ejection ends first gets used anyway.
+func (pp *ProxyPool) pick(campaignId CampaignId, now time.Time) *proxy {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	start := pp.next
+	if pp.strategy == ProxySticky && campaignId > 0 {
+		start = int(campaignId % CampaignId(len(pp.proxies)))
+	} else {
+		pp.next = (pp.next + 1) % len(pp.proxies)
+	}
+
+	for i := range pp.proxies {
+		p := pp.proxies[(start+i)%len(pp.proxies)]
+		if p.ejectedUntil.IsZero() {
+			return p
+		}
+		if !p.probing && !now.Before(p.ejectedUntil) {
+			p.probing = true
+			logging.Infof("Probing proxy %s", p.stats.Url)
+			return p
+		}
+	}
+
+	return slices.MinFunc(pp.proxies, func(a, b *proxy) int {
+		return a.ejectedUntil.Compare(b.ejectedUntil)
+	})
+}
+
+// record updates the stats of the proxy with the result of a request, ejecting it if it keeps failing
+func (pp *ProxyPool) record(p *proxy, err error, now time.Time) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	p.stats.Requests++
+	failed := false
+	switch status := statusFromError(err); {
+	case err == nil:
+		p.stats.Succeeded++
+	case status == RewardErrorForbidden:
+		p.stats.Forbidden++
+		failed = true
+	case status == RewardErrorRateLimit:
+		p.stats.RateLimited++
+		failed = true
+	default:
+		p.stats.Errors++
+	}
+
+	wasProbing := p.probing
+	p.probing = false
+	if !failed {
+		// Only 403 and 429 indicate that Patreon refuses the proxy, anything else doesn't count against it.
+		// Ejected proxies are used as well if all of them are ejected, so a success restores the proxy even
+		// if it wasn't probed.
+		p.failures = 0
+		if !p.ejectedUntil.IsZero() && (wasProbing || err == nil) {
+			logging.Infof("Proxy %s is available again", p.stats.Url)
+			p.ejectedUntil = time.Time{}
+			p.ejectDuration = 0
+		}
+		return
+	}
+
+	p.failures++
+	switch {
+	case wasProbing:
+		p.ejectDuration = min(2*p.ejectDuration, maxProxyEjectDuration)
+	case p.ejectedUntil.IsZero() && p.failures >= pp.maxFailures:
+		p.ejectDuration = pp.ejectionTime
+	default:
+		return
+	}
+	p.ejectedUntil = now.Add(p.ejectDuration)
+	logging.Warnf("Ejecting proxy %s for %s after %d failed requests", p.stats.Url, p.ejectDuration, p.failures)
+}
+
+// dueForProbe returns the ejected proxies whose ejection is over, marking them as being probed
+func (pp *ProxyPool) dueForProbe(now time.Time) []*proxy {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	var due []*proxy
+	for _, p := range pp.proxies {
+		if !p.ejectedUntil.IsZero() && !p.probing && !now.Before(p.ejectedUntil) {
+			p.probing = true
+			due = append(due, p)
+		}
+	}
+	return due
+}
+
+// ProbeProxies sends a request through every ejected proxy whose ejection is over, so proxies are restored even
+// if there are no requests to send otherwise. The probes count towards the request limit like any other request.
+func (c *Client) ProbeProxies(ctx context.Context) {
+	if c.proxies == nil {
+		return
+	}
+	probeUrl, _ := c.baseUrl.Parse("/api/current_user")
+	for _, p := range c.proxies.dueForProbe(time.Now()) {
+		logging.Infof("Probing proxy %s", p.stats.Url)
+		// Without a session, Patreon responds with 401, which is fine as long as it doesn't refuse the proxy
+		err := c.fetchWith(p.httpClient, probeUrl, &struct{}{}, nil, ctx)
+		if ctx.Err() != nil {
+			c.proxies.abortProbe(p)
+			return
+		}
+		c.proxies.record(p, err, time.Now())
+	}
+}
+
+// abortProbe allows probing the proxy again, used if the probe couldn't be sent
+func (pp *ProxyPool) abortProbe(p *proxy) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	p.probing = false
+}
+
+// campaignOf returns the campaign the reward belongs to, if known
+func (pp *ProxyPool) campaignOf(id RewardId) CampaignId {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	return pp.campaigns[id]
+}
+
+func (pp *ProxyPool) rememberCampaign(id RewardId, campaignId CampaignId) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	pp.campaigns[id] = campaignId
+}
+
+// Stats returns the stats of all proxies in the pool
+func (pp *ProxyPool) Stats() []ProxyStats {
+	if pp == nil {
+		return nil
+	}
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	stats := make([]ProxyStats, 0, len(pp.proxies))
+	for _, p := range pp.proxies {
+		s := p.stats
+		s.Ejected = !p.ejectedUntil.IsZero()
+		s.EjectedUntil = p.ejectedUntil
+		stats = append(stats, s)
+	}
+	return stats
+}
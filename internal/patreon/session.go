@@ -0,0 +1,177 @@
+package patreon
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fanonwue/goutils/logging"
+)
+
+const sessionCookieName = "session_id"
+
+var (
+	ErrNoSession      = errors.New("no Patreon session configured")
+	ErrSessionExpired = errors.New("the Patreon session has expired")
+)
+
+type (
+	// Session holds the cookie of a logged in Patreon session. Requests that are forbidden for anonymous users
+	// are retried with it. Once Patreon rejects the session, it is marked as expired and not used anymore,
+	// until a new one gets set.
+	Session struct {
+		mu      sync.RWMutex
+		cookie  string
+		expired bool
+		// suspect is set while the session gets validated after a forbidden request
+		suspect   bool
+		validated time.Time
+		onExpired func()
+	}
+
+	// SessionStatus describes the state of the session
+	SessionStatus struct {
+		Configured bool
+		Expired    bool
+		// Validated is the last time Patreon accepted the session, zero if it never did
+		Validated time.Time
+	}
+)
+
+// NewSession creates an empty session. onExpired gets called once the session expires, it may be nil.
+func NewSession(onExpired func()) *Session {
+	return &Session{onExpired: onExpired}
+}
+
+// WithSession retries requests forbidden for anonymous users with the session
+func WithSession(session *Session) ClientOption {
+	return func(c *Client) {
+		c.session = session
+	}
+}
+
+// Set replaces the session cookie. Both the plain value of the session_id cookie and a full Cookie header are
+// accepted.
+func (s *Session) Set(cookie string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cookie = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(cookie), "Cookie:"))
+	if cookie != "" && !strings.Contains(cookie, "=") {
+		cookie = sessionCookieName + "=" + cookie
+	}
+	s.cookie = cookie
+	s.expired = false
+	s.suspect = false
+	s.validated = time.Time{}
+}
+
+// Clear removes the session
+func (s *Session) Clear() {
+	s.Set("")
+}
+
+// Status returns the current state of the session
+func (s *Session) Status() SessionStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return SessionStatus{Configured: s.cookie != "", Expired: s.expired, Validated: s.validated}
+}
+
+// activeCookie returns the Cookie header of the session, if it's configured and not expired
+func (s *Session) activeCookie() (string, bool) {
+	if s == nil {
+		return "", false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cookie, s.cookie != "" && !s.expired
+}
+
+func (s *Session) markValid(cookie string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cookie == cookie {
+		s.expired = false
+		s.suspect = false
+		s.validated = time.Now()
+	}
+}
+
+// markSuspect marks the session as suspect after Patreon forbade a request made with it. Returns true if the
+// session needs to be validated, false if it got replaced, expired or is being validated already.
+func (s *Session) markSuspect(cookie string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cookie != cookie || s.expired || s.suspect {
+		return false
+	}
+	s.suspect = true
+	return true
+}
+
+func (s *Session) clearSuspect() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.suspect = false
+}
+
+// markExpired marks the session as expired, calling onExpired if it wasn't expired before. The cookie the
+// rejected request was sent with is passed, so a session that got replaced in the meantime is left alone.
+func (s *Session) markExpired(cookie string) {
+	s.mu.Lock()
+	if s.cookie != cookie || s.expired {
+		s.mu.Unlock()
+		return
+	}
+	s.expired = true
+	s.suspect = false
+	s.mu.Unlock()
+
+	logging.Warn("The Patreon session has expired")
+	if s.onExpired != nil {
+		s.onExpired()
+	}
+}
+
+func sessionHeader(cookie string) http.Header {
+	return http.Header{"Cookie": []string{cookie}}
+}
+
+// isSessionRejected checks whether the error of an authenticated request means Patreon doesn't accept the session.
+// Patreon answers with 403 instead of 401 for some expired sessions, so a 403 for a request that only needs a
+// logged in user counts as well.
+func isSessionRejected(err error) bool {
+	var responseCodeError *ResponseCodeError
+	if !errors.As(err, &responseCodeError) {
+		return false
+	}
+	return responseCodeError.StatusCode == http.StatusUnauthorized || responseCodeError.StatusCode == http.StatusForbidden
+}
+
+// ValidateSession checks whether Patreon still accepts the session by requesting the current user, marking it as
+// expired if not
+func (c *Client) ValidateSession(ctx context.Context) error {
+	cookie, active := c.session.activeCookie()
+	if !active {
+		if c.session != nil && c.session.Status().Expired {
+			return ErrSessionExpired
+		}
+		return ErrNoSession
+	}
+
+	currentUserUrl, _ := c.baseUrl.Parse("/api/current_user")
+	err := c.fetch(currentUserUrl, &struct{}{}, 0, sessionHeader(cookie), ctx)
+	switch {
+	case err == nil:
+		c.session.markValid(cookie)
+		return nil
+	case isSessionRejected(err):
+		c.session.markExpired(cookie)
+		return ErrSessionExpired
+	default:
+		return err
+	}
+}
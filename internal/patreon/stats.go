@@ -0,0 +1,91 @@
+package patreon
+
+import (
+	"sync"
+	"time"
+)
+
+const statsBucketCount = 60
+const statsBucketDuration = time.Minute
+
+type (
+	statsBucket struct {
+		start  time.Time
+		counts map[RewardStatus]int
+	}
+
+	// RequestStats counts reward requests sent to Patreon by their resulting status, using one bucket per minute
+	RequestStats struct {
+		mu      sync.Mutex
+		buckets [statsBucketCount]statsBucket
+	}
+)
+
+var requestStats = &RequestStats{}
+
+func (rs *RequestStats) record(status RewardStatus) {
+	rs.recordAt(status, time.Now())
+}
+
+func (rs *RequestStats) recordAt(status RewardStatus, at time.Time) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	start := at.Truncate(statsBucketDuration)
+	bucket := &rs.buckets[start.Unix()/int64(statsBucketDuration.Seconds())%statsBucketCount]
+	if !bucket.start.Equal(start) {
+		bucket.start = start
+		bucket.counts = make(map[RewardStatus]int)
+	}
+	bucket.counts[status]++
+}
+
+// Since returns the number of requests per status since the given time, limited to the last hour
+func (rs *RequestStats) Since(since time.Time) map[RewardStatus]int {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	oldest := time.Now().Add(-statsBucketCount * statsBucketDuration)
+	counts := make(map[RewardStatus]int)
+	for _, bucket := range rs.buckets {
+		if bucket.start.Before(since.Truncate(statsBucketDuration)) || !bucket.start.After(oldest) {
+			continue
+		}
+		for status, count := range bucket.counts {
+			counts[status] += count
+		}
+	}
+	return counts
+}
+
+// PerMinute returns the total number of requests for each of the given number of minutes up to the reference time,
+// oldest first. The minute of the reference time is included, even though it's not over yet.
+func (rs *RequestStats) PerMinute(minutes int, at time.Time) []int {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	minutes = min(minutes, statsBucketCount)
+	current := at.Truncate(statsBucketDuration)
+	counts := make([]int, minutes)
+	for _, bucket := range rs.buckets {
+		age := int(current.Sub(bucket.start) / statsBucketDuration)
+		if bucket.start.IsZero() || age < 0 || age >= minutes {
+			continue
+		}
+		for _, count := range bucket.counts {
+			counts[minutes-1-age] += count
+		}
+	}
+	return counts
+}
+
+// RequestsPerMinute returns the number of reward requests sent to Patreon during each of the last minutes,
+// oldest first, which shows how evenly the requests are spread
+func RequestsPerMinute(minutes int) []int {
+	return requestStats.PerMinute(minutes, time.Now())
+}
+
+// RequestsLastHour returns the number of reward requests sent to Patreon during the last hour, grouped by status
+func RequestsLastHour() map[RewardStatus]int {
+	return requestStats.Since(time.Now().Add(-time.Hour))
+}
@@ -0,0 +1,336 @@
+package telegram
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fanonwue/goutils/logging"
+	"github.com/fanonwue/patreon-gobot/internal/db"
+	"github.com/fanonwue/patreon-gobot/internal/util"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"gorm.io/gorm"
+)
+
+type accessMode string
+
+const (
+	// accessModeOpen lets everyone use the bot after registering via /start
+	accessModeOpen accessMode = "open"
+	// accessModeRestricted requires new users to either redeem an invite or to be approved by an admin
+	accessModeRestricted accessMode = "restricted"
+)
+
+const inviteValidity = 7 * 24 * time.Hour
+
+const (
+	callbackAccessPrefix  = "access:"
+	callbackAccessApprove = callbackAccessPrefix + "approve:"
+	callbackAccessReject  = callbackAccessPrefix + "reject:"
+)
+
+var currentAccessMode = accessModeRestricted
+
+// accessModeFromEnv reads the access mode. Without explicit configuration, the bot is restricted if a creator
+// has been configured and open otherwise.
+func accessModeFromEnv() accessMode {
+	switch mode := accessMode(strings.ToLower(os.Getenv(util.PrefixEnvVar("ACCESS_MODE")))); mode {
+	case accessModeOpen, accessModeRestricted:
+		return mode
+	case "":
+		if telegramCreatorId > 0 {
+			return accessModeRestricted
+		}
+		return accessModeOpen
+	default:
+		logging.Warnf("Unknown access mode %s, defaulting to %s", mode, accessModeRestricted)
+		return accessModeRestricted
+	}
+}
+
+// isCommand checks whether the text invokes the command, with or without arguments
+func isCommand(text string, command string) bool {
+	return strings.EqualFold(text, command) || strings.HasPrefix(strings.ToLower(text), strings.ToLower(command)+" ")
+}
+
+// accessControlMiddleware only lets users with access use the bot. The privacy policy, /start (which is used
+// to request access) and acknowledging notifications are always allowed.
+func accessControlMiddleware(next bot.HandlerFunc) bot.HandlerFunc {
+	return func(ctx context.Context, b *bot.Bot, update *models.Update) {
+		if update.Message != nil && (isCommand(update.Message.Text, privacyPolicyCommand.Pattern) || isCommand(update.Message.Text, startCommandPattern)) {
+			next(ctx, b, update)
+			return
+		}
+		// Notifications may have been sent to a channel, so the sender isn't necessarily a user of the bot.
+		// The handler checks whether the sender may acknowledge notifications of the user the reward belongs to.
+		if update.CallbackQuery != nil && strings.HasPrefix(update.CallbackQuery.Data, callbackAcknowledgePrefix) {
+			next(ctx, b, update)
+			return
+		}
+
+		chatId, err := chatIdFromUpdate(update)
+		if err != nil {
+			return
+		}
+
+		user, found := userFromChatId(chatId, nil)
+		if found && user.HasAccess() {
+			next(ctx, b, update)
+			return
+		}
+		if found && user.Role == db.RoleBanned {
+			return
+		}
+		if update.InlineQuery != nil {
+			// Inline queries can't be answered with a message, so point the user to the bot instead
+			_, _ = b.AnswerInlineQuery(ctx, &bot.AnswerInlineQueryParams{
+				InlineQueryID: update.InlineQuery.ID,
+				Results:       []models.InlineQueryResult{},
+				IsPersonal:    true,
+				Button:        &models.InlineQueryResultsButton{Text: "Register to search your rewards", StartParameter: "inline"},
+			})
+			return
+		}
+
+		text := "Please register via /start first"
+		if found && user.Role == db.RolePending {
+			text = "Your access request has not been approved yet. You will be notified once an admin approves it."
+		}
+		sendMessage(ctx, &bot.SendMessageParams{
+			ChatID: chatId,
+			Text:   text,
+		})
+	}
+}
+
+// adminOnly wraps the handler so it only gets called for admins
+func adminOnly(next bot.HandlerFunc) bot.HandlerFunc {
+	return func(ctx context.Context, b *bot.Bot, update *models.Update) {
+		chatId, err := chatIdFromUpdate(update)
+		if err != nil {
+			return
+		}
+
+		if user, found := userFromChatId(chatId, nil); !found || !user.IsAdmin() {
+			sendMessage(ctx, &bot.SendMessageParams{
+				ChatID: chatId,
+				Text:   "This command is only available for admins",
+			})
+			return
+		}
+		next(ctx, b, update)
+	}
+}
+
+// initialRole determines the role of a newly registered user, redeeming the invite code if needed.
+// Returns the redeemed invite, if any.
+func initialRole(chatId int64, inviteCode string, tx *gorm.DB) (db.Role, *db.Invite) {
+	if telegramCreatorId > 0 && chatId == int64(telegramCreatorId) {
+		return db.RoleAdmin, nil
+	}
+	if invite := findValidInvite(inviteCode, tx); invite != nil {
+		return db.RoleUser, invite
+	}
+	if currentAccessMode == accessModeOpen {
+		return db.RoleUser, nil
+	}
+	return db.RolePending, nil
+}
+
+func findValidInvite(code string, tx *gorm.DB) *db.Invite {
+	if code == "" {
+		return nil
+	}
+	invite := &db.Invite{}
+	tx.Limit(1).Find(invite, "code = ?", code)
+	if invite.ID == 0 || !invite.IsValid() {
+		return nil
+	}
+	return invite
+}
+
+func redeemInvite(invite *db.Invite, user *db.User, tx *gorm.DB) error {
+	now := time.Now().UTC()
+	invite.RedeemedByID = &user.ID
+	invite.RedeemedAt = &now
+	return tx.Save(invite).Error
+}
+
+// ensureCreatorIsAdmin makes sure the configured creator always has the admin role
+func ensureCreatorIsAdmin() {
+	if telegramCreatorId <= 0 {
+		return
+	}
+	err := db.Db().Model(&db.User{}).
+		Where("telegram_chat_id = ? AND role <> ?", telegramCreatorId, db.RoleAdmin).
+		Update("role", db.RoleAdmin).Error
+	if err != nil {
+		logging.Errorf("Error promoting creator to admin: %v", err)
+	}
+}
+
+func admins() []db.User {
+	var adminUsers []db.User
+	db.Db().Find(&adminUsers, "role = ?", db.RoleAdmin)
+	return adminUsers
+}
+
+// requestApproval sends the access request of the user to all admins
+func requestApproval(ctx context.Context, user *db.User, from *models.User) {
+	name := strconv.FormatInt(user.TelegramChatId, 10)
+	if from != nil {
+		name = strings.TrimSpace(from.FirstName + " " + from.LastName)
+		if from.Username != "" {
+			name += " (@" + from.Username + ")"
+		}
+	}
+
+	userId := strconv.FormatUint(uint64(user.ID), 10)
+	for _, admin := range admins() {
+		sendMessage(ctx, &bot.SendMessageParams{
+			ChatID:    admin.TelegramChatId,
+			ParseMode: models.ParseModeHTML,
+			Text:      fmt.Sprintf("New access request from <b>%s</b> (Chat ID <code>%d</code>)", Escape(name), user.TelegramChatId),
+			ReplyMarkup: &models.InlineKeyboardMarkup{
+				InlineKeyboard: [][]models.InlineKeyboardButton{{
+					{Text: "Approve", CallbackData: callbackAccessApprove + userId},
+					{Text: "Reject", CallbackData: callbackAccessReject + userId},
+				}},
+			},
+		})
+	}
+}
+
+// accessCallbackHandler handles the approve and reject buttons sent to admins by requestApproval
+func accessCallbackHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	query := update.CallbackQuery
+	_, _ = b.AnswerCallbackQuery(ctx, &bot.AnswerCallbackQueryParams{CallbackQueryID: query.ID})
+
+	admin, found := userFromChatId(query.From.ID, nil)
+	if !found || !admin.IsAdmin() {
+		return
+	}
+
+	approve := strings.HasPrefix(query.Data, callbackAccessApprove)
+	rawUserId := strings.TrimPrefix(strings.TrimPrefix(query.Data, callbackAccessApprove), callbackAccessReject)
+	userId, err := strconv.ParseUint(rawUserId, 10, 64)
+	if err != nil {
+		return
+	}
+
+	user := &db.User{}
+	db.Db().Limit(1).Find(user, userId)
+
+	var result string
+	switch {
+	case user.ID == 0 || user.Role != db.RolePending:
+		result = "This request has already been handled"
+	case approve:
+		err = db.Db().Model(user).Update("role", db.RoleUser).Error
+		result = "Request approved"
+		if err == nil {
+			sendMessage(ctx, &bot.SendMessageParams{
+				ChatID: user.TelegramChatId,
+				Text:   "Your access request has been approved. You can start adding rewards that you'd like to track via the /add command.",
+			})
+			logging.Infof("User %d (Chat ID: %d) approved by admin %d", user.ID, user.TelegramChatId, admin.ID)
+		}
+	default:
+		err = db.Db().Unscoped().Delete(user).Error
+		result = "Request rejected"
+		if err == nil {
+			sendMessage(ctx, &bot.SendMessageParams{
+				ChatID: user.TelegramChatId,
+				Text:   "Your access request has been rejected.",
+			})
+			logging.Infof("User %d (Chat ID: %d) rejected by admin %d", user.ID, user.TelegramChatId, admin.ID)
+		}
+	}
+
+	if err != nil {
+		logging.Errorf("Error handling access request: %v", err)
+		result = "Error handling the request"
+	}
+
+	if query.Message.Message != nil {
+		_, _ = b.EditMessageText(ctx, &bot.EditMessageTextParams{
+			ChatID:    query.Message.Message.Chat.ID,
+			MessageID: query.Message.Message.ID,
+			ParseMode: models.ParseModeHTML,
+			Text:      Escape(query.Message.Message.Text) + "\n\n<b>" + result + "</b>",
+		})
+	}
+}
+
+func inviteCommand() *CommandHandler {
+	return &CommandHandler{
+		Pattern:     "/invite",
+		Description: "Creates an invite link for a new user",
+		HandlerType: bot.HandlerTypeMessageText,
+		MatchType:   bot.MatchTypeExact,
+		HandlerFunc: inviteHandler,
+		ChatAction:  models.ChatActionTyping,
+		AdminOnly:   true,
+	}
+}
+
+func inviteHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	chatId := update.Message.Chat.ID
+	admin, _ := userFromChatId(chatId, nil)
+
+	codeBytes := make([]byte, 12)
+	_, _ = rand.Read(codeBytes)
+	invite := &db.Invite{
+		Code:        hex.EncodeToString(codeBytes),
+		CreatedByID: admin.ID,
+		ExpiresAt:   time.Now().Add(inviteValidity).UTC(),
+	}
+
+	if err := db.Db().Create(invite).Error; err != nil {
+		logging.Errorf("Error creating invite: %v", err)
+		sendMessage(ctx, &bot.SendMessageParams{
+			ChatID: chatId,
+			Text:   "Error creating invite",
+		})
+		return
+	}
+
+	sendMessage(ctx, &bot.SendMessageParams{
+		ChatID:    chatId,
+		ParseMode: models.ParseModeHTML,
+		Text: fmt.Sprintf("Invite link (valid until %s, single use):\n%s",
+			invite.ExpiresAt.Format(time.DateOnly), Escape(inviteLink(invite.Code))),
+	})
+	logging.Infof("Admin %d created an invite", admin.ID)
+}
+
+func inviteLink(code string) string {
+	if botUsername == "" {
+		return fmt.Sprintf("/start %s", code)
+	}
+	return fmt.Sprintf("https://t.me/%s?start=%s", botUsername, code)
+}
+
+// registerAdminCommands shows the admin commands in the command list of every admin
+func registerAdminCommands(commands []*CommandHandler, tgBot *bot.Bot, ctx context.Context) {
+	botCommands := make([]models.BotCommand, 0, len(commands))
+	for _, ch := range commands {
+		botCommands = append(botCommands, models.BotCommand{Command: ch.Pattern, Description: ch.Description})
+	}
+
+	for _, admin := range admins() {
+		_, err := tgBot.SetMyCommands(ctx, &bot.SetMyCommandsParams{
+			Commands: botCommands,
+			Scope:    &models.BotCommandScopeChat{ChatID: admin.TelegramChatId},
+		})
+		if err != nil {
+			logging.Errorf("Error registering admin commands for Chat ID %d: %v", admin.TelegramChatId, err)
+		}
+	}
+}
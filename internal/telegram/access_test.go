@@ -0,0 +1,170 @@
+package telegram
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/fanonwue/patreon-gobot/internal/db"
+	"github.com/fanonwue/patreon-gobot/internal/util"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"github.com/stretchr/testify/assert"
+)
+
+// withAccessMode sets the access mode and the creator until the test is done
+func withAccessMode(t *testing.T, mode accessMode, creatorId int) {
+	previousMode, previousCreatorId := currentAccessMode, telegramCreatorId
+	currentAccessMode, telegramCreatorId = mode, creatorId
+	t.Cleanup(func() {
+		currentAccessMode, telegramCreatorId = previousMode, previousCreatorId
+	})
+}
+
+// registeredUser loads the user registered for the chat, removing it once the test is done
+func registeredUser(t *testing.T, chatId int64) (*db.User, bool) {
+	t.Cleanup(func() { db.Db().Unscoped().Delete(&db.User{}, "telegram_chat_id = ?", chatId) })
+	return userFromChatId(chatId, nil)
+}
+
+func accessCallbackUpdate(fromId int64, data string) *models.Update {
+	return &models.Update{CallbackQuery: &models.CallbackQuery{
+		ID:      "1",
+		From:    models.User{ID: fromId},
+		Data:    data,
+		Message: models.MaybeInaccessibleMessage{Message: &models.Message{ID: 1, Chat: models.Chat{ID: fromId}}},
+	}}
+}
+
+func TestAccessModeFromEnv(t *testing.T) {
+	withAccessMode(t, accessModeRestricted, 0)
+	envVar := util.PrefixEnvVar("ACCESS_MODE")
+
+	t.Setenv(envVar, "")
+	assert.Equal(t, accessModeOpen, accessModeFromEnv())
+	telegramCreatorId = 1
+	assert.Equal(t, accessModeRestricted, accessModeFromEnv())
+
+	t.Setenv(envVar, "Open")
+	assert.Equal(t, accessModeOpen, accessModeFromEnv())
+	t.Setenv(envVar, "invite-only")
+	assert.Equal(t, accessModeRestricted, accessModeFromEnv())
+}
+
+func TestStartHandler_Roles(t *testing.T) {
+	fake := newFakeTelegram(t)
+	withAccessMode(t, accessModeOpen, 8001)
+	ctx := context.Background()
+
+	startHandler(ctx, nil, messageUpdate(8001, "/start"))
+	assert.Contains(t, fake.lastSentTo(8001), "You have been registered")
+	creator, found := registeredUser(t, 8001)
+	assert.True(t, found)
+	assert.Equal(t, db.RoleAdmin, creator.Role)
+
+	startHandler(ctx, nil, messageUpdate(8002, "/start"))
+	user, _ := registeredUser(t, 8002)
+	assert.Equal(t, db.RoleUser, user.Role)
+
+	// Restricted bots only register new users as pending and ask the admins for approval
+	currentAccessMode = accessModeRestricted
+	startHandler(ctx, nil, messageUpdate(8003, "/start"))
+	pending, _ := registeredUser(t, 8003)
+	assert.Equal(t, db.RolePending, pending.Role)
+	assert.Contains(t, fake.lastSentTo(8003), "not open to the public")
+	assert.Contains(t, fake.lastSentTo(8001), "New access request")
+
+	// Starting again doesn't send another request
+	startHandler(ctx, nil, messageUpdate(8003, "/start"))
+	assert.Contains(t, fake.lastSentTo(8003), "has not been approved yet")
+	assert.Len(t, fake.sentTo(8001), 2)
+}
+
+func TestStartHandler_Invites(t *testing.T) {
+	fake := newFakeTelegram(t)
+	withAccessMode(t, accessModeRestricted, 0)
+	admin := createTestUser(t, 8011, db.RoleAdmin)
+	t.Cleanup(func() { db.Db().Unscoped().Delete(&db.Invite{}, "created_by_id = ?", admin.ID) })
+	ctx := context.Background()
+
+	inviteHandler(ctx, nil, messageUpdate(admin.TelegramChatId, "/invite"))
+	assert.Contains(t, fake.lastSentTo(admin.TelegramChatId), "Invite link")
+	invite := &db.Invite{}
+	assert.NoError(t, db.Db().First(invite, "created_by_id = ?", admin.ID).Error)
+
+	startHandler(ctx, nil, messageUpdate(8012, "/start "+invite.Code))
+	invited, _ := registeredUser(t, 8012)
+	assert.Equal(t, db.RoleUser, invited.Role)
+	db.Db().First(invite, invite.ID)
+	assert.Equal(t, &invited.ID, invite.RedeemedByID)
+
+	// Invites can only be used once
+	startHandler(ctx, nil, messageUpdate(8013, "/start "+invite.Code))
+	second, _ := registeredUser(t, 8013)
+	assert.Equal(t, db.RolePending, second.Role)
+
+	// Pending users can still redeem another invite
+	inviteHandler(ctx, nil, messageUpdate(admin.TelegramChatId, "/invite"))
+	another := &db.Invite{}
+	assert.NoError(t, db.Db().Last(another, "created_by_id = ?", admin.ID).Error)
+	startHandler(ctx, nil, messageUpdate(8013, "/start "+another.Code))
+	second, _ = userFromChatId(8013, nil)
+	assert.Equal(t, db.RoleUser, second.Role)
+}
+
+func TestAccessCallbackHandler(t *testing.T) {
+	fake := newFakeTelegram(t)
+	admin := createTestUser(t, 8021, db.RoleAdmin)
+	user := createTestUser(t, 8022, db.RoleUser)
+	approved := createTestUser(t, 8023, db.RolePending)
+	rejected := createTestUser(t, 8024, db.RolePending)
+	ctx := context.Background()
+
+	role := func(u *db.User) db.Role {
+		stored, found := userFromChatId(u.TelegramChatId, nil)
+		if !found {
+			return ""
+		}
+		return stored.Role
+	}
+
+	// Only admins can approve requests
+	accessCallbackHandler(ctx, botInstance, accessCallbackUpdate(user.TelegramChatId, callbackAccessApprove+strconv.Itoa(int(approved.ID))))
+	assert.Equal(t, db.RolePending, role(approved))
+
+	accessCallbackHandler(ctx, botInstance, accessCallbackUpdate(admin.TelegramChatId, callbackAccessApprove+strconv.Itoa(int(approved.ID))))
+	assert.Equal(t, db.RoleUser, role(approved))
+	assert.Contains(t, fake.lastSentTo(approved.TelegramChatId), "has been approved")
+
+	accessCallbackHandler(ctx, botInstance, accessCallbackUpdate(admin.TelegramChatId, callbackAccessReject+strconv.Itoa(int(rejected.ID))))
+	assert.Equal(t, db.Role(""), role(rejected))
+	assert.Contains(t, fake.lastSentTo(rejected.TelegramChatId), "has been rejected")
+
+	// Requests are only handled once
+	accessCallbackHandler(ctx, botInstance, accessCallbackUpdate(admin.TelegramChatId, callbackAccessReject+strconv.Itoa(int(approved.ID))))
+	assert.Equal(t, db.RoleUser, role(approved))
+}
+
+func TestAccessControlMiddleware(t *testing.T) {
+	fake := newFakeTelegram(t)
+	user := createTestUser(t, 8031, db.RoleUser)
+	pending := createTestUser(t, 8032, db.RolePending)
+	banned := createTestUser(t, 8033, db.RoleBanned)
+	ctx := context.Background()
+
+	var handled []int64
+	handler := accessControlMiddleware(func(ctx context.Context, b *bot.Bot, update *models.Update) {
+		handled = append(handled, update.Message.Chat.ID)
+	})
+
+	for _, chatId := range []int64{user.TelegramChatId, pending.TelegramChatId, banned.TelegramChatId, 8034} {
+		handler(ctx, botInstance, messageUpdate(chatId, "/list"))
+	}
+	// /start is always allowed, it's how access gets requested
+	handler(ctx, botInstance, messageUpdate(8034, "/start"))
+
+	assert.Equal(t, []int64{user.TelegramChatId, 8034}, handled)
+	assert.Contains(t, fake.lastSentTo(pending.TelegramChatId), "has not been approved yet")
+	assert.Empty(t, fake.sentTo(banned.TelegramChatId))
+	assert.Equal(t, "Please register via /start first", fake.lastSentTo(8034))
+}
@@ -0,0 +1,361 @@
+package telegram
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fanonwue/goutils/dsext"
+	"github.com/fanonwue/goutils/logging"
+	"github.com/fanonwue/patreon-gobot/internal/db"
+	"github.com/fanonwue/patreon-gobot/internal/patreon"
+	"github.com/fanonwue/patreon-gobot/internal/tmpl"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"gorm.io/gorm"
+)
+
+const conversationTimeout = 10 * time.Minute
+
+const (
+	callbackAddPrefix  = "add:"
+	callbackAddConfirm = callbackAddPrefix + "confirm"
+	callbackAddCancel  = callbackAddPrefix + "cancel"
+)
+
+// pendingAdd holds the rewards of an /add conversation that are waiting for confirmation. It's stored as
+// conversation payload.
+type pendingAdd struct {
+	RewardIds  []patreon.RewardId `json:"rewardIds"`
+	SkippedIds []patreon.RewardId `json:"skippedIds,omitempty"`
+}
+
+func addRewardsCommand() *CommandHandler {
+	return &CommandHandler{
+		Pattern:        "/add",
+		Description:    "Adds one or more Rewards IDs to the list of observed rewards",
+		HandlerType:    bot.HandlerTypeMessageText,
+		MatchType:      bot.MatchTypePrefix,
+		HandlerFunc:    addRewardsHandler,
+		ChatAction:     models.ChatActionTyping,
+		GroupAdminOnly: true,
+	}
+}
+
+// addRewardsHandler adds the rewards passed as arguments right away. Without arguments, it starts a conversation
+// asking for the rewards and showing a preview before adding them.
+func addRewardsHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	chatId := update.Message.Chat.ID
+
+	if len(commandArgs(update.Message.Text)) == 0 {
+		convHandler.SetActiveConversationStage(chatId, stageAddRewards)
+		replyText(ctx, update, "Send me the IDs or checkout links of the rewards you'd like to track. Send /cancel to abort.")
+		return
+	}
+
+	ids := parseIdList(update.Message.Text)
+	if len(ids) == 0 {
+		replyText(ctx, update, "No valid reward IDs provided")
+		return
+	}
+
+	user, _ := userFromChatId(chatId, nil)
+	newRewardIds, skippedIds, err := selectNewRewardIds(user, ids)
+	if err != nil {
+		replyText(ctx, update, err.Error())
+		return
+	}
+
+	var foundIds []patreon.RewardId
+
+	for r := range patreonClient().FetchRewardsSlice(newRewardIds, false, ctx) {
+		if r.IsPresent() {
+			foundIds = append(foundIds, r.Id)
+		}
+	}
+
+	savedRewards, quotaSkippedIds, err := trackRewards(user, foundIds)
+	if err != nil {
+		logging.Errorf("Error occured while adding rewards: %v", err)
+		sendMessage(ctx, &bot.SendMessageParams{
+			ChatID: chatId,
+			Text:   fmt.Sprintf("Error saving rewards: %s", err),
+		})
+		return
+	}
+
+	replyText(ctx, update, trackedRewardsText(user, savedRewards, append(skippedIds, quotaSkippedIds...)))
+	logging.Infof("Added rewards [%s] for user %d (Chat ID: %d)", strings.Join(savedRewards, ", "), user.ID, user.TelegramChatId)
+}
+
+// selectNewRewardIds returns the rewards the user isn't tracking yet, split into the ones that fit into the
+// user's quota and the ones that don't. Returns an error meant for the user if no reward can be added.
+func selectNewRewardIds(user *db.User, ids []int) ([]patreon.RewardId, []patreon.RewardId, error) {
+	newRewardIds := untrackedRewardIds(user, ids)
+	if len(newRewardIds) == 0 {
+		return nil, nil, errors.New("No new reward ID found")
+	}
+
+	newRewardIds, skippedIds, usage := applyQuota(user, newRewardIds)
+	if len(newRewardIds) == 0 {
+		return nil, nil, fmt.Errorf("Quota exceeded, no rewards added. Current usage: %s", usage)
+	}
+	return newRewardIds, skippedIds, nil
+}
+
+// untrackedRewardIds returns the distinct rewards the user isn't tracking yet
+func untrackedRewardIds(user *db.User, ids []int) []patreon.RewardId {
+	db.Db().Preload("Rewards").Find(user)
+	existingRewardIds := dsext.Map(user.Rewards, func(r db.TrackedReward) int {
+		return int(r.RewardId)
+	})
+
+	var newRewardIds []patreon.RewardId
+	for _, id := range ids {
+		if !slices.Contains(existingRewardIds, id) && !slices.Contains(newRewardIds, patreon.RewardId(id)) {
+			newRewardIds = append(newRewardIds, patreon.RewardId(id))
+		}
+	}
+	return newRewardIds
+}
+
+// applyQuota splits the rewards into the ones that fit into the user's quota and the ones that don't
+func applyQuota(user *db.User, ids []patreon.RewardId) ([]patreon.RewardId, []patreon.RewardId, *quotaUsage) {
+	usage := usageForUser(user)
+	allowedIds, skippedIds := splitByQuota(ids, usage)
+	return allowedIds, skippedIds, usage
+}
+
+// trackRewards saves the rewards for the user, returning the IDs of the rewards saved. The quota is checked again
+// within the same transaction, so concurrent additions can't exceed it. Rewards exceeding it are returned as skipped.
+func trackRewards(user *db.User, ids []patreon.RewardId) ([]string, []patreon.RewardId, error) {
+	var savedRewards []string
+	var skippedIds []patreon.RewardId
+	txErr := db.Db().Transaction(func(tx *gorm.DB) error {
+		ids, skippedIds = splitByQuota(ids, usageInTx(tx, user))
+		for _, id := range ids {
+			tracked := db.TrackedReward{RewardId: int64(id), UserID: user.ID}
+			tx.Save(&tracked)
+			if tx.Error != nil {
+				return tx.Error
+			}
+			if tracked.ID > 0 {
+				savedRewards = append(savedRewards, strconv.Itoa(int(tracked.RewardId)))
+				if err := tx.Create(&db.RewardAddition{UserID: user.ID}).Error; err != nil {
+					return err
+				}
+			}
+		}
+		// Only additions within the window count towards the quota
+		return tx.Delete(&db.RewardAddition{}, "user_id = ? AND created_at <= ?", user.ID, time.Now().Add(-addsWindow)).Error
+	})
+	if txErr != nil {
+		return nil, nil, txErr
+	}
+	return savedRewards, skippedIds, nil
+}
+
+func trackedRewardsText(user *db.User, savedRewards []string, skippedIds []patreon.RewardId) string {
+	text := fmt.Sprintf("Now tracking rewards [%s]", strings.Join(savedRewards, ", "))
+	if len(skippedIds) > 0 {
+		text += fmt.Sprintf("\nSkipped [%s] due to your quota. Current usage: %s", dsext.Join(skippedIds, ", ", func(id patreon.RewardId) string {
+			return strconv.Itoa(int(id))
+		}), usageForUser(user))
+	}
+	return text
+}
+
+// leaveConversationForCommand ends the conversation if the message is a command, handing it to the regular
+// handlers instead. Returns true if the message has been handed over.
+func leaveConversationForCommand(ctx context.Context, b *bot.Bot, update *models.Update) bool {
+	if !strings.HasPrefix(update.Message.Text, "/") {
+		return false
+	}
+	convHandler.EndConversation(update.Message.Chat.ID)
+	b.ProcessUpdate(ctx, update)
+	return true
+}
+
+// addRewardsStageHandler receives the rewards to add and asks for confirmation, showing a preview of them
+func addRewardsStageHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	chatId := update.Message.Chat.ID
+	if isGroupChat(update.Message.Chat) && !isGroupAdmin(ctx, b, update.Message) {
+		return
+	}
+	if leaveConversationForCommand(ctx, b, update) {
+		return
+	}
+
+	ids := parseIdList(update.Message.Text)
+	if len(ids) == 0 {
+		convHandler.SetActiveConversationStage(chatId, stageAddRewards)
+		replyText(ctx, update, "No valid reward IDs found. Please send reward IDs or checkout links, or /cancel to abort.")
+		return
+	}
+
+	b.SendChatAction(ctx, &bot.SendChatActionParams{ChatID: chatId, Action: models.ChatActionTyping})
+
+	user, _ := userFromChatId(chatId, nil)
+	newRewardIds, skippedIds, err := selectNewRewardIds(user, ids)
+	if err != nil {
+		convHandler.EndConversation(chatId)
+		replyText(ctx, update, err.Error())
+		return
+	}
+
+	preview, foundIds := collectAddPreview(ctx, newRewardIds)
+	preview.Skipped = skippedIds
+
+	buf := new(bytes.Buffer)
+	if err = addPreviewTemplate.Execute(buf, preview); err != nil {
+		logging.Errorf("Error executing template: %v", err)
+	}
+
+	params := &bot.SendMessageParams{
+		ChatID:             chatId,
+		ReplyParameters:    &models.ReplyParameters{MessageID: update.Message.ID},
+		ParseMode:          models.ParseModeHTML,
+		LinkPreviewOptions: &models.LinkPreviewOptions{IsDisabled: bot.True()},
+		Text:               buf.String(),
+	}
+
+	if len(foundIds) == 0 {
+		convHandler.EndConversation(chatId)
+		sendMessage(ctx, params)
+		return
+	}
+
+	convHandler.SetActiveConversationStage(chatId, stageAddConfirm)
+	err = convHandler.SetConversationData(chatId, &pendingAdd{RewardIds: foundIds, SkippedIds: skippedIds})
+	if err != nil {
+		logging.Errorf("Error saving conversation data of chat %d: %v", chatId, err)
+		convHandler.EndConversation(chatId)
+		replyText(ctx, update, "Error preparing the rewards, please try again")
+		return
+	}
+	params.ReplyMarkup = &models.InlineKeyboardMarkup{
+		InlineKeyboard: [][]models.InlineKeyboardButton{{
+			{Text: "Confirm", CallbackData: callbackAddConfirm},
+			{Text: "Cancel", CallbackData: callbackAddCancel},
+		}},
+	}
+	sendMessage(ctx, params)
+}
+
+// collectAddPreview fetches the rewards and groups them by campaign. Returns the preview and the IDs of the
+// rewards that have been found.
+func collectAddPreview(ctx context.Context, ids []patreon.RewardId) (*tmpl.AddPreviewData, []patreon.RewardId) {
+	preview := &tmpl.AddPreviewData{}
+	campaigns := map[patreon.CampaignId]*tmpl.ListCampaign{}
+	var foundIds []patreon.RewardId
+
+	for result := range patreonClient().FetchRewardsSlice(ids, false, ctx) {
+		if !result.IsPresent() {
+			preview.Missing = append(preview.Missing, &result)
+			continue
+		}
+
+		campaignId, err := result.Reward.CampaignId()
+		listCampaign, found := campaigns[campaignId]
+		if err == nil && !found {
+			var campaign *patreon.Campaign
+			campaign, err = patreonClient().FetchCampaign(campaignId, false, ctx)
+			if err == nil {
+				listCampaign = &tmpl.ListCampaign{Campaign: campaign, Rewards: []*tmpl.ListReward{}}
+				campaigns[campaignId] = listCampaign
+			}
+		}
+		if err != nil {
+			result.Status = patreon.RewardErrorNoCampaign
+			preview.Missing = append(preview.Missing, &result)
+			continue
+		}
+
+		listCampaign.AddReward(&tmpl.ListReward{Reward: result.Reward})
+		foundIds = append(foundIds, result.Id)
+	}
+
+	preview.Campaigns = tmpl.SortListCampaigns(slices.Collect(maps.Values(campaigns)), tmpl.DefaultListSort)
+	return preview, foundIds
+}
+
+// addConfirmStageHandler reminds the user to use the buttons while the preview is waiting for confirmation
+func addConfirmStageHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	if isGroupChat(update.Message.Chat) && !isGroupAdmin(ctx, b, update.Message) {
+		return
+	}
+	if leaveConversationForCommand(ctx, b, update) {
+		return
+	}
+	convHandler.SetActiveConversationStage(update.Message.Chat.ID, stageAddConfirm)
+	replyText(ctx, update, "Please confirm or cancel adding the rewards using the buttons above, or send /cancel to abort.")
+}
+
+// addCallbackHandler handles the confirm and cancel buttons of the preview sent by addRewardsStageHandler
+func addCallbackHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	query := update.CallbackQuery
+	_, _ = b.AnswerCallbackQuery(ctx, &bot.AnswerCallbackQueryParams{CallbackQueryID: query.ID})
+
+	message := query.Message.Message
+	if message == nil {
+		return
+	}
+	chatId := message.Chat.ID
+	if isGroupChat(message.Chat) && !isChatAdmin(ctx, b, chatId, query.From.ID) {
+		return
+	}
+
+	pending := &pendingAdd{}
+	active := convHandler.TakeConversationData(chatId, stageAddConfirm, pending)
+
+	var result string
+	switch {
+	case !active:
+		result = "This request has expired, please use /add again"
+	case query.Data == callbackAddCancel:
+		result = "Cancelled, no rewards have been added"
+	default:
+		user, _ := userFromChatId(chatId, nil)
+		// Rewards may have been added in the meantime, so the quota is applied again
+		rewardIds, skippedIds, err := selectNewRewardIds(user, dsext.Map(pending.RewardIds, func(id patreon.RewardId) int {
+			return int(id)
+		}))
+		if err != nil {
+			result = err.Error()
+			break
+		}
+		savedRewards, quotaSkippedIds, err := trackRewards(user, rewardIds)
+		if err != nil {
+			logging.Errorf("Error occured while adding rewards: %v", err)
+			result = fmt.Sprintf("Error saving rewards: %s", err)
+			break
+		}
+		skippedIds = append(skippedIds, quotaSkippedIds...)
+		result = trackedRewardsText(user, savedRewards, append(pending.SkippedIds, skippedIds...))
+		logging.Infof("Added rewards [%s] for user %d (Chat ID: %d)", strings.Join(savedRewards, ", "), user.ID, user.TelegramChatId)
+	}
+
+	_, _ = b.EditMessageReplyMarkup(ctx, &bot.EditMessageReplyMarkupParams{
+		ChatID:    chatId,
+		MessageID: message.ID,
+	})
+	sendMessage(ctx, &bot.SendMessageParams{
+		ChatID:          chatId,
+		ReplyParameters: &models.ReplyParameters{MessageID: message.ID},
+		Text:            result,
+	})
+}
+
+// conversationTimeoutHandler lets the user know that their conversation has been abandoned
+func conversationTimeoutHandler(chatId int64, stageId int) {
+	sendMessage(botContext, &bot.SendMessageParams{
+		ChatID: chatId,
+		Text:   "The conversation has been cancelled due to inactivity",
+	})
+}
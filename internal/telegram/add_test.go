@@ -0,0 +1,46 @@
+package telegram
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-telegram/bot/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddConfirmStageHandler_IgnoresGroupMembers(t *testing.T) {
+	fake := newFakeTelegram(t)
+	previousHandler := convHandler
+	convHandler = NewConversationHandler(nil, nil, time.Minute)
+	t.Cleanup(func() { convHandler = previousHandler })
+
+	const groupId = int64(-3601)
+	convHandler.SetActiveConversationStage(groupId, stageAddConfirm)
+	t.Cleanup(func() { convHandler.EndConversation(groupId) })
+	conv, _ := convHandler.findConversation(groupId, false)
+
+	groupMessage := func(text string, senderChat *models.Chat) *models.Update {
+		return &models.Update{Message: &models.Message{
+			ID:         1,
+			Chat:       models.Chat{ID: groupId, Type: models.ChatTypeSupergroup},
+			From:       &models.User{ID: 3602},
+			SenderChat: senderChat,
+			Text:       text,
+		}}
+	}
+
+	// Members that aren't administrators neither end nor extend the conversation
+	addConfirmStageHandler(context.Background(), botInstance, groupMessage("hello", nil))
+	addConfirmStageHandler(context.Background(), botInstance, groupMessage("/list", nil))
+	assert.Empty(t, fake.sentTo(groupId))
+	current, active := convHandler.findConversation(groupId, false)
+	assert.True(t, active)
+	assert.Equal(t, stageAddConfirm, current.Stage)
+	assert.Equal(t, conv.ExpiresAt, current.ExpiresAt)
+
+	// Anonymous administrators post on behalf of the group
+	addConfirmStageHandler(context.Background(), botInstance, groupMessage("hello", &models.Chat{ID: groupId}))
+	assert.Contains(t, fake.lastSentTo(groupId), "Please confirm or cancel")
+	assert.True(t, convHandler.hasConversation(groupId))
+}
@@ -0,0 +1,359 @@
+package telegram
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/fanonwue/goutils/logging"
+	"github.com/fanonwue/patreon-gobot/internal/db"
+	"github.com/fanonwue/patreon-gobot/internal/patreon"
+	"github.com/fanonwue/patreon-gobot/internal/tmpl"
+	"github.com/fanonwue/patreon-gobot/internal/util"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+// statsRequestMinutes is the number of minutes /stats shows the request count of
+const statsRequestMinutes = 10
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+// currentLogLevel is the level set via /loglevel, or the one configured by LOG_LEVEL on startup
+var currentLogLevel = cmp.Or(strings.ToLower(os.Getenv(util.PrefixEnvVar("LOG_LEVEL"))), "default")
+
+var forceCheckHandler func() error
+var runHistoryHandler func() []*tmpl.RunSummary
+
+// SetForceCheckHandler sets the function that gets called by the /force_check command. The handler is expected
+// to start the check in the background and fail if it can't be started.
+func SetForceCheckHandler(handler func() error) {
+	forceCheckHandler = handler
+}
+
+// SetRunHistoryHandler sets the function that provides the summaries of recent update runs for the /runs command
+func SetRunHistoryHandler(handler func() []*tmpl.RunSummary) {
+	runHistoryHandler = handler
+}
+
+func adminCommands() []*CommandHandler {
+	return []*CommandHandler{
+		{
+			Pattern:     "/stats",
+			Description: "Shows statistics about users, rewards and Patreon requests",
+			HandlerFunc: statsHandler,
+		},
+		{
+			Pattern:     "/users",
+			Description: "Lists all registered users",
+			HandlerFunc: usersHandler,
+		},
+		{
+			Pattern:     "/ban",
+			Description: "Bans the user with the given Chat ID",
+			HandlerFunc: func(ctx context.Context, b *bot.Bot, update *models.Update) {
+				setUserRole(ctx, update, db.RoleBanned)
+			},
+		},
+		{
+			Pattern:     "/unban",
+			Description: "Lifts the ban of the user with the given Chat ID",
+			HandlerFunc: func(ctx context.Context, b *bot.Bot, update *models.Update) {
+				setUserRole(ctx, update, db.RoleUser)
+			},
+		},
+		{
+			Pattern:     "/broadcast",
+			Description: "Sends a message to all users",
+			HandlerFunc: broadcastHandler,
+		},
+		{
+			Pattern:     "/force_check",
+			Description: "Checks all tracked rewards immediately",
+			HandlerFunc: forceCheckCommandHandler,
+		},
+		{
+			Pattern:     "/runs",
+			Description: "Shows summaries of the most recent update runs",
+			HandlerFunc: runsHandler,
+		},
+		{
+			Pattern:     "/session",
+			Description: "Shows or sets the Patreon session used for forbidden rewards, only in private chats",
+			HandlerFunc: sessionHandler,
+		},
+		{
+			Pattern:     "/loglevel",
+			Description: "Shows or changes the log level",
+			HandlerFunc: logLevelHandler,
+		},
+	}
+}
+
+// adminCommandHandlers fills in the defaults shared by all admin commands
+func adminCommandHandlers() []*CommandHandler {
+	commands := adminCommands()
+	for _, command := range commands {
+		command.HandlerType = bot.HandlerTypeMessageText
+		command.MatchType = bot.MatchTypePrefix
+		command.ChatAction = models.ChatActionTyping
+		command.AdminOnly = true
+	}
+	return commands
+}
+
+// NotifyAdmins sends the message to all admins
+func NotifyAdmins(text string) {
+	for _, admin := range admins() {
+		queueMessage(&bot.SendMessageParams{
+			ChatID: admin.TelegramChatId,
+			Text:   text,
+		})
+	}
+}
+
+func replyText(ctx context.Context, update *models.Update, text string) {
+	sendMessage(ctx, &bot.SendMessageParams{
+		ChatID:          update.Message.Chat.ID,
+		ReplyParameters: &models.ReplyParameters{MessageID: update.Message.ID},
+		Text:            text,
+	})
+}
+
+func statsHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	data := &tmpl.StatsData{
+		UsersByRole:       make(map[string]int64),
+		CacheSizes:        patreon.CacheSizes(),
+		RequestsPerMinute: patreon.RequestsPerMinute(statsRequestMinutes),
+	}
+	for _, ps := range proxyPool.Stats() {
+		proxyStats := &tmpl.ProxyStats{
+			Url:         ps.Url,
+			Requests:    ps.Requests,
+			Succeeded:   ps.Succeeded,
+			Forbidden:   ps.Forbidden,
+			RateLimited: ps.RateLimited,
+			Errors:      ps.Errors,
+		}
+		if ps.Ejected {
+			proxyStats.EjectedUntil = ps.EjectedUntil.Format("15:04")
+		}
+		data.Proxies = append(data.Proxies, proxyStats)
+	}
+
+	var roleCounts []struct {
+		Role  string
+		Count int64
+	}
+	db.Db().Model(&db.User{}).Select("role, COUNT(*) AS count").Group("role").Scan(&roleCounts)
+	for _, rc := range roleCounts {
+		data.UsersByRole[rc.Role] = rc.Count
+	}
+	db.Db().Model(&db.User{}).Where("is_inactive = ?", true).Count(&data.InactiveUsers)
+	db.Db().Model(&db.TrackedReward{}).Count(&data.TrackedRewards)
+	db.Db().Model(&db.TrackedReward{}).Distinct("reward_id").Count(&data.DistinctRewards)
+	db.Db().Model(&db.PendingMessage{}).Count(&data.PendingMessages)
+
+	for status, count := range patreon.RequestsLastHour() {
+		data.TotalRequests += count
+		data.RequestsLastHour = append(data.RequestsLastHour, &tmpl.RequestCount{Status: requestStatusName(status), Count: count})
+	}
+	slices.SortFunc(data.RequestsLastHour, func(a, b *tmpl.RequestCount) int {
+		return cmp.Compare(b.Count, a.Count)
+	})
+
+	buf := new(bytes.Buffer)
+	err := statsTemplate.Execute(buf, data)
+	if err != nil {
+		logging.Errorf("Error executing template: %v", err)
+	}
+
+	sendMessage(ctx, &bot.SendMessageParams{
+		ChatID:    update.Message.Chat.ID,
+		ParseMode: models.ParseModeHTML,
+		Text:      buf.String(),
+	})
+}
+
+func requestStatusName(status patreon.RewardStatus) string {
+	if status == patreon.RewardFound {
+		return "Found"
+	}
+	return status.Text()
+}
+
+func usersHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	var users []db.User
+	db.Db().Order("id").Find(&users)
+
+	var rewardCounts []struct {
+		UserID uint
+		Count  int64
+	}
+	db.Db().Model(&db.TrackedReward{}).Select("user_id, COUNT(*) AS count").Group("user_id").Scan(&rewardCounts)
+	countsPerUser := make(map[uint]int64, len(rewardCounts))
+	for _, rc := range rewardCounts {
+		countsPerUser[rc.UserID] = rc.Count
+	}
+
+	data := &tmpl.UserListData{}
+	for _, user := range users {
+		data.Users = append(data.Users, &tmpl.UserListEntry{
+			ChatId:         user.TelegramChatId,
+			Role:           string(user.Role),
+			Inactive:       user.IsInactive,
+			TrackedRewards: countsPerUser[user.ID],
+		})
+	}
+
+	buf := new(bytes.Buffer)
+	err := usersTemplate.Execute(buf, data)
+	if err != nil {
+		logging.Errorf("Error executing template: %v", err)
+	}
+
+	sendMessage(ctx, &bot.SendMessageParams{
+		ChatID:    update.Message.Chat.ID,
+		ParseMode: models.ParseModeHTML,
+		Text:      buf.String(),
+	})
+}
+
+// setUserRole bans or unbans the user with the Chat ID given in the message. Admins can't be banned, and only
+// banned users can be unbanned, so pending users don't get approved by accident.
+func setUserRole(ctx context.Context, update *models.Update, role db.Role) {
+	args := commandArgs(update.Message.Text)
+	if len(args) == 0 {
+		replyText(ctx, update, "No Chat ID provided")
+		return
+	}
+
+	chatId, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		replyText(ctx, update, "Invalid Chat ID provided")
+		return
+	}
+
+	if chatId == update.Message.Chat.ID {
+		replyText(ctx, update, "You can't change your own role")
+		return
+	}
+
+	user, found := userFromChatId(chatId, nil)
+	if !found {
+		replyText(ctx, update, fmt.Sprintf("No user found for Chat ID %d", chatId))
+		return
+	}
+
+	if user.IsAdmin() {
+		replyText(ctx, update, "The roles of admins can't be changed")
+		return
+	}
+	if role != db.RoleBanned && user.Role != db.RoleBanned {
+		replyText(ctx, update, fmt.Sprintf("User %d is not banned", chatId))
+		return
+	}
+
+	if err = db.Db().Model(user).Update("role", role).Error; err != nil {
+		logging.Errorf("Error updating role of user %d: %v", user.ID, err)
+		replyText(ctx, update, "Error updating user")
+		return
+	}
+
+	replyText(ctx, update, fmt.Sprintf("Role of user %d set to %s", chatId, role))
+	logging.Infof("Role of user %d (Chat ID: %d) set to %s", user.ID, user.TelegramChatId, role)
+}
+
+func broadcastHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	message := strings.TrimSpace(strings.TrimPrefix(update.Message.Text, strings.Fields(update.Message.Text)[0]))
+	if message == "" {
+		replyText(ctx, update, "Usage: /broadcast <message>")
+		return
+	}
+
+	var users []db.User
+	db.Db().Find(&users, "is_inactive = ? AND role IN ?", false, db.ActiveRoles)
+	for _, user := range users {
+		queueMessage(&bot.SendMessageParams{
+			ChatID: user.TelegramChatId,
+			Text:   message,
+		})
+	}
+
+	replyText(ctx, update, fmt.Sprintf("Broadcast queued for %d users", len(users)))
+	logging.Infof("Broadcast queued for %d users", len(users))
+}
+
+func forceCheckCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	if forceCheckHandler == nil {
+		replyText(ctx, update, "Forcing a check is not supported")
+		return
+	}
+
+	if err := forceCheckHandler(); err != nil {
+		replyText(ctx, update, fmt.Sprintf("Check not started: %v", err))
+		return
+	}
+	replyText(ctx, update, "Check started")
+}
+
+func runsHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	if runHistoryHandler == nil {
+		replyText(ctx, update, "Run history is not available")
+		return
+	}
+
+	runs := runHistoryHandler()
+	if len(runs) == 0 {
+		replyText(ctx, update, "No update runs yet")
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	err := runsTemplate.Execute(buf, &tmpl.RunHistoryData{Runs: runs})
+	if err != nil {
+		logging.Errorf("Error executing template: %v", err)
+	}
+
+	sendMessage(ctx, &bot.SendMessageParams{
+		ChatID:    update.Message.Chat.ID,
+		ParseMode: models.ParseModeHTML,
+		Text:      buf.String(),
+	})
+}
+
+func logLevelHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	args := commandArgs(update.Message.Text)
+	if len(args) == 0 {
+		replyText(ctx, update, fmt.Sprintf("Current log level: %s", currentLogLevel))
+		return
+	}
+
+	name := strings.ToLower(args[0])
+	if !slices.Contains(logLevelNames, name) {
+		replyText(ctx, update, fmt.Sprintf("Invalid log level %s, valid levels are %s", args[0], strings.Join(logLevelNames, ", ")))
+		return
+	}
+
+	// The logging package reads the level from the environment only, so LOG_LEVEL is updated to match
+	logLevelVar := util.PrefixEnvVar("LOG_LEVEL")
+	previousLevel, wasSet := os.LookupEnv(logLevelVar)
+	_ = os.Setenv(logLevelVar, name)
+	if err := logging.SetLogLevelFromEnvironment(logLevelVar); err != nil {
+		if wasSet {
+			_ = os.Setenv(logLevelVar, previousLevel)
+		} else {
+			_ = os.Unsetenv(logLevelVar)
+		}
+		replyText(ctx, update, fmt.Sprintf("Error setting log level %s: %v", name, err))
+		return
+	}
+	currentLogLevel = name
+	replyText(ctx, update, fmt.Sprintf("Log level set to %s", name))
+	logging.Infof("Log level set to %s", name)
+}
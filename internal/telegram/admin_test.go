@@ -0,0 +1,114 @@
+package telegram
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/fanonwue/patreon-gobot/internal/db"
+	"github.com/fanonwue/patreon-gobot/internal/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatsHandler(t *testing.T) {
+	fake := newFakeTelegram(t)
+	admin := createTestUser(t, 6001, db.RoleAdmin)
+	user := createTestUser(t, 6002, db.RoleUser)
+	assert.NoError(t, db.Db().Create(&db.TrackedReward{UserID: user.ID, RewardId: 1}).Error)
+
+	statsHandler(context.Background(), nil, messageUpdate(admin.TelegramChatId, "/stats"))
+	stats := fake.lastSentTo(admin.TelegramChatId)
+	assert.Contains(t, stats, "admin: 1")
+	assert.Contains(t, stats, "user: 1")
+	assert.Contains(t, stats, "total: 1")
+}
+
+func TestUsersHandler(t *testing.T) {
+	fake := newFakeTelegram(t)
+	admin := createTestUser(t, 6011, db.RoleAdmin)
+	user := createTestUser(t, 6012, db.RoleUser)
+	assert.NoError(t, db.Db().Create(&db.TrackedReward{UserID: user.ID, RewardId: 1}).Error)
+
+	usersHandler(context.Background(), nil, messageUpdate(admin.TelegramChatId, "/users"))
+	users := fake.lastSentTo(admin.TelegramChatId)
+	assert.Contains(t, users, "<code>6011</code> - admin, 0 tracked rewards")
+	assert.Contains(t, users, "<code>6012</code> - user, 1 tracked rewards")
+}
+
+func TestSetUserRole(t *testing.T) {
+	fake := newFakeTelegram(t)
+	admin := createTestUser(t, 6021, db.RoleAdmin)
+	otherAdmin := createTestUser(t, 6022, db.RoleAdmin)
+	user := createTestUser(t, 6023, db.RoleUser)
+	pending := createTestUser(t, 6024, db.RolePending)
+	ctx := context.Background()
+
+	role := func(u *db.User) db.Role {
+		stored := &db.User{}
+		db.Db().First(stored, u.ID)
+		return stored.Role
+	}
+
+	setUserRole(ctx, messageUpdate(admin.TelegramChatId, "/ban 6023"), db.RoleBanned)
+	assert.Equal(t, db.RoleBanned, role(user))
+	assert.Equal(t, "Role of user 6023 set to banned", fake.lastSentTo(admin.TelegramChatId))
+
+	setUserRole(ctx, messageUpdate(admin.TelegramChatId, "/unban 6023"), db.RoleUser)
+	assert.Equal(t, db.RoleUser, role(user))
+
+	// Admins, the own chat and pending users are left alone
+	setUserRole(ctx, messageUpdate(admin.TelegramChatId, "/ban 6022"), db.RoleBanned)
+	assert.Equal(t, db.RoleAdmin, role(otherAdmin))
+	assert.Equal(t, "The roles of admins can't be changed", fake.lastSentTo(admin.TelegramChatId))
+	setUserRole(ctx, messageUpdate(admin.TelegramChatId, "/ban 6021"), db.RoleBanned)
+	assert.Equal(t, db.RoleAdmin, role(admin))
+	setUserRole(ctx, messageUpdate(admin.TelegramChatId, "/unban 6024"), db.RoleUser)
+	assert.Equal(t, db.RolePending, role(pending))
+	assert.Equal(t, "User 6024 is not banned", fake.lastSentTo(admin.TelegramChatId))
+
+	setUserRole(ctx, messageUpdate(admin.TelegramChatId, "/ban 6099"), db.RoleBanned)
+	assert.Equal(t, "No user found for Chat ID 6099", fake.lastSentTo(admin.TelegramChatId))
+}
+
+func TestBroadcastHandler(t *testing.T) {
+	fake := newFakeTelegram(t)
+	admin := createTestUser(t, 6031, db.RoleAdmin)
+	user := createTestUser(t, 6032, db.RoleUser)
+	banned := createTestUser(t, 6033, db.RoleBanned)
+	inactive := createTestUser(t, 6034, db.RoleUser)
+	assert.NoError(t, db.Db().Model(inactive).Update("is_inactive", true).Error)
+	chatIds := []int64{admin.TelegramChatId, user.TelegramChatId, banned.TelegramChatId, inactive.TelegramChatId}
+	t.Cleanup(func() { db.Db().Unscoped().Delete(&db.PendingMessage{}, "chat_id IN ?", chatIds) })
+
+	broadcastHandler(context.Background(), nil, messageUpdate(admin.TelegramChatId, "/broadcast"))
+	assert.Equal(t, "Usage: /broadcast <message>", fake.lastSentTo(admin.TelegramChatId))
+
+	broadcastHandler(context.Background(), nil, messageUpdate(admin.TelegramChatId, "/broadcast Maintenance tonight"))
+	var queued []db.PendingMessage
+	db.Db().Order("chat_id").Find(&queued, "chat_id IN ?", chatIds)
+	if assert.Len(t, queued, 2) {
+		assert.Equal(t, admin.TelegramChatId, queued[0].ChatId)
+		assert.Equal(t, user.TelegramChatId, queued[1].ChatId)
+		assert.Equal(t, "Maintenance tonight", queued[1].Text)
+	}
+}
+
+func TestLogLevelHandler(t *testing.T) {
+	fake := newFakeTelegram(t)
+	admin := createTestUser(t, 6041, db.RoleAdmin)
+	previousLevel := currentLogLevel
+	t.Cleanup(func() { currentLogLevel = previousLevel })
+	logLevelVar := util.PrefixEnvVar("LOG_LEVEL")
+	// Restores the variable once the test is done
+	t.Setenv(logLevelVar, os.Getenv(logLevelVar))
+
+	logLevelHandler(context.Background(), nil, messageUpdate(admin.TelegramChatId, "/loglevel verbose"))
+	assert.Contains(t, fake.lastSentTo(admin.TelegramChatId), "Invalid log level verbose")
+	assert.Equal(t, previousLevel, currentLogLevel)
+
+	logLevelHandler(context.Background(), nil, messageUpdate(admin.TelegramChatId, "/loglevel DEBUG"))
+	assert.Equal(t, "debug", currentLogLevel)
+	assert.Equal(t, "debug", os.Getenv(logLevelVar))
+	logLevelHandler(context.Background(), nil, messageUpdate(admin.TelegramChatId, "/loglevel"))
+	assert.Equal(t, "Current log level: debug", fake.lastSentTo(admin.TelegramChatId))
+}
@@ -4,10 +4,12 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"os"
 	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/fanonwue/goutils/dsext"
 	"github.com/fanonwue/goutils/logging"
@@ -28,17 +30,42 @@ var htmlEscaper = strings.NewReplacer("<", "&lt;", ">", "&gt;", "&", "&amp;")
 var convHandler *ConversationHandler
 
 var telegramCreatorId = 0
+var botUsername = ""
+var botId int64
 var tgPatreonClient = patreon.NewClient(4)
-
-const creatorOnly = true
+var tgClientOptions []patreon.ClientOption
+var proxyPool *patreon.ProxyPool
 
 const (
-	stageAddCampaign = iota
+	stageAddRewards = iota
+	stageAddConfirm
+	stageImportDocument
 )
 
+// SetProxyPool sets the proxy pool the requests of the bot to Patreon are routed through. /stats shows its stats.
+func SetProxyPool(pool *patreon.ProxyPool) {
+	proxyPool = pool
+	tgPatreonClient = newPatreonClient()
+}
+
+// SetClientOptions configures the client the bot uses for requests to Patreon
+func SetClientOptions(options ...patreon.ClientOption) {
+	tgClientOptions = options
+	tgPatreonClient = newPatreonClient()
+}
+
+// newPatreonClient creates the client for the bot from the configured options, routed through the proxy pool
+func newPatreonClient() *patreon.Client {
+	return patreon.NewClient(4, append(slices.Clone(tgClientOptions), patreon.WithProxyPool(proxyPool))...)
+}
+
 func StartBot(ctx context.Context) *bot.Bot {
 	botContext = ctx
 	telegramCreatorId, _ = strconv.Atoi(os.Getenv(util.PrefixEnvVar("TELEGRAM_CREATOR_ID")))
+	currentAccessMode = accessModeFromEnv()
+	defaultQuota = quotaFromEnv()
+	ensureCreatorIsAdmin()
+	logging.Infof("Access mode: %s", currentAccessMode)
 
 	convEnd := ConversationEnd{
 		Command:  "/cancel",
@@ -46,8 +73,10 @@ func StartBot(ctx context.Context) *bot.Bot {
 	}
 
 	convHandler = NewConversationHandler(map[int]bot.HandlerFunc{
-		stageAddCampaign: noopHandler,
-	}, &convEnd)
+		stageAddRewards:     addRewardsStageHandler,
+		stageAddConfirm:     addConfirmStageHandler,
+		stageImportDocument: importStageHandler,
+	}, &convEnd, conversationTimeout)
 
 	opts := []bot.Option{
 		bot.WithErrorsHandler(errorHandler),
@@ -55,6 +84,14 @@ func StartBot(ctx context.Context) *bot.Bot {
 		bot.WithMiddlewares(middlewares()...),
 	}
 
+	webhook, err := webhookConfigFromEnv()
+	if err != nil {
+		panic(fmt.Sprintf("invalid webhook configuration: %v", err))
+	}
+	if webhook != nil {
+		opts = append(opts, bot.WithWebhookSecretToken(webhook.secretToken))
+	}
+
 	botToken := os.Getenv(util.PrefixEnvVar("TELEGRAM_BOT_TOKEN"))
 	if botToken == "" {
 		panic("No Telegram bot token has been set")
@@ -65,33 +102,103 @@ func StartBot(ctx context.Context) *bot.Bot {
 		panic(err)
 	}
 
+	me, err := b.GetMe(botContext)
+	if err != nil {
+		logging.Errorf("Error retrieving bot information: %v", err)
+	} else {
+		botUsername = me.Username
+		botId = me.ID
+	}
+
 	commands := commandHandlers()
 
 	registerHandlers(commands, b, botContext)
 	registerCommands(commands, b, botContext)
+	b.RegisterHandler(bot.HandlerTypeCallbackQueryData, callbackAccessPrefix, bot.MatchTypePrefix, accessCallbackHandler)
+	b.RegisterHandler(bot.HandlerTypeCallbackQueryData, callbackAddPrefix, bot.MatchTypePrefix, addCallbackHandler)
+	b.RegisterHandler(bot.HandlerTypeCallbackQueryData, callbackAcknowledgePrefix, bot.MatchTypePrefix, acknowledgeCallbackHandler)
+	b.RegisterHandlerMatchFunc(isInlineQuery, inlineQueryHandler)
+	b.RegisterHandlerMatchFunc(isImportDocument, groupAdminOnly(importDocumentHandler))
 
+	botInstance = b
+	outbox.start(botContext)
+	convHandler.StartCleanup(botContext, conversationTimeoutHandler)
+
+	if webhook != nil {
+		err = startWebhook(botContext, b, webhook)
+		if err != nil {
+			panic(fmt.Sprintf("error starting webhook: %v", err))
+		}
+		logging.Infof("Receiving updates via webhook at %s", webhook.url.Host)
+		return b
+	}
+
+	// Polling doesn't work while a webhook is set, e.g. if the last run didn't shut down cleanly
+	_, err = b.DeleteWebhook(botContext, &bot.DeleteWebhookParams{})
+	if err != nil {
+		logging.Errorf("Error deleting webhook: %v", err)
+	}
+	logging.Info("Receiving updates via long polling")
 	go func() {
 		b.Start(botContext)
 	}()
-	botInstance = b
 	return b
 }
 
-func NotifyAvailable(user *db.User, reward *patreon.RewardResult, campaign *patreon.Campaign) {
+// StopBot cleans up after the bot context has been cancelled
+func StopBot() {
+	stopWebhook()
+}
+
+// NotifyAvailable notifies the user about an available reward. High priority notifications can be acknowledged
+// to stop re-alerts, which are worded as reminder.
+func NotifyAvailable(user *db.User, reward *patreon.RewardResult, tr *db.TrackedReward, campaign *patreon.Campaign) {
 	logging.Infof("Notifying about available reward: %d", reward.Id)
 	buf := new(bytes.Buffer)
 	err := rewardAvailableTemplate.Execute(buf, &tmpl.RewardAvailableData{
 		Reward:   reward.Reward,
 		Campaign: campaign,
+		Note:     tr.Note,
+		Tags:     tr.TagList(),
+		Realert:  tr.Realerts > 0,
 	})
 	if err != nil {
 		logging.Errorf("Error executing template: %v", err)
 	}
 
-	sendMessage(botContext, &bot.SendMessageParams{
-		ChatID:    user.TelegramChatId,
+	params := &bot.SendMessageParams{
+		ChatID:    user.NotificationChatId(),
 		ParseMode: models.ParseModeHTML,
 		Text:      buf.String(),
+		// High priority rewards bypass the quiet hours
+		DisableNotification: tr.Priority != db.PriorityHigh && user.IsQuietAt(time.Now()),
+	}
+	if tr.Priority == db.PriorityHigh {
+		params.ReplyMarkup = acknowledgeKeyboard(tr)
+	}
+	queueMessage(params)
+}
+
+// NotifyDigest sends a single message listing all low priority rewards that became available
+func NotifyDigest(user *db.User, rewards []*tmpl.RewardAvailableData) {
+	if len(rewards) == 0 {
+		return
+	}
+
+	logging.Infof("Sending digest of %d rewards to user %d", len(rewards), user.ID)
+	buf := new(bytes.Buffer)
+	err := digestTemplate.Execute(buf, &tmpl.DigestData{Rewards: rewards})
+	if err != nil {
+		logging.Errorf("Error executing template: %v", err)
+	}
+
+	disableLinkPreview := true
+	queueMessage(&bot.SendMessageParams{
+		ChatID:              user.NotificationChatId(),
+		ParseMode:           models.ParseModeHTML,
+		LinkPreviewOptions:  &models.LinkPreviewOptions{IsDisabled: &disableLinkPreview},
+		DisableNotification: true,
+		Text:                buf.String(),
 	})
 }
 
@@ -109,10 +216,11 @@ func NotifyMissing(user *db.User, missing []*patreon.RewardResult) {
 		logging.Errorf("Error executing template: %v", err)
 	}
 
-	sendMessage(botContext, &bot.SendMessageParams{
-		ChatID:    user.TelegramChatId,
-		ParseMode: models.ParseModeHTML,
-		Text:      buf.String(),
+	queueMessage(&bot.SendMessageParams{
+		ChatID:              user.NotificationChatId(),
+		ParseMode:           models.ParseModeHTML,
+		Text:                buf.String(),
+		DisableNotification: user.IsQuietAt(time.Now()),
 	})
 	return
 }
@@ -133,26 +241,36 @@ func errorHandler(err error) {
 func patreonClient() *patreon.Client { return tgPatreonClient }
 
 func middlewares() []bot.Middleware {
-	m := []bot.Middleware{
+	return []bot.Middleware{
+		// Updates from groups and channels have to be normalized before anything else looks at them
+		chatMiddleware,
+		accessControlMiddleware,
 		convHandler.CreateHandlerMiddleware(),
 	}
-
-	if creatorOnly && telegramCreatorId > 0 {
-		// Prepend creator only middleware to make sure it gets evaluated first
-		m = append([]bot.Middleware{creatorOnlyMiddleware}, m...)
-	}
-
-	return m
 }
 
 func commandHandlers() []*CommandHandler {
 	sortedCommands := []*CommandHandler{
 		addRewardsCommand(),
+		budgetCommand(),
+		campaignBudgetCommand(),
+		channelCommand(),
+		exportCommand(),
+		importCommand(),
+		inviteCommand(),
 		removeRewardsCommand(),
 		cancelCommand(),
 		listRewardsCommand(),
+		noteCommand(),
+		priorityCommand(),
+		quietCommand(),
+		quotaCommand(),
+		statusCommand(),
+		tagCommand(),
+		untagCommand(),
 		resetNotificationsCommand(),
 	}
+	sortedCommands = append(sortedCommands, adminCommandHandlers()...)
 
 	slices.SortStableFunc(sortedCommands, func(a, b *CommandHandler) int {
 		return strings.Compare(a.Pattern, b.Pattern)
@@ -182,17 +300,31 @@ func registerHandlers(commands []*CommandHandler, tgBot *bot.Bot, ctx context.Co
 		if command.ChatAction != "" {
 			handler = command.ChatActionHandler()
 		}
+		if command.AdminOnly {
+			handler = adminOnly(handler)
+		}
+		if command.GroupAdminOnly {
+			handler = groupAdminOnly(handler)
+		}
 
 		tgBot.RegisterHandler(command.HandlerType, command.Pattern, command.MatchType, handler)
 	}
 }
 
 func registerCommands(commands []*CommandHandler, tgBot *bot.Bot, ctx context.Context) {
+	var publicCommands []*CommandHandler
+	for _, command := range commands {
+		if !command.AdminOnly {
+			publicCommands = append(publicCommands, command)
+		}
+	}
+
 	tgBot.SetMyCommands(ctx, &bot.SetMyCommandsParams{
-		Commands: dsext.Map(commands, func(ch *CommandHandler) models.BotCommand {
+		Commands: dsext.Map(publicCommands, func(ch *CommandHandler) models.BotCommand {
 			return models.BotCommand{Command: ch.Pattern, Description: ch.Description}
 		}),
 	})
+	registerAdminCommands(commands, tgBot, ctx)
 }
 
 func cancelConversationHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
@@ -216,8 +348,11 @@ func chatIdFromUpdate(update *models.Update) (int64, error) {
 	chatId := int64(0)
 	if update.Message != nil {
 		chatId = update.Message.Chat.ID
-	} else if update.CallbackQuery != nil {
+	} else if update.CallbackQuery != nil && update.CallbackQuery.Message.Message != nil {
 		chatId = update.CallbackQuery.Message.Message.Chat.ID
+	} else if update.InlineQuery != nil {
+		// The private chat with a user shares its ID with the user
+		chatId = update.InlineQuery.From.ID
 	}
 
 	if chatId == 0 {
@@ -226,34 +361,31 @@ func chatIdFromUpdate(update *models.Update) (int64, error) {
 	return chatId, nil
 }
 
-func creatorOnlyMiddleware(next bot.HandlerFunc) bot.HandlerFunc {
-	return func(ctx context.Context, b *bot.Bot, update *models.Update) {
-		// Always allow privacy policy command
-		if update.Message != nil && strings.EqualFold(update.Message.Text, privacyPolicyCommand.Pattern) {
-			next(ctx, b, update)
-			return
+// sendMessage sends the message, splitting it into multiple messages if it exceeds Telegram's length limit.
+// The reply parameters are only applied to the first message, the reply markup only to the last one.
+// Returns the last message sent.
+func sendMessage(ctx context.Context, params *bot.SendMessageParams) *models.Message {
+	chunks := splitMessage(params.Text, maxMessageLength, params.ParseMode == models.ParseModeHTML)
+	var m *models.Message
+	for i, chunk := range chunks {
+		chunkParams := *params
+		chunkParams.Text = chunk
+		if i > 0 {
+			chunkParams.ReplyParameters = nil
 		}
-
-		chatId, err := chatIdFromUpdate(update)
-		if err != nil {
-			return
+		if i < len(chunks)-1 {
+			chunkParams.ReplyMarkup = nil
 		}
 
-		if int64(telegramCreatorId) != chatId {
-			sendMessage(ctx, &bot.SendMessageParams{
-				ChatID: chatId,
-				Text:   "This bot is not yet available for the public. If you are interested, please contact this bot's creator (see bot description)",
-			})
-		} else {
-			next(ctx, b, update)
+		var err error
+		m, err = sendPaced(ctx, &chunkParams)
+		if err != nil {
+			logging.Errorf("Error sending message: %v", err)
+			if chatId, ok := params.ChatID.(int64); ok && isChatUnreachable(err) {
+				deactivateChat(chatId, err)
+			}
+			break
 		}
 	}
-}
-
-func sendMessage(ctx context.Context, params *bot.SendMessageParams) *models.Message {
-	m, err := botInstance.SendMessage(ctx, params)
-	if err != nil {
-		logging.Errorf("Error sending message: %v", err)
-	}
 	return m
 }
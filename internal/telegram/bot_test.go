@@ -0,0 +1,142 @@
+package telegram
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fanonwue/patreon-gobot/internal/db"
+	"github.com/fanonwue/patreon-gobot/internal/util"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "patreon-gobot-test")
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv(util.PrefixEnvVar("DATABASE_PATH"), filepath.Join(dir, "test.db"))
+	db.CreateDatabase()
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// createTestUser creates a user with the chat ID and role, removing it again once the test is done
+func createTestUser(t *testing.T, chatId int64, role db.Role) *db.User {
+	user := &db.User{TelegramChatId: chatId, Role: role}
+	assert.NoError(t, db.Db().Create(user).Error)
+	t.Cleanup(func() {
+		db.Db().Unscoped().Delete(&db.TrackedReward{}, "user_id = ?", user.ID)
+		db.Db().Delete(&db.RewardAddition{}, "user_id = ?", user.ID)
+		db.Db().Unscoped().Delete(user)
+	})
+	return user
+}
+
+// fakeTelegram is a Telegram Bot API server recording the messages sent by the bot
+type fakeTelegram struct {
+	mu       sync.Mutex
+	messages map[int64][]string
+	// failures holds the error responses returned for the next messages to the chat
+	failures map[int64][]string
+	requests map[string]int
+}
+
+// newFakeTelegram starts a fake Telegram server and points the bot to it until the test is done. Messages are
+// sent without pacing.
+func newFakeTelegram(t *testing.T) *fakeTelegram {
+	fake := &fakeTelegram{
+		messages: make(map[int64][]string),
+		failures: make(map[int64][]string),
+		requests: make(map[string]int),
+	}
+	server := httptest.NewServer(http.HandlerFunc(fake.handle))
+
+	b, err := bot.New("test-token", bot.WithServerURL(server.URL), bot.WithSkipGetMe())
+	assert.NoError(t, err)
+	previousBot, previousLimiter := botInstance, limiter
+	botInstance, limiter = b, newRateLimiter(0, 0)
+	t.Cleanup(func() {
+		botInstance, limiter = previousBot, previousLimiter
+		server.Close()
+	})
+	return fake
+}
+
+func (ft *fakeTelegram) handle(w http.ResponseWriter, r *http.Request) {
+	_ = r.ParseMultipartForm(1 << 20)
+	method := path.Base(r.URL.Path)
+	chatId, _ := strconv.ParseInt(r.FormValue("chat_id"), 10, 64)
+
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	ft.requests[method]++
+	if method != "sendMessage" {
+		_, _ = w.Write([]byte(`{"ok":true,"result":true}`))
+		return
+	}
+	if failures := ft.failures[chatId]; len(failures) > 0 {
+		ft.failures[chatId] = failures[1:]
+		_, _ = w.Write([]byte(failures[0]))
+		return
+	}
+	ft.messages[chatId] = append(ft.messages[chatId], r.FormValue("text"))
+	_, _ = fmt.Fprintf(w, `{"ok":true,"result":{"message_id":%d,"chat":{"id":%d}}}`, len(ft.messages[chatId]), chatId)
+}
+
+// fail makes the next message to the chat fail with the error code
+func (ft *fakeTelegram) fail(chatId int64, errorCode int, description string, retryAfter int) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	ft.failures[chatId] = append(ft.failures[chatId], fmt.Sprintf(
+		`{"ok":false,"error_code":%d,"description":%q,"parameters":{"retry_after":%d}}`, errorCode, description, retryAfter))
+}
+
+// sentTo returns the texts of all messages delivered to the chat
+func (ft *fakeTelegram) sentTo(chatId int64) []string {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	return append([]string(nil), ft.messages[chatId]...)
+}
+
+// lastSentTo returns the text of the last message delivered to the chat
+func (ft *fakeTelegram) lastSentTo(chatId int64) string {
+	messages := ft.sentTo(chatId)
+	if len(messages) == 0 {
+		return ""
+	}
+	return messages[len(messages)-1]
+}
+
+func (ft *fakeTelegram) requestCount(method string) int {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	return ft.requests[method]
+}
+
+// waitForMessages waits until the number of messages delivered to the chat is reached
+func (ft *fakeTelegram) waitForMessages(t *testing.T, chatId int64, count int) {
+	assert.Eventually(t, func() bool {
+		return len(ft.sentTo(chatId)) >= count
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+// messageUpdate creates an update for a message sent to the bot in the private chat
+func messageUpdate(chatId int64, text string) *models.Update {
+	return &models.Update{Message: &models.Message{
+		ID:   1,
+		Chat: models.Chat{ID: chatId, Type: models.ChatTypePrivate},
+		From: &models.User{ID: chatId},
+		Text: text,
+	}}
+}
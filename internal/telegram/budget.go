@@ -0,0 +1,234 @@
+package telegram
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/fanonwue/goutils/dsext"
+	"github.com/fanonwue/goutils/logging"
+	"github.com/fanonwue/patreon-gobot/internal/db"
+	"github.com/fanonwue/patreon-gobot/internal/patreon"
+	"github.com/fanonwue/patreon-gobot/internal/tmpl"
+	"github.com/fanonwue/patreon-gobot/internal/util"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"gorm.io/gorm"
+)
+
+const budgetOff = "off"
+
+func budgetCommand() *CommandHandler {
+	return &CommandHandler{
+		Pattern:        "/budget",
+		Description:    "Shows or sets the maximum price of rewards you want to be notified about",
+		HandlerType:    bot.HandlerTypeMessageText,
+		MatchType:      bot.MatchTypePrefix,
+		HandlerFunc:    budgetHandler,
+		ChatAction:     models.ChatActionTyping,
+		GroupAdminOnly: true,
+	}
+}
+
+func budgetHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	chatId := update.Message.Chat.ID
+	reply := models.ReplyParameters{
+		MessageID: update.Message.ID,
+	}
+
+	args := commandArgs(update.Message.Text)
+	if len(args) == 0 {
+		sendBudgetOverview(ctx, chatId)
+		return
+	}
+
+	user, _ := userFromChatId(chatId, nil)
+	var text string
+
+	if strings.EqualFold(args[0], budgetOff) {
+		user.BudgetCents = nil
+		text = "Budget removed"
+	} else {
+		cents, err := util.ParseMoney(args[0])
+		if err != nil {
+			sendMessage(ctx, &bot.SendMessageParams{
+				ChatID:          chatId,
+				ReplyParameters: &reply,
+				Text:            "Invalid amount provided. Usage: /budget <amount> <currency>",
+			})
+			return
+		}
+
+		currency := util.Currency(user.BudgetCurrency)
+		if len(args) > 1 {
+			currency = util.Currency(args[1])
+		}
+		if currency == "" {
+			sendMessage(ctx, &bot.SendMessageParams{
+				ChatID:          chatId,
+				ReplyParameters: &reply,
+				Text:            "No currency provided. Usage: /budget <amount> <currency>",
+			})
+			return
+		}
+		if !currency.IsKnown() {
+			sendMessage(ctx, &bot.SendMessageParams{
+				ChatID:          chatId,
+				ReplyParameters: &reply,
+				Text: fmt.Sprintf("Unknown currency %s, supported are: %s", currency, dsext.Join(util.KnownCurrencies, ", ", func(c util.Currency) string {
+					return c.String()
+				})),
+			})
+			return
+		}
+
+		user.BudgetCents = &cents
+		user.BudgetCurrency = currency.String()
+		text = fmt.Sprintf("Budget set to %s", util.FormatCents(cents, currency))
+	}
+
+	err := db.Db().Select("budget_cents", "budget_currency").Save(user).Error
+	if err != nil {
+		logging.Errorf("Error saving budget: %v", err)
+		text = "Error saving budget"
+	} else {
+		logging.Infof("Budget updated for user %d (Chat ID: %d)", user.ID, user.TelegramChatId)
+	}
+
+	sendMessage(ctx, &bot.SendMessageParams{
+		ChatID:          chatId,
+		ReplyParameters: &reply,
+		Text:            text,
+	})
+}
+
+func campaignBudgetCommand() *CommandHandler {
+	return &CommandHandler{
+		Pattern:        "/campaign_budget",
+		Description:    "Sets the maximum price of rewards for a single campaign, overriding your budget",
+		HandlerType:    bot.HandlerTypeMessageText,
+		MatchType:      bot.MatchTypePrefix,
+		HandlerFunc:    campaignBudgetHandler,
+		ChatAction:     models.ChatActionTyping,
+		GroupAdminOnly: true,
+	}
+}
+
+func campaignBudgetHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	chatId := update.Message.Chat.ID
+	reply := models.ReplyParameters{
+		MessageID: update.Message.ID,
+	}
+
+	args := commandArgs(update.Message.Text)
+	if len(args) == 0 {
+		sendBudgetOverview(ctx, chatId)
+		return
+	}
+
+	campaignId, err := strconv.Atoi(args[0])
+	if err != nil || len(args) < 2 {
+		sendMessage(ctx, &bot.SendMessageParams{
+			ChatID:          chatId,
+			ReplyParameters: &reply,
+			Text:            "Usage: /campaign_budget <campaign ID> <amount>, or /campaign_budget <campaign ID> off",
+		})
+		return
+	}
+
+	user, _ := userFromChatId(chatId, nil)
+	var text string
+
+	if strings.EqualFold(args[1], budgetOff) {
+		err = db.Db().Unscoped().Delete(&db.CampaignBudget{}, "user_id = ? AND campaign_id = ?", user.ID, campaignId).Error
+		text = fmt.Sprintf("Budget for campaign %d removed", campaignId)
+	} else {
+		cents, parseErr := util.ParseMoney(args[1])
+		if parseErr != nil {
+			sendMessage(ctx, &bot.SendMessageParams{
+				ChatID:          chatId,
+				ReplyParameters: &reply,
+				Text:            "Invalid amount provided",
+			})
+			return
+		}
+
+		campaign, fetchErr := patreonClient().FetchCampaign(patreon.CampaignId(campaignId), false, ctx)
+		if fetchErr != nil {
+			sendMessage(ctx, &bot.SendMessageParams{
+				ChatID:          chatId,
+				ReplyParameters: &reply,
+				Text:            fmt.Sprintf("Could not find campaign %d", campaignId),
+			})
+			return
+		}
+
+		err = db.Db().Transaction(func(tx *gorm.DB) error {
+			cb := db.CampaignBudget{}
+			tx.Limit(1).Find(&cb, "user_id = ? AND campaign_id = ?", user.ID, campaignId)
+			cb.UserID = user.ID
+			cb.CampaignId = int64(campaignId)
+			cb.MaxPriceCents = cents
+			return tx.Save(&cb).Error
+		})
+		text = fmt.Sprintf("Budget for %s set to %s", campaign.Name(), formatCampaignBudget(cents, campaign))
+	}
+
+	if err != nil {
+		logging.Errorf("Error saving campaign budget: %v", err)
+		text = "Error saving campaign budget"
+	} else {
+		logging.Infof("Campaign budget for campaign %d updated for user %d (Chat ID: %d)", campaignId, user.ID, user.TelegramChatId)
+	}
+
+	sendMessage(ctx, &bot.SendMessageParams{
+		ChatID:          chatId,
+		ReplyParameters: &reply,
+		Text:            text,
+	})
+}
+
+// formatCampaignBudget formats the budget in the currency of the campaign, which is the currency its rewards are
+// priced in. The currency is left out if it isn't known.
+func formatCampaignBudget(cents int, campaign *patreon.Campaign) string {
+	if campaign == nil || campaign.Attributes.Currency == "" {
+		return fmt.Sprintf("%.2f", float64(cents)/100)
+	}
+	return util.FormatCents(cents, campaign.Attributes.Currency)
+}
+
+func sendBudgetOverview(ctx context.Context, chatId int64) {
+	user, _ := userFromChatId(chatId, nil)
+	db.Db().Preload("CampaignBudgets").Find(user)
+
+	data := &tmpl.BudgetData{}
+	if user.BudgetCents != nil {
+		data.Budget = util.FormatCents(*user.BudgetCents, util.Currency(user.BudgetCurrency))
+	}
+
+	for _, cb := range user.CampaignBudgets {
+		campaignId := patreon.CampaignId(cb.CampaignId)
+		campaign, _ := patreonClient().FetchCampaign(campaignId, false, ctx)
+		data.CampaignBudgets = append(data.CampaignBudgets, &tmpl.CampaignBudget{
+			CampaignId: campaignId,
+			Campaign:   campaign,
+			MaxPrice:   formatCampaignBudget(cb.MaxPriceCents, campaign),
+		})
+	}
+
+	buf := new(bytes.Buffer)
+	err := budgetTemplate.Execute(buf, data)
+	if err != nil {
+		logging.Errorf("Error executing template: %v", err)
+	}
+
+	disableLinkPreview := true
+	sendMessage(ctx, &bot.SendMessageParams{
+		ChatID:             chatId,
+		LinkPreviewOptions: &models.LinkPreviewOptions{IsDisabled: &disableLinkPreview},
+		ParseMode:          models.ParseModeHTML,
+		Text:               buf.String(),
+	})
+}
@@ -0,0 +1,17 @@
+package telegram
+
+import (
+	"testing"
+
+	"github.com/fanonwue/patreon-gobot/internal/patreon"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatCampaignBudget(t *testing.T) {
+	campaign := &patreon.Campaign{Attributes: patreon.CampaignAttributes{Currency: "EUR"}}
+	assert.Equal(t, "12.50 €", formatCampaignBudget(1250, campaign))
+
+	// The currency is unknown if the campaign couldn't be fetched
+	assert.Equal(t, "12.50", formatCampaignBudget(1250, nil))
+	assert.Equal(t, "12.50", formatCampaignBudget(1250, &patreon.Campaign{}))
+}
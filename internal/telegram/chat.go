@@ -0,0 +1,191 @@
+package telegram
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/fanonwue/goutils/logging"
+	"github.com/fanonwue/patreon-gobot/internal/db"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+// isGroupChat checks whether the chat is shared by multiple users
+func isGroupChat(chat models.Chat) bool {
+	return chat.Type == models.ChatTypeGroup || chat.Type == models.ChatTypeSupergroup
+}
+
+// stripBotMention removes the bot username from commands addressed like /add@botname. Returns false if the
+// command is addressed to a different bot.
+func stripBotMention(text string, username string) (string, bool) {
+	if !strings.HasPrefix(text, "/") {
+		return text, true
+	}
+
+	commandEnd := strings.IndexFunc(text, unicode.IsSpace)
+	if commandEnd < 0 {
+		commandEnd = len(text)
+	}
+	command, mention, found := strings.Cut(text[:commandEnd], "@")
+	if !found {
+		return text, true
+	}
+	if username != "" && !strings.EqualFold(mention, username) {
+		return text, false
+	}
+	return command + text[commandEnd:], true
+}
+
+// chatMiddleware prepares updates from groups and channels, so handlers can treat them like private messages.
+// Channel posts are handled like regular messages and bot mentions are removed from commands. As handlers
+// are matched before middlewares run, changed updates are dispatched again.
+func chatMiddleware(next bot.HandlerFunc) bot.HandlerFunc {
+	return func(ctx context.Context, b *bot.Bot, update *models.Update) {
+		if update.ChannelPost != nil {
+			update.Message = update.ChannelPost
+			update.ChannelPost = nil
+			b.ProcessUpdate(ctx, update)
+			return
+		}
+
+		if update.Message == nil || update.Message.Chat.Type == models.ChatTypePrivate {
+			next(ctx, b, update)
+			return
+		}
+
+		// Documents carry commands in their caption
+		text, forUs := stripBotMention(update.Message.Text, botUsername)
+		caption, captionForUs := stripBotMention(update.Message.Caption, botUsername)
+		if !forUs || !captionForUs {
+			return
+		}
+		if text != update.Message.Text || caption != update.Message.Caption {
+			update.Message.Text = text
+			update.Message.Caption = caption
+			b.ProcessUpdate(ctx, update)
+			return
+		}
+
+		// Ignore the regular conversation in groups, unless the bot is waiting for input
+		isCommand := strings.HasPrefix(text, "/") || strings.HasPrefix(caption, "/")
+		if _, active := convHandler.stageIdForChat(update.Message.Chat.ID, true); !active && !isCommand {
+			return
+		}
+		next(ctx, b, update)
+	}
+}
+
+func isChatAdministrator(member *models.ChatMember) bool {
+	return member.Type == models.ChatMemberTypeOwner || member.Type == models.ChatMemberTypeAdministrator
+}
+
+// isGroupAdmin checks whether the sender of the message is an administrator of the group
+func isGroupAdmin(ctx context.Context, b *bot.Bot, message *models.Message) bool {
+	// Anonymous administrators send messages on behalf of the group itself
+	if message.SenderChat != nil && message.SenderChat.ID == message.Chat.ID {
+		return true
+	}
+	if message.From == nil {
+		return false
+	}
+	return isChatAdmin(ctx, b, message.Chat.ID, message.From.ID)
+}
+
+// isChatAdmin checks whether the user is an administrator of the chat
+func isChatAdmin(ctx context.Context, b *bot.Bot, chatId int64, userId int64) bool {
+	member, err := b.GetChatMember(ctx, &bot.GetChatMemberParams{ChatID: chatId, UserID: userId})
+	if err != nil {
+		logging.Errorf("Error retrieving chat member %d of chat %d: %v", userId, chatId, err)
+		return false
+	}
+	return isChatAdministrator(member)
+}
+
+// groupAdminOnly wraps the handler so it can only be called by group administrators when used in a group.
+// Channel posts can only be sent by administrators anyway.
+func groupAdminOnly(next bot.HandlerFunc) bot.HandlerFunc {
+	return func(ctx context.Context, b *bot.Bot, update *models.Update) {
+		if update.Message != nil && isGroupChat(update.Message.Chat) && !isGroupAdmin(ctx, b, update.Message) {
+			replyText(ctx, update, "Only group administrators can use this command")
+			return
+		}
+		next(ctx, b, update)
+	}
+}
+
+func channelCommand() *CommandHandler {
+	return &CommandHandler{
+		Pattern:        "/channel",
+		Description:    "Sends notifications to a channel you administer instead of this chat",
+		HandlerType:    bot.HandlerTypeMessageText,
+		MatchType:      bot.MatchTypePrefix,
+		HandlerFunc:    channelHandler,
+		ChatAction:     models.ChatActionTyping,
+		GroupAdminOnly: true,
+	}
+}
+
+func channelHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	chatId := update.Message.Chat.ID
+	user, _ := userFromChatId(chatId, nil)
+
+	args := commandArgs(update.Message.Text)
+	if len(args) == 0 {
+		if user.NotificationChat == nil {
+			replyText(ctx, update, "Notifications are sent to this chat. Use /channel <@channel|Chat ID> to send them to a channel instead.")
+		} else {
+			replyText(ctx, update, fmt.Sprintf("Notifications are sent to the channel with Chat ID %d. Use /channel off to send them to this chat again.", *user.NotificationChat))
+		}
+		return
+	}
+
+	if strings.EqualFold(args[0], "off") {
+		if err := db.Db().Model(user).Update("notification_chat", nil).Error; err != nil {
+			logging.Errorf("Error resetting notification chat of user %d: %v", user.ID, err)
+			replyText(ctx, update, "Error updating notification settings")
+			return
+		}
+		replyText(ctx, update, "Notifications will be sent to this chat again")
+		logging.Infof("Notification chat of user %d (Chat ID: %d) reset", user.ID, user.TelegramChatId)
+		return
+	}
+
+	if update.Message.From == nil {
+		replyText(ctx, update, "The channel has to be set up by one of its administrators")
+		return
+	}
+
+	var target any = args[0]
+	if channelId, err := strconv.ParseInt(args[0], 10, 64); err == nil {
+		target = channelId
+	}
+	channel, err := b.GetChat(ctx, &bot.GetChatParams{ChatID: target})
+	if err != nil || channel.Type != models.ChatTypeChannel {
+		replyText(ctx, update, "Channel not found. Make sure the bot has been added to the channel as an administrator.")
+		return
+	}
+
+	member, err := b.GetChatMember(ctx, &bot.GetChatMemberParams{ChatID: channel.ID, UserID: update.Message.From.ID})
+	if err != nil || !isChatAdministrator(member) {
+		replyText(ctx, update, "You have to be an administrator of the channel")
+		return
+	}
+
+	botMember, err := b.GetChatMember(ctx, &bot.GetChatMemberParams{ChatID: channel.ID, UserID: botId})
+	if err != nil || botMember.Administrator == nil || !botMember.Administrator.CanPostMessages {
+		replyText(ctx, update, "The bot has to be allowed to post messages in the channel")
+		return
+	}
+
+	if err = db.Db().Model(user).Update("notification_chat", channel.ID).Error; err != nil {
+		logging.Errorf("Error setting notification chat of user %d: %v", user.ID, err)
+		replyText(ctx, update, "Error updating notification settings")
+		return
+	}
+
+	replyText(ctx, update, fmt.Sprintf("Notifications will be sent to %s", channel.Title))
+	logging.Infof("Notification chat of user %d (Chat ID: %d) set to %d", user.ID, user.TelegramChatId, channel.ID)
+}
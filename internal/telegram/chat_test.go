@@ -0,0 +1,34 @@
+package telegram
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStripBotMention(t *testing.T) {
+	tests := []struct {
+		text     string
+		expected string
+		forUs    bool
+	}{
+		{"/add 1 2", "/add 1 2", true},
+		{"/add@GoBot 1 2", "/add 1 2", true},
+		{"/list@gobot", "/list", true},
+		{"/add@GoBot\n1", "/add\n1", true},
+		{"/add@OtherBot 1", "/add@OtherBot 1", false},
+		{"mail me at a@b.c", "mail me at a@b.c", true},
+	}
+
+	for _, test := range tests {
+		text, forUs := stripBotMention(test.text, "GoBot")
+		assert.Equal(t, test.expected, text, test.text)
+		assert.Equal(t, test.forUs, forUs, test.text)
+	}
+}
+
+func TestStripBotMention_UnknownUsername(t *testing.T) {
+	text, forUs := stripBotMention("/add@AnyBot 1", "")
+	assert.Equal(t, "/add 1", text)
+	assert.True(t, forUs)
+}
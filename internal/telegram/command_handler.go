@@ -13,6 +13,9 @@ type CommandHandler struct {
 	HandlerType bot.HandlerType
 	MatchType   bot.MatchType
 	HandlerFunc bot.HandlerFunc
+	AdminOnly   bool
+	// GroupAdminOnly restricts the command to group administrators when used in a group
+	GroupAdminOnly bool
 }
 
 func (ch *CommandHandler) ChatActionHandler() bot.HandlerFunc {
@@ -1,143 +1,56 @@
 package telegram
 
 import (
-	"bytes"
-	"cmp"
 	"context"
 	"fmt"
-	"maps"
-	"slices"
 	"strconv"
 	"strings"
+	"unicode"
 
-	"github.com/fanonwue/goutils/dsext"
 	"github.com/fanonwue/goutils/logging"
 	"github.com/fanonwue/patreon-gobot/internal/db"
 	"github.com/fanonwue/patreon-gobot/internal/patreon"
-	"github.com/fanonwue/patreon-gobot/internal/tmpl"
 	"github.com/go-telegram/bot"
 	"github.com/go-telegram/bot/models"
 	"gorm.io/gorm"
 )
 
+// parseIdList parses reward IDs separated by commas or whitespace. Patreon checkout links are accepted as well.
 func parseIdList(message string) []int {
 	var ids []int
-	splitByComma := strings.Split(message, ",")
-	for _, segment := range splitByComma {
-		splitBySpace := strings.Split(segment, " ")
-		for _, rawId := range splitBySpace {
-			id := strings.TrimSpace(rawId)
-			if id == "" {
-				continue
-			}
-			parsedId, err := strconv.Atoi(id)
-			if err != nil {
-				continue
-			}
+	segments := strings.FieldsFunc(message, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+	for _, segment := range segments {
+		if parsedId, err := strconv.Atoi(segment); err == nil {
 			ids = append(ids, parsedId)
+			continue
+		}
+		if rewardId, ok := patreon.RewardIdFromUrl(segment); ok {
+			ids = append(ids, int(rewardId))
 		}
 	}
 	return ids
 }
 
-func addRewardsCommand() *CommandHandler {
-	return &CommandHandler{
-		Pattern:     "/add",
-		Description: "Adds one or more Rewards IDs to the list of observed rewards",
-		HandlerType: bot.HandlerTypeMessageText,
-		MatchType:   bot.MatchTypePrefix,
-		HandlerFunc: addRewardsHandler,
-		ChatAction:  models.ChatActionTyping,
+// commandArgs returns the whitespace separated arguments following the command
+func commandArgs(message string) []string {
+	fields := strings.Fields(message)
+	if len(fields) <= 1 {
+		return []string{}
 	}
-}
-
-func addRewardsHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
-	chatId := update.Message.Chat.ID
-	reply := models.ReplyParameters{
-		MessageID: update.Message.ID,
-	}
-
-	ids := parseIdList(update.Message.Text)
-
-	if len(ids) == 0 {
-		sendMessage(ctx, &bot.SendMessageParams{
-			ChatID:          chatId,
-			ReplyParameters: &reply,
-			Text:            "No valid reward IDs provided",
-		})
-		return
-	}
-
-	user, _ := userFromChatId(chatId, nil)
-	db.Db().Preload("Rewards").Find(user)
-	existingRewardIds := dsext.Map(user.Rewards, func(r db.TrackedReward) int {
-		return int(r.RewardId)
-	})
-
-	var newRewardIds []patreon.RewardId
-	for _, id := range ids {
-		if !slices.Contains(existingRewardIds, id) {
-			newRewardIds = append(newRewardIds, patreon.RewardId(id))
-		}
-	}
-
-	if len(newRewardIds) == 0 {
-		sendMessage(ctx, &bot.SendMessageParams{
-			ChatID:          chatId,
-			ReplyParameters: &reply,
-			Text:            "No new reward ID found",
-		})
-		return
-	}
-
-	var foundIds []patreon.RewardId
-
-	for r := range patreonClient().FetchRewardsSlice(newRewardIds, false, ctx) {
-		if r.IsPresent() {
-			foundIds = append(foundIds, r.Id)
-		}
-	}
-
-	var savedRewards []string
-	txErr := db.Db().Transaction(func(tx *gorm.DB) error {
-		for _, id := range foundIds {
-			tracked := db.TrackedReward{RewardId: int64(id), UserID: user.ID}
-			tx.Save(&tracked)
-			if tx.Error != nil {
-				return tx.Error
-			}
-			if tracked.ID > 0 {
-				savedRewards = append(savedRewards, strconv.Itoa(int(tracked.RewardId)))
-			}
-		}
-		return nil
-	})
-	if txErr != nil {
-		logging.Errorf("Error occured while adding rewards: %v", txErr)
-		sendMessage(ctx, &bot.SendMessageParams{
-			ChatID: chatId,
-			Text:   fmt.Sprintf("Error saving rewards: %s", txErr),
-		})
-		return
-	}
-
-	savedRewardsJoined := strings.Join(savedRewards, ", ")
-	sendMessage(ctx, &bot.SendMessageParams{
-		ChatID:          chatId,
-		ReplyParameters: &reply,
-		Text:            fmt.Sprintf("Now tracking rewards [%s]", savedRewardsJoined),
-	})
-	logging.Infof("Added rewards [%s] for user %d (Chat ID: %d)", savedRewardsJoined, user.ID, user.TelegramChatId)
+	return fields[1:]
 }
 
 func removeRewardsCommand() *CommandHandler {
 	return &CommandHandler{
-		Pattern:     "/remove",
-		Description: "Remove one or more Rewards IDs from the list of observed rewards",
-		HandlerType: bot.HandlerTypeMessageText,
-		MatchType:   bot.MatchTypePrefix,
-		HandlerFunc: removeRewardsHandler,
-		ChatAction:  models.ChatActionTyping,
+		Pattern:        "/remove",
+		Description:    "Remove one or more Rewards IDs from the list of observed rewards",
+		HandlerType:    bot.HandlerTypeMessageText,
+		MatchType:      bot.MatchTypePrefix,
+		HandlerFunc:    removeRewardsHandler,
+		ChatAction:     models.ChatActionTyping,
+		GroupAdminOnly: true,
 	}
 }
 
@@ -187,105 +100,15 @@ func removeRewardsHandler(ctx context.Context, b *bot.Bot, update *models.Update
 	logging.Infof("Removed rewards [%s] for user %d (Chat ID: %d)", removedRewardsJoined, user.ID, user.TelegramChatId)
 }
 
-func listRewardsCommand() *CommandHandler {
-	return &CommandHandler{
-		Pattern:     "/list",
-		Description: "Shows a list of currently tracked rewards",
-		HandlerType: bot.HandlerTypeMessageText,
-		MatchType:   bot.MatchTypeExact,
-		HandlerFunc: listRewardsHandler,
-		ChatAction:  models.ChatActionTyping,
-	}
-}
-
-func listRewardsHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
-	chatId := update.Message.Chat.ID
-	user, _ := userFromChatId(chatId, nil)
-	db.Db().Preload("Rewards").Find(user)
-
-	campaigns := map[patreon.CampaignId]*tmpl.ListCampaign{}
-
-	rewardResults := patreonClient().FetchRewardsSlice(dsext.Map(user.Rewards, func(r db.TrackedReward) patreon.RewardId {
-		return patreon.RewardId(r.RewardId)
-	}), false, ctx)
-
-	var missingRewards []*patreon.RewardResult
-
-	for result := range rewardResults {
-		if !result.IsPresent() {
-			missingRewards = append(missingRewards, &result)
-			continue
-		}
-
-		r := result.Reward
-
-		campaignId, err := r.CampaignId()
-		if err != nil {
-			result.Status = patreon.RewardErrorNoCampaign
-			missingRewards = append(missingRewards, &result)
-			continue
-		}
-
-		listCampaign, found := campaigns[campaignId]
-		if !found {
-			campaign, err := patreonClient().FetchCampaign(campaignId, false)
-			if err != nil {
-				result.Status = patreon.RewardErrorNoCampaign
-				missingRewards = append(missingRewards, &result)
-				continue
-			}
-			listCampaign = &tmpl.ListCampaign{Campaign: campaign, Rewards: []*patreon.Reward{}}
-			campaigns[campaignId] = listCampaign
-		}
-
-		listCampaign.AddReward(r)
-	}
-
-	listCampaigns := slices.SortedFunc(maps.Values(campaigns), func(a, b *tmpl.ListCampaign) int {
-		return cmp.Compare(a.Campaign.Name(), b.Campaign.Name())
-	})
-
-	buf := new(bytes.Buffer)
-	err := listRewardsTemplate.Execute(buf, &tmpl.ListTemplateData{Campaigns: listCampaigns})
-	if err != nil {
-		logging.Errorf("Error executing template: %v", err)
-	}
-
-	disableLinkPreview := true
-
-	sendMessage(ctx, &bot.SendMessageParams{
-		ChatID:             chatId,
-		LinkPreviewOptions: &models.LinkPreviewOptions{IsDisabled: &disableLinkPreview},
-		ParseMode:          models.ParseModeHTML,
-		Text:               buf.String(),
-	})
-
-	if len(missingRewards) == 0 {
-		return
-	}
-
-	buf.Reset()
-	err = missingRewardsTemplate.Execute(buf, &tmpl.MissingRewardsData{Rewards: missingRewards})
-	if err != nil {
-		logging.Errorf("Error executing template: %v", err)
-	}
-
-	sendMessage(ctx, &bot.SendMessageParams{
-		ChatID:             chatId,
-		LinkPreviewOptions: &models.LinkPreviewOptions{IsDisabled: &disableLinkPreview},
-		ParseMode:          models.ParseModeHTML,
-		Text:               buf.String(),
-	})
-}
-
 func resetNotificationsCommand() *CommandHandler {
 	return &CommandHandler{
-		Pattern:     "/reset_notifications",
-		Description: "Resets the notification tracker. Previous notifications for (still) available rewards will be sent again.",
-		HandlerType: bot.HandlerTypeMessageText,
-		MatchType:   bot.MatchTypeExact,
-		HandlerFunc: resetNotificationsHandler,
-		ChatAction:  models.ChatActionTyping,
+		Pattern:        "/reset_notifications",
+		Description:    "Resets the notification tracker. Previous notifications for (still) available rewards will be sent again.",
+		HandlerType:    bot.HandlerTypeMessageText,
+		MatchType:      bot.MatchTypeExact,
+		HandlerFunc:    resetNotificationsHandler,
+		ChatAction:     models.ChatActionTyping,
+		GroupAdminOnly: true,
 	}
 }
 
@@ -331,12 +154,14 @@ func cancelCommand() *CommandHandler {
 	}
 }
 
+const startCommandPattern = "/start"
+
 func startCommand() *CommandHandler {
 	return &CommandHandler{
-		Pattern:     "/start",
+		Pattern:     startCommandPattern,
 		Description: "Starts bot interaction",
 		HandlerType: bot.HandlerTypeMessageText,
-		MatchType:   bot.MatchTypeExact,
+		MatchType:   bot.MatchTypePrefix,
 		HandlerFunc: startHandler,
 		ChatAction:  models.ChatActionTyping,
 	}
@@ -344,18 +169,47 @@ func startCommand() *CommandHandler {
 
 func startHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
 	chatId := update.Message.Chat.ID
+	// Invite codes are passed as argument, either manually or via deep link
+	inviteCode := ""
+	if args := commandArgs(update.Message.Text); len(args) > 0 {
+		inviteCode = args[0]
+	}
+
 	var user *db.User
-	var userFound bool
+	var userFound, reactivated, inviteRedeemed bool
 	txErr := db.Db().Transaction(func(tx *gorm.DB) error {
 		user, userFound = userFromChatId(chatId, tx)
 
 		if userFound {
+			if user.IsInactive {
+				reactivated = true
+				if err := tx.Model(user).Update("is_inactive", false).Error; err != nil {
+					return err
+				}
+			}
+			if user.Role == db.RolePending {
+				if invite := findValidInvite(inviteCode, tx); invite != nil {
+					inviteRedeemed = true
+					if err := tx.Model(user).Update("role", db.RoleUser).Error; err != nil {
+						return err
+					}
+					return redeemInvite(invite, user, tx)
+				}
+			}
 			return nil
 		}
 
+		var invite *db.Invite
 		user.TelegramChatId = chatId
-		tx.Create(&user)
-		return tx.Error
+		user.Role, invite = initialRole(chatId, inviteCode, tx)
+		if err := tx.Create(&user).Error; err != nil {
+			return err
+		}
+		if invite != nil {
+			inviteRedeemed = true
+			return redeemInvite(invite, user, tx)
+		}
+		return nil
 	})
 	if txErr != nil {
 		logging.Errorf("Error adding user: %v", txErr)
@@ -365,7 +219,32 @@ func startHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
 		})
 		return
 	}
-	if userFound {
+	if reactivated {
+		logging.Infof("Reactivated user %d (Chat ID: %d)", user.ID, user.TelegramChatId)
+	}
+	if inviteRedeemed {
+		logging.Infof("User %d (Chat ID: %d) redeemed an invite", user.ID, user.TelegramChatId)
+	}
+
+	if user.Role == db.RoleBanned {
+		return
+	}
+
+	if user.Role == db.RolePending {
+		text := "Your access request has not been approved yet. You will be notified once an admin approves it."
+		if !userFound {
+			text = "This bot is not open to the public. Your access request has been forwarded to the admins, you will be notified once it's approved."
+			requestApproval(ctx, user, update.Message.From)
+			logging.Infof("Registered new pending user %d (Chat ID: %d)", user.ID, user.TelegramChatId)
+		}
+		sendMessage(ctx, &bot.SendMessageParams{
+			ChatID: chatId,
+			Text:   text,
+		})
+		return
+	}
+
+	if userFound && !inviteRedeemed {
 		sendMessage(ctx, &bot.SendMessageParams{
 			ChatID: chatId,
 			Text:   "You are already registered. Welcome back!",
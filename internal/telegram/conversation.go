@@ -2,12 +2,21 @@ package telegram
 
 import (
 	"context"
+	"encoding/json"
+	"github.com/fanonwue/goutils/logging"
+	"github.com/fanonwue/patreon-gobot/internal/db"
 	"github.com/go-telegram/bot"
 	"github.com/go-telegram/bot/models"
 	"strings"
 	"sync"
+	"time"
 )
 
+const conversationCleanupInterval = time.Minute
+
+// conversationLockStripes is the number of locks the chats are spread across, so chats rarely wait for each other
+const conversationLockStripes = 64
+
 type ConversationStage map[int]bot.HandlerFunc
 
 type ConversationEnd struct {
@@ -15,16 +24,21 @@ type ConversationEnd struct {
 	Function bot.HandlerFunc
 }
 
-type ConversationHandler struct {
-	stagesMutex         sync.RWMutex
-	activeStagesPerChat map[int64]int
-	stages              ConversationStage
-	end                 *ConversationEnd
-}
+// ConversationTimeout gets called for every conversation that has been abandoned
+type ConversationTimeout func(chatId int64, stageId int)
 
-type ConversationBot struct {
-	bot.Bot
-	conversationHandler *ConversationHandler
+// ConversationHandler routes messages to the handler of the active conversation stage of the chat.
+// Conversations are persisted in the database, so they survive restarts. Every conversation can carry
+// a payload, which gets stored as JSON. Changes to the conversation of a chat are serialized by a lock per chat.
+// The chats with a conversation are kept in memory, so messages of other chats don't need to query the database.
+type ConversationHandler struct {
+	chatMutexes [conversationLockStripes]sync.Mutex
+	// activeMutex guards activeChats, it is never held during database operations
+	activeMutex sync.Mutex
+	activeChats map[int64]struct{}
+	stages      ConversationStage
+	end         *ConversationEnd
+	timeout     time.Duration
 }
 
 func (c *ConversationHandler) CreateHandlerMiddleware() bot.Middleware {
@@ -40,20 +54,120 @@ func (c *ConversationHandler) CreateHandlerMiddleware() bot.Middleware {
 	}
 }
 
-func NewConversationHandler(stages ConversationStage, end *ConversationEnd) *ConversationHandler {
+// NewConversationHandler creates a handler for the given stages. Conversations without any activity for the
+// duration of the timeout are ended.
+func NewConversationHandler(stages ConversationStage, end *ConversationEnd, timeout time.Duration) *ConversationHandler {
+	var chatIds []int64
+	db.Db().Model(&db.Conversation{}).Pluck("chat_id", &chatIds)
+	activeChats := make(map[int64]struct{}, len(chatIds))
+	for _, chatId := range chatIds {
+		activeChats[chatId] = struct{}{}
+	}
 	return &ConversationHandler{
-		stagesMutex:         sync.RWMutex{},
-		activeStagesPerChat: make(map[int64]int),
-		stages:              stages,
-		end:                 end,
+		activeChats: activeChats,
+		stages:      stages,
+		end:         end,
+		timeout:     timeout,
+	}
+}
+
+// lockChat locks the conversation of the chat, returning the function to unlock it again
+func (c *ConversationHandler) lockChat(chatId int64) func() {
+	mutex := &c.chatMutexes[uint64(chatId)%conversationLockStripes]
+	mutex.Lock()
+	return mutex.Unlock
+}
+
+// hasConversation checks whether the chat may have a conversation, without querying the database. Expired
+// conversations count until they are cleaned up.
+func (c *ConversationHandler) hasConversation(chatId int64) bool {
+	c.activeMutex.Lock()
+	defer c.activeMutex.Unlock()
+	_, found := c.activeChats[chatId]
+	return found
+}
+
+func (c *ConversationHandler) setHasConversation(chatId int64, active bool) {
+	c.activeMutex.Lock()
+	defer c.activeMutex.Unlock()
+	if active {
+		c.activeChats[chatId] = struct{}{}
+	} else {
+		delete(c.activeChats, chatId)
 	}
 }
 
+// SetActiveConversationStage moves the conversation to the stage, keeping its payload and resetting the timeout
 func (c *ConversationHandler) SetActiveConversationStage(chatId int64, stageId int) {
-	c.stagesMutex.Lock()
-	defer c.stagesMutex.Unlock()
+	defer c.lockChat(chatId)()
+
+	conv, found := c.findConversation(chatId, true)
+	if !found || c.isExpired(conv, time.Now()) {
+		// Expired conversations that haven't been cleaned up yet don't pass on their payload
+		conv.Payload = ""
+	}
+	conv.ChatId = chatId
+	conv.Stage = stageId
+	conv.ExpiresAt = c.expiry()
+	if err := db.Db().Save(conv).Error; err != nil {
+		logging.Errorf("Error saving conversation of chat %d: %v", chatId, err)
+		return
+	}
+	c.setHasConversation(chatId, true)
+}
 
-	c.activeStagesPerChat[chatId] = stageId
+// SetConversationData attaches the payload to the active conversation of the chat. The payload has to be
+// serializable to JSON.
+func (c *ConversationHandler) SetConversationData(chatId int64, data any) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	defer c.lockChat(chatId)()
+
+	return db.Db().Model(&db.Conversation{}).
+		Where("chat_id = ? AND expires_at > ?", chatId, time.Now().UTC()).
+		Update("payload", string(payload)).Error
+}
+
+// ConversationData reads the payload of the active conversation of the chat into data. Returns false if there's
+// no active conversation or it doesn't carry a payload.
+func (c *ConversationHandler) ConversationData(chatId int64, data any) bool {
+	if !c.hasConversation(chatId) {
+		return false
+	}
+	defer c.lockChat(chatId)()
+
+	conv, found := c.findConversation(chatId, false)
+	return found && unmarshalPayload(conv, data)
+}
+
+// TakeConversationData ends the active conversation of the chat if it's in the given stage, reading its payload
+// into data. Ending the conversation at the same time makes sure the payload is only used once.
+func (c *ConversationHandler) TakeConversationData(chatId int64, stageId int, data any) bool {
+	if !c.hasConversation(chatId) {
+		return false
+	}
+	defer c.lockChat(chatId)()
+
+	conv, found := c.findConversation(chatId, false)
+	if !found || conv.Stage != stageId {
+		return false
+	}
+	c.endConversationInternal(chatId, false)
+	return unmarshalPayload(conv, data)
+}
+
+func unmarshalPayload(conv *db.Conversation, data any) bool {
+	if conv.Payload == "" {
+		return false
+	}
+	if err := json.Unmarshal([]byte(conv.Payload), data); err != nil {
+		logging.Errorf("Error reading conversation payload of chat %d: %v", conv.ChatId, err)
+		return false
+	}
+	return true
 }
 
 func (c *ConversationHandler) EndConversation(chatId int64) {
@@ -62,48 +176,124 @@ func (c *ConversationHandler) EndConversation(chatId int64) {
 
 func (c *ConversationHandler) endConversationInternal(chatId int64, lock bool) {
 	if lock {
-		c.stagesMutex.Lock()
-		defer c.stagesMutex.Unlock()
+		defer c.lockChat(chatId)()
 	}
 
-	delete(c.activeStagesPerChat, chatId)
+	if err := db.Db().Unscoped().Delete(&db.Conversation{}, "chat_id = ?", chatId).Error; err != nil {
+		logging.Errorf("Error ending conversation of chat %d: %v", chatId, err)
+		return
+	}
+	c.setHasConversation(chatId, false)
+}
+
+// StartCleanup periodically ends expired conversations until the context is cancelled. This includes conversations
+// that expired while the bot was not running.
+func (c *ConversationHandler) StartCleanup(ctx context.Context, onTimeout ConversationTimeout) {
+	go func() {
+		ticker := time.NewTicker(conversationCleanupInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				for _, conv := range c.removeExpired(now) {
+					onTimeout(conv.ChatId, conv.Stage)
+				}
+			}
+		}
+	}()
+}
+
+// removeExpired ends all conversations that expired by now. Every chat is locked on its own, and conversations
+// that got extended in the meantime are kept.
+func (c *ConversationHandler) removeExpired(now time.Time) []db.Conversation {
+	var candidates, expired []db.Conversation
+	db.Db().Find(&candidates, "expires_at <= ?", now.UTC())
+	for _, conv := range candidates {
+		if c.removeIfExpired(conv, now) {
+			expired = append(expired, conv)
+		}
+	}
+	return expired
 }
 
+func (c *ConversationHandler) removeIfExpired(conv db.Conversation, now time.Time) bool {
+	defer c.lockChat(conv.ChatId)()
+
+	result := db.Db().Unscoped().Delete(&db.Conversation{}, "id = ? AND expires_at <= ?", conv.ID, now.UTC())
+	if result.Error != nil {
+		logging.Errorf("Error removing expired conversation of chat %d: %v", conv.ChatId, result.Error)
+		return false
+	}
+	if result.RowsAffected == 0 {
+		return false
+	}
+	c.setHasConversation(conv.ChatId, false)
+	return true
+}
+
+func (c *ConversationHandler) expiry() time.Time {
+	if c.timeout <= 0 {
+		// Conversations without timeout never expire
+		return time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC)
+	}
+	return time.Now().Add(c.timeout).UTC()
+}
+
+func (c *ConversationHandler) isExpired(conv *db.Conversation, now time.Time) bool {
+	return !now.Before(conv.ExpiresAt)
+}
+
+// findConversation loads the conversation of the chat, optionally including expired ones
+func (c *ConversationHandler) findConversation(chatId int64, includeExpired bool) (*db.Conversation, bool) {
+	conv := &db.Conversation{}
+	query := db.Db().Limit(1)
+	if !includeExpired {
+		query = query.Where("expires_at > ?", time.Now().UTC())
+	}
+	query.Find(conv, "chat_id = ?", chatId)
+	return conv, conv.ID > 0
+}
+
+// getStageFunction returns the handler of the active stage. Only messages are handled by stages, everything else
+// (like button presses) is handled by the regular handlers.
 func (c *ConversationHandler) getStageFunction(update *models.Update) bot.HandlerFunc {
-	chatId, err := chatIdFromUpdate(update)
-	if err != nil {
+	if update.Message == nil {
+		return nil
+	}
+	chatId := update.Message.Chat.ID
+	if !c.hasConversation(chatId) {
 		return nil
 	}
 
-	stageId, active := c.stageIdForChat(chatId, true)
-
-	if active {
-		if update.Message != nil && strings.ToLower(update.Message.Text) == strings.ToLower(c.end.Command) {
-			c.stagesMutex.Lock()
-			defer c.stagesMutex.Unlock()
-			// Retest condition after acquiring write lock
-			_, active = c.stageIdForChat(chatId, false)
-			if !active {
-				// Return nil if it's not active anymore
-				return nil
-			}
-			c.endConversationInternal(chatId, false)
-			return c.end.Function
-		}
+	defer c.lockChat(chatId)()
+	stageId, active := c.stageIdForChat(chatId, false)
+	if !active {
+		return nil
+	}
 
-		if hf, ok := c.stages[stageId]; ok {
-			return hf
-		}
+	if strings.ToLower(update.Message.Text) == strings.ToLower(c.end.Command) {
+		c.endConversationInternal(chatId, false)
+		return c.end.Function
 	}
 
+	if hf, ok := c.stages[stageId]; ok {
+		return hf
+	}
 	return nil
 }
 
 func (c *ConversationHandler) stageIdForChat(chatId int64, lock bool) (int, bool) {
+	if !c.hasConversation(chatId) {
+		return 0, false
+	}
 	if lock {
-		c.stagesMutex.RLock()
-		defer c.stagesMutex.RUnlock()
+		defer c.lockChat(chatId)()
+	}
+	conv, active := c.findConversation(chatId, false)
+	if !active {
+		return 0, false
 	}
-	stageId, active := c.activeStagesPerChat[chatId]
-	return stageId, active
+	return conv.Stage, true
 }
@@ -0,0 +1,36 @@
+package telegram
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConversationHandler(t *testing.T) {
+	c := NewConversationHandler(nil, nil, time.Minute)
+	const chatId = 5001
+	assert.False(t, c.hasConversation(chatId))
+
+	c.SetActiveConversationStage(chatId, stageAddConfirm)
+	assert.True(t, c.hasConversation(chatId))
+	assert.NoError(t, c.SetConversationData(chatId, []int{1, 2}))
+
+	// Conversations are loaded from the database on start
+	assert.True(t, NewConversationHandler(nil, nil, time.Minute).hasConversation(chatId))
+
+	var data []int
+	assert.False(t, c.TakeConversationData(chatId, stageAddRewards, &data))
+	assert.True(t, c.TakeConversationData(chatId, stageAddConfirm, &data))
+	assert.Equal(t, []int{1, 2}, data)
+	assert.False(t, c.hasConversation(chatId))
+	_, active := c.stageIdForChat(chatId, true)
+	assert.False(t, active)
+
+	c.SetActiveConversationStage(chatId, stageAddRewards)
+	expired := c.removeExpired(time.Now().Add(2 * time.Minute))
+	if assert.Len(t, expired, 1) {
+		assert.Equal(t, int64(chatId), expired[0].ChatId)
+	}
+	assert.False(t, c.hasConversation(chatId))
+}
@@ -0,0 +1,110 @@
+package telegram
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/fanonwue/goutils/logging"
+	"github.com/fanonwue/patreon-gobot/internal/db"
+	"github.com/fanonwue/patreon-gobot/internal/tmpl"
+	"github.com/fanonwue/patreon-gobot/internal/util"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+const (
+	// inlineResultsPerPage is the maximum number of results Telegram accepts per answer
+	inlineResultsPerPage = 50
+	inlineCacheSeconds   = 60
+)
+
+func isInlineQuery(update *models.Update) bool {
+	return update.InlineQuery != nil
+}
+
+// inlineQueryHandler answers inline queries with the tracked rewards of the user whose campaign name, title,
+// note or tags contain all words of the query
+func inlineQueryHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	query := update.InlineQuery
+	user, _ := userFromChatId(query.From.ID, nil)
+	db.Db().Preload("Rewards").Preload("CampaignBudgets").Find(user)
+
+	listCampaigns, _ := collectListCampaigns(ctx, user, &listOptions{sort: tmpl.DefaultListSort})
+	terms := strings.Fields(strings.ToLower(query.Query))
+
+	var results []models.InlineQueryResult
+	for _, listCampaign := range listCampaigns {
+		for _, reward := range listCampaign.Rewards {
+			if matchesInlineQuery(listCampaign, reward, terms) {
+				results = append(results, inlineRewardResult(listCampaign, reward))
+			}
+		}
+	}
+
+	offset, _ := strconv.Atoi(query.Offset)
+	offset = min(max(offset, 0), len(results))
+	end := min(offset+inlineResultsPerPage, len(results))
+	nextOffset := ""
+	if end < len(results) {
+		nextOffset = strconv.Itoa(end)
+	}
+
+	_, err := b.AnswerInlineQuery(ctx, &bot.AnswerInlineQueryParams{
+		InlineQueryID: query.ID,
+		Results:       results[offset:end],
+		CacheTime:     inlineCacheSeconds,
+		IsPersonal:    true,
+		NextOffset:    nextOffset,
+	})
+	if err != nil {
+		logging.Errorf("Error answering inline query for user %d (Chat ID: %d): %v", user.ID, user.TelegramChatId, err)
+	}
+}
+
+func matchesInlineQuery(listCampaign *tmpl.ListCampaign, reward *tmpl.ListReward, terms []string) bool {
+	searchable := strings.ToLower(strings.Join([]string{
+		listCampaign.Campaign.Name(), reward.Title(), reward.Note, strings.Join(reward.Tags, " "),
+	}, " "))
+	for _, term := range terms {
+		if !strings.Contains(searchable, term) {
+			return false
+		}
+	}
+	return true
+}
+
+func inlineRewardResult(listCampaign *tmpl.ListCampaign, reward *tmpl.ListReward) models.InlineQueryResult {
+	buf := new(bytes.Buffer)
+	err := sharedRewardTemplate.Execute(buf, &tmpl.RewardAvailableData{
+		Reward:   reward.Reward,
+		Campaign: listCampaign.Campaign,
+	})
+	if err != nil {
+		logging.Errorf("Error executing template: %v", err)
+	}
+
+	availability := util.EmojiCross + " sold out"
+	if reward.IsAvailable() {
+		availability = util.EmojiGreenCheck + " " + strconv.Itoa(reward.Attributes.Remaining) + " left"
+	}
+
+	return &models.InlineQueryResultArticle{
+		ID:    strconv.Itoa(int(reward.Id)),
+		Title: reward.Title(),
+		Description: strings.Join([]string{
+			listCampaign.Campaign.Name(), reward.FormattedAmount(), availability,
+		}, " · "),
+		ThumbnailURL: reward.Attributes.ImageUrl,
+		InputMessageContent: &models.InputTextMessageContent{
+			MessageText: buf.String(),
+			ParseMode:   models.ParseModeHTML,
+		},
+		ReplyMarkup: &models.InlineKeyboardMarkup{
+			InlineKeyboard: [][]models.InlineKeyboardButton{{
+				{Text: "Join on Patreon", URL: reward.FullUrl()},
+			}},
+		},
+	}
+}
@@ -0,0 +1,60 @@
+package telegram
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/fanonwue/patreon-gobot/internal/patreon"
+	"github.com/fanonwue/patreon-gobot/internal/tmpl"
+	"github.com/go-telegram/bot/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func inlineTestReward(remaining int) (*tmpl.ListCampaign, *tmpl.ListReward) {
+	campaign := &tmpl.ListCampaign{Campaign: &patreon.Campaign{
+		Attributes: patreon.CampaignAttributes{Name: "Some Artist"},
+	}}
+	reward := &tmpl.ListReward{
+		Reward: &patreon.Reward{
+			Id:         1234,
+			Attributes: patreon.RewardAttributes{Title: "Gold Tier", Remaining: remaining, AmountCents: 500},
+		},
+		Note: "Signed Prints",
+		Tags: []string{"art", "physical"},
+	}
+	return campaign, reward
+}
+
+func TestMatchesInlineQuery(t *testing.T) {
+	campaign, reward := inlineTestReward(1)
+	matches := func(query string) bool {
+		return matchesInlineQuery(campaign, reward, strings.Fields(strings.ToLower(query)))
+	}
+
+	assert.True(t, matches(""))
+	// Campaign name, title, note and tags are searched, ignoring case
+	assert.True(t, matches("ARTIST"))
+	assert.True(t, matches("gold"))
+	assert.True(t, matches("prints"))
+	assert.True(t, matches("physical"))
+	// Every word has to match
+	assert.True(t, matches("artist gold art"))
+	assert.False(t, matches("artist silver"))
+	assert.False(t, matches("digital"))
+}
+
+func TestInlineRewardResult(t *testing.T) {
+	campaign, reward := inlineTestReward(3)
+	result, ok := inlineRewardResult(campaign, reward).(*models.InlineQueryResultArticle)
+	if !assert.True(t, ok) {
+		return
+	}
+	assert.Equal(t, "1234", result.ID)
+	assert.Equal(t, "Gold Tier", result.Title)
+	assert.Contains(t, result.Description, "Some Artist")
+	assert.Contains(t, result.Description, "3 left")
+
+	campaign, reward = inlineTestReward(0)
+	result = inlineRewardResult(campaign, reward).(*models.InlineQueryResultArticle)
+	assert.Contains(t, result.Description, "sold out")
+}
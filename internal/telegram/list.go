@@ -0,0 +1,238 @@
+package telegram
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/fanonwue/goutils/dsext"
+	"github.com/fanonwue/goutils/logging"
+	"github.com/fanonwue/patreon-gobot/internal/db"
+	"github.com/fanonwue/patreon-gobot/internal/patreon"
+	"github.com/fanonwue/patreon-gobot/internal/tmpl"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+const (
+	listFilterAvailable = "available"
+	listFilterMissing   = "missing"
+	listFilterCampaign  = "campaign:"
+	listFilterTag       = "tag:"
+	listSortPrefix      = "sort:"
+	listUsage           = "Usage: /list [available] [missing] [campaign:<campaign ID>] [tag:<tag> ...] [sort:<price|price_desc|name|recent|remaining>]\n" +
+		"Multiple tags list the rewards carrying any of them"
+)
+
+type listOptions struct {
+	available  bool
+	missing    bool
+	campaignId patreon.CampaignId
+	tags       []string
+	sort       tmpl.ListSort
+	filters    []string
+}
+
+func parseListOptions(args []string) (*listOptions, error) {
+	opts := &listOptions{sort: tmpl.DefaultListSort}
+	for _, arg := range args {
+		lowerArg := strings.ToLower(arg)
+		switch {
+		case lowerArg == listFilterAvailable:
+			opts.available = true
+		case lowerArg == listFilterMissing:
+			opts.missing = true
+		case strings.HasPrefix(lowerArg, listFilterCampaign):
+			campaignId, err := strconv.Atoi(strings.TrimPrefix(lowerArg, listFilterCampaign))
+			if err != nil {
+				return nil, fmt.Errorf("invalid campaign ID: %s", arg)
+			}
+			opts.campaignId = patreon.CampaignId(campaignId)
+		case strings.HasPrefix(lowerArg, listFilterTag):
+			tag := db.NormalizeTag(strings.TrimPrefix(lowerArg, listFilterTag))
+			if tag == "" {
+				return nil, fmt.Errorf("invalid tag: %s", arg)
+			}
+			opts.tags = append(opts.tags, tag)
+		case strings.HasPrefix(lowerArg, listSortPrefix):
+			opts.sort = tmpl.ListSort(strings.TrimPrefix(lowerArg, listSortPrefix))
+			if !opts.sort.IsValid() {
+				return nil, fmt.Errorf("invalid sort order: %s", arg)
+			}
+			continue
+		default:
+			return nil, fmt.Errorf("unknown argument: %s", arg)
+		}
+		opts.filters = append(opts.filters, lowerArg)
+	}
+	return opts, nil
+}
+
+// matchesTracked checks whether the tracked reward passes the filters that don't need any data from Patreon.
+// Like all commands accepting tags, the reward has to carry any of the given tags.
+func (opts *listOptions) matchesTracked(tr *db.TrackedReward) bool {
+	return len(opts.tags) == 0 || slices.ContainsFunc(opts.tags, tr.HasTag)
+}
+
+// matches checks whether the reward passes the filters depending on its Patreon data. The missing filter
+// is applied separately.
+func (opts *listOptions) matches(r *patreon.Reward, campaignId patreon.CampaignId) bool {
+	if opts.available && !r.IsAvailable() {
+		return false
+	}
+	if opts.campaignId > 0 && opts.campaignId != campaignId {
+		return false
+	}
+	return true
+}
+
+// matchesMissing checks whether a reward that could not be fetched passes the filters. Neither its availability
+// nor its campaign are known, so it never passes the available and campaign filters.
+func (opts *listOptions) matchesMissing() bool {
+	return !opts.available && opts.campaignId == 0
+}
+
+func listRewardsCommand() *CommandHandler {
+	return &CommandHandler{
+		Pattern:     "/list",
+		Description: "Shows a list of currently tracked rewards, optionally filtered and sorted",
+		HandlerType: bot.HandlerTypeMessageText,
+		MatchType:   bot.MatchTypePrefix,
+		HandlerFunc: listRewardsHandler,
+		ChatAction:  models.ChatActionTyping,
+	}
+}
+
+func listRewardsHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	chatId := update.Message.Chat.ID
+
+	opts, err := parseListOptions(commandArgs(update.Message.Text))
+	if err != nil {
+		sendMessage(ctx, &bot.SendMessageParams{
+			ChatID:          chatId,
+			ReplyParameters: &models.ReplyParameters{MessageID: update.Message.ID},
+			Text:            fmt.Sprintf("%s\n%s", err, listUsage),
+		})
+		return
+	}
+
+	user, _ := userFromChatId(chatId, nil)
+	db.Db().Preload("Rewards").Preload("CampaignBudgets").Find(user)
+
+	listCampaigns, missingRewards := collectListCampaigns(ctx, user, opts)
+	disableLinkPreview := true
+	buf := new(bytes.Buffer)
+
+	if !opts.missing {
+		err = listRewardsTemplate.Execute(buf, &tmpl.ListTemplateData{
+			Campaigns: listCampaigns,
+			Filters:   opts.filters,
+		})
+		if err != nil {
+			logging.Errorf("Error executing template: %v", err)
+		}
+
+		sendMessage(ctx, &bot.SendMessageParams{
+			ChatID:             chatId,
+			LinkPreviewOptions: &models.LinkPreviewOptions{IsDisabled: &disableLinkPreview},
+			ParseMode:          models.ParseModeHTML,
+			Text:               buf.String(),
+		})
+	}
+
+	if len(missingRewards) == 0 {
+		if opts.missing {
+			sendMessage(ctx, &bot.SendMessageParams{
+				ChatID: chatId,
+				Text:   "No missing rewards found",
+			})
+		}
+		return
+	}
+
+	buf.Reset()
+	err = missingRewardsTemplate.Execute(buf, &tmpl.MissingRewardsData{Rewards: missingRewards})
+	if err != nil {
+		logging.Errorf("Error executing template: %v", err)
+	}
+
+	sendMessage(ctx, &bot.SendMessageParams{
+		ChatID:             chatId,
+		LinkPreviewOptions: &models.LinkPreviewOptions{IsDisabled: &disableLinkPreview},
+		ParseMode:          models.ParseModeHTML,
+		Text:               buf.String(),
+	})
+}
+
+// collectListCampaigns fetches the tracked rewards of the user and groups the ones matching the options by campaign.
+// Rewards that could not be fetched are returned separately. The user needs to have its Rewards and
+// CampaignBudgets preloaded.
+func collectListCampaigns(ctx context.Context, user *db.User, opts *listOptions) ([]*tmpl.ListCampaign, []*patreon.RewardResult) {
+	campaigns := map[patreon.CampaignId]*tmpl.ListCampaign{}
+	trackedRewards := map[patreon.RewardId]*db.TrackedReward{}
+	for i := range user.Rewards {
+		trackedRewards[patreon.RewardId(user.Rewards[i].RewardId)] = &user.Rewards[i]
+	}
+
+	rewardResults := patreonClient().FetchRewardsSlice(dsext.Map(user.Rewards, func(r db.TrackedReward) patreon.RewardId {
+		return patreon.RewardId(r.RewardId)
+	}), false, ctx)
+
+	var missingRewards []*patreon.RewardResult
+
+	for result := range rewardResults {
+		tr := trackedRewards[result.Id]
+		if tr == nil || !opts.matchesTracked(tr) {
+			continue
+		}
+
+		if !result.IsPresent() {
+			if opts.matchesMissing() {
+				missingRewards = append(missingRewards, &result)
+			}
+			continue
+		}
+
+		r := result.Reward
+
+		campaignId, err := r.CampaignId()
+		if err != nil {
+			if opts.matchesMissing() {
+				result.Status = patreon.RewardErrorNoCampaign
+				missingRewards = append(missingRewards, &result)
+			}
+			continue
+		}
+
+		if !opts.matches(r, campaignId) {
+			continue
+		}
+
+		listCampaign, found := campaigns[campaignId]
+		if !found {
+			campaign, err := patreonClient().FetchCampaign(campaignId, false, ctx)
+			if err != nil {
+				result.Status = patreon.RewardErrorNoCampaign
+				missingRewards = append(missingRewards, &result)
+				continue
+			}
+			listCampaign = &tmpl.ListCampaign{Campaign: campaign, Rewards: []*tmpl.ListReward{}}
+			campaigns[campaignId] = listCampaign
+		}
+
+		listCampaign.AddReward(&tmpl.ListReward{
+			Reward:         r,
+			AboveBudget:    user.IsAboveBudget(int64(campaignId), r.Attributes.AmountCents, r.Attributes.Currency),
+			AvailableSince: tr.AvailableSince,
+			Note:           tr.Note,
+			Tags:           tr.TagList(),
+			Priority:       string(tr.Priority),
+		})
+	}
+
+	return tmpl.SortListCampaigns(slices.Collect(maps.Values(campaigns)), opts.sort), missingRewards
+}
@@ -0,0 +1,57 @@
+package telegram
+
+import (
+	"testing"
+
+	"github.com/fanonwue/patreon-gobot/internal/db"
+	"github.com/fanonwue/patreon-gobot/internal/patreon"
+	"github.com/fanonwue/patreon-gobot/internal/tmpl"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseListOptions(t *testing.T) {
+	opts, err := parseListOptions(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, &listOptions{sort: tmpl.DefaultListSort}, opts)
+
+	opts, err = parseListOptions([]string{"Available", "missing", "campaign:42", "tag:Art", "tag:comics", "sort:name"})
+	assert.NoError(t, err)
+	assert.Equal(t, &listOptions{
+		available:  true,
+		missing:    true,
+		campaignId: 42,
+		tags:       []string{"art", "comics"},
+		sort:       tmpl.ListSortName,
+		filters:    []string{"available", "missing", "campaign:42", "tag:art", "tag:comics"},
+	}, opts)
+
+	for _, args := range [][]string{{"campaign:abc"}, {"tag:"}, {"sort:cheapest"}, {"everything"}} {
+		_, err = parseListOptions(args)
+		assert.Error(t, err, args)
+	}
+}
+
+func TestListOptions_Matches(t *testing.T) {
+	tr := &db.TrackedReward{Tags: "art,comics"}
+	available := &patreon.Reward{Attributes: patreon.RewardAttributes{Remaining: 1}}
+
+	opts, _ := parseListOptions([]string{"tag:art", "tag:comics"})
+	assert.True(t, opts.matchesTracked(tr))
+	// Multiple tags match rewards carrying any of them, like for /priority
+	opts, _ = parseListOptions([]string{"tag:art", "tag:music"})
+	assert.True(t, opts.matchesTracked(tr))
+	opts, _ = parseListOptions([]string{"tag:music", "tag:games"})
+	assert.False(t, opts.matchesTracked(tr))
+	assert.False(t, opts.matchesTracked(&db.TrackedReward{}))
+
+	opts, _ = parseListOptions([]string{"campaign:42"})
+	assert.True(t, opts.matches(available, 42))
+	assert.False(t, opts.matches(available, 43))
+	assert.False(t, opts.matchesMissing())
+
+	opts, _ = parseListOptions([]string{"available"})
+	assert.False(t, opts.matchesMissing())
+
+	opts, _ = parseListOptions([]string{"missing", "tag:art"})
+	assert.True(t, opts.matchesMissing())
+}
@@ -0,0 +1,173 @@
+package telegram
+
+import (
+	"regexp"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxMessageLength is the maximum length of a message accepted by Telegram, measured in UTF-16 code units
+const maxMessageLength = 4096
+
+// htmlReserve is subtracted from the maximum length when packing HTML chunks, leaving room for tags
+// that need to be closed at the end of a chunk and reopened at the beginning of the next one
+const htmlReserve = 256
+
+// sectionSeparator separates sections (e.g. campaigns) of a message. It's the preferred breakpoint when
+// a message has to be split.
+const sectionSeparator = "-----------------------------------------"
+
+// messageBreakpoints are tried in order when splitting a message that exceeds maxMessageLength
+var messageBreakpoints = []string{sectionSeparator + "\n", "\n\n", "\n", " "}
+
+var htmlTagRegex = regexp.MustCompile(`<(/?)([a-zA-Z][a-zA-Z0-9-]*)[^>]*>`)
+
+// splitMessage splits the text into chunks that each fit into a single Telegram message. Section boundaries
+// are preferred over blank lines, lines and words. If isHtml is set, tags that are open at the end of a
+// chunk get closed and are reopened in the next chunk.
+func splitMessage(text string, limit int, isHtml bool) []string {
+	if messageLength(text) <= limit {
+		return []string{text}
+	}
+
+	packLimit := limit
+	if isHtml {
+		packLimit = max(limit-htmlReserve, limit/2)
+	}
+
+	var chunks []string
+	current := ""
+	for _, piece := range splitPieces(text, packLimit, 0, isHtml) {
+		if current != "" && messageLength(current)+messageLength(piece) > packLimit {
+			chunks = appendChunk(chunks, current)
+			current = ""
+		}
+		current += piece
+	}
+	chunks = appendChunk(chunks, current)
+
+	if isHtml {
+		chunks = balanceHtmlChunks(chunks)
+	}
+	return chunks
+}
+
+func appendChunk(chunks []string, chunk string) []string {
+	chunk = strings.TrimSpace(chunk)
+	chunk = strings.TrimSpace(strings.TrimPrefix(chunk, sectionSeparator))
+	chunk = strings.TrimSpace(strings.TrimSuffix(chunk, sectionSeparator))
+	if chunk == "" {
+		return chunks
+	}
+	return append(chunks, chunk)
+}
+
+func splitPieces(text string, limit, level int, isHtml bool) []string {
+	if messageLength(text) <= limit {
+		return []string{text}
+	}
+
+	if level >= len(messageBreakpoints) {
+		return hardSplit(text, limit, isHtml)
+	}
+
+	var pieces []string
+	for _, part := range strings.SplitAfter(text, messageBreakpoints[level]) {
+		if part == "" {
+			continue
+		}
+		pieces = append(pieces, splitPieces(part, limit, level+1, isHtml)...)
+	}
+	return pieces
+}
+
+// hardSplit cuts the text into pieces of at most limit length, making sure not to cut
+// through an HTML tag or entity
+func hardSplit(text string, limit int, isHtml bool) []string {
+	var pieces []string
+	for messageLength(text) > limit {
+		cut := 0
+		length := 0
+		for i, r := range text {
+			length += runeLength(r)
+			if length > limit {
+				break
+			}
+			cut = i + utf8.RuneLen(r)
+		}
+
+		if isHtml {
+			if tagStart := strings.LastIndexByte(text[:cut], '<'); tagStart > strings.LastIndexByte(text[:cut], '>') {
+				cut = tagStart
+			}
+			if entityStart := strings.LastIndexByte(text[:cut], '&'); entityStart > strings.LastIndexByte(text[:cut], ';') {
+				cut = entityStart
+			}
+		}
+
+		if cut == 0 {
+			// Should only ever happen for a single tag longer than the limit, which can't be sent anyway
+			break
+		}
+
+		pieces = append(pieces, text[:cut])
+		text = text[cut:]
+	}
+	return append(pieces, text)
+}
+
+// balanceHtmlChunks closes all tags left open at the end of a chunk and reopens them at the start of the next one
+func balanceHtmlChunks(chunks []string) []string {
+	var openTags []string
+	balanced := make([]string, 0, len(chunks))
+	for _, chunk := range chunks {
+		prefix := strings.Join(openTags, "")
+
+		for _, match := range htmlTagRegex.FindAllStringSubmatch(chunk, -1) {
+			if match[1] == "" {
+				openTags = append(openTags, match[0])
+				continue
+			}
+			// Remove the most recently opened tag with a matching name
+			for i := len(openTags) - 1; i >= 0; i-- {
+				if tagName(openTags[i]) == strings.ToLower(match[2]) {
+					openTags = slices.Delete(openTags, i, i+1)
+					break
+				}
+			}
+		}
+
+		suffix := ""
+		for i := len(openTags) - 1; i >= 0; i-- {
+			suffix += "</" + tagName(openTags[i]) + ">"
+		}
+
+		balanced = append(balanced, prefix+chunk+suffix)
+	}
+	return balanced
+}
+
+func tagName(tag string) string {
+	match := htmlTagRegex.FindStringSubmatch(tag)
+	if match == nil {
+		return ""
+	}
+	return strings.ToLower(match[2])
+}
+
+func messageLength(s string) int {
+	length := 0
+	for _, r := range s {
+		length += runeLength(r)
+	}
+	return length
+}
+
+// runeLength returns the length of the rune in UTF-16 code units, as that's how Telegram measures messages
+func runeLength(r rune) int {
+	if r >= 0x10000 {
+		return 2
+	}
+	return 1
+}
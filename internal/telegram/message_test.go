@@ -0,0 +1,60 @@
+package telegram
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitMessage_Short(t *testing.T) {
+	text := "<b>Short</b> message"
+	assert.Equal(t, []string{text}, splitMessage(text, maxMessageLength, true))
+}
+
+func TestSplitMessage_SectionBoundaries(t *testing.T) {
+	sections := make([]string, 0)
+	for i := 0; i < 50; i++ {
+		section := fmt.Sprintf("<a href=\"https://example.com/%d\"><b>Campaign %d</b></a>\n", i, i)
+		for j := 0; j < 5; j++ {
+			section += fmt.Sprintf("\n<b>Tier %d</b> for 10.00 $\n(ID <code>%d</code>)\n", j, i*100+j)
+		}
+		sections = append(sections, section)
+	}
+	text := strings.Join(sections, sectionSeparator+"\n")
+
+	chunks := splitMessage(text, maxMessageLength, true)
+	assert.Greater(t, len(chunks), 1)
+
+	for _, chunk := range chunks {
+		assert.LessOrEqual(t, messageLength(chunk), maxMessageLength)
+		assert.True(t, strings.HasPrefix(chunk, "<a href="), "chunk should start with a campaign")
+		assert.False(t, strings.HasSuffix(chunk, sectionSeparator))
+		assert.Equal(t, strings.Count(chunk, "<b>"), strings.Count(chunk, "</b>"))
+	}
+}
+
+func TestSplitMessage_BalancesTags(t *testing.T) {
+	text := "<b>" + strings.Repeat("word ", 2000) + "</b>"
+
+	chunks := splitMessage(text, maxMessageLength, true)
+	assert.Greater(t, len(chunks), 1)
+
+	for _, chunk := range chunks {
+		assert.LessOrEqual(t, messageLength(chunk), maxMessageLength)
+		assert.True(t, strings.HasPrefix(chunk, "<b>"))
+		assert.True(t, strings.HasSuffix(chunk, "</b>"))
+	}
+}
+
+func TestSplitMessage_HardSplitKeepsEntities(t *testing.T) {
+	text := strings.Repeat("a&amp;", 1000)
+
+	chunks := splitMessage(text, 100, true)
+	for _, chunk := range chunks {
+		assert.LessOrEqual(t, messageLength(chunk), 100)
+		assert.Equal(t, strings.Count(chunk, "&"), strings.Count(chunk, ";"))
+	}
+	assert.Equal(t, text, strings.Join(chunks, ""))
+}
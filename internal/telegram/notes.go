@@ -0,0 +1,193 @@
+package telegram
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/fanonwue/goutils/logging"
+	"github.com/fanonwue/patreon-gobot/internal/db"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+const (
+	maxNoteLength = 500
+	noteUsage     = "Usage: /note <reward ID> <text>. Omit the text to remove the note."
+	tagUsage      = "Usage: /tag <reward ID> <tag> [tag...]"
+	untagUsage    = "Usage: /untag <reward ID> <tag> [tag...]"
+)
+
+// parseRewardArgs splits the arguments of a command into the reward ID (or checkout link) and the remaining text
+func parseRewardArgs(message string) (int, string, bool) {
+	fields := strings.Fields(message)
+	if len(fields) < 2 {
+		return 0, "", false
+	}
+	ids := parseIdList(fields[1])
+	if len(ids) != 1 {
+		return 0, "", false
+	}
+
+	rest := strings.TrimSpace(message)
+	for _, field := range fields[:2] {
+		rest = strings.TrimSpace(strings.TrimPrefix(rest, field))
+	}
+	return ids[0], rest, true
+}
+
+// parseTagFilters returns the tags of all tag:<tag> arguments
+func parseTagFilters(args []string) []string {
+	var tags []string
+	for _, arg := range args {
+		if len(arg) > len(listFilterTag) && strings.EqualFold(arg[:len(listFilterTag)], listFilterTag) {
+			if tag := db.NormalizeTag(arg[len(listFilterTag):]); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return tags
+}
+
+// rewardIdsWithTags returns the IDs of the rewards of the user that carry any of the tags
+func rewardIdsWithTags(user *db.User, tags []string) []int {
+	var trackedRewards []db.TrackedReward
+	db.Db().Find(&trackedRewards, "user_id = ? AND tags <> ''", user.ID)
+
+	var ids []int
+	for _, tr := range trackedRewards {
+		if slices.ContainsFunc(tags, tr.HasTag) {
+			ids = append(ids, int(tr.RewardId))
+		}
+	}
+	return ids
+}
+
+// trackedRewardForCommand loads the tracked reward of the chat, replying with an error if it isn't tracked
+func trackedRewardForCommand(ctx context.Context, update *models.Update, rewardId int) (*db.TrackedReward, *db.User) {
+	user, _ := userFromChatId(update.Message.Chat.ID, nil)
+	tr := &db.TrackedReward{}
+	db.Db().Limit(1).Find(tr, "user_id = ? AND reward_id = ?", user.ID, rewardId)
+	if tr.ID == 0 {
+		replyText(ctx, update, fmt.Sprintf("You are not tracking reward %d", rewardId))
+		return nil, user
+	}
+	return tr, user
+}
+
+func noteCommand() *CommandHandler {
+	return &CommandHandler{
+		Pattern:        "/note",
+		Description:    "Attaches a note to a tracked reward",
+		HandlerType:    bot.HandlerTypeMessageText,
+		MatchType:      bot.MatchTypePrefix,
+		HandlerFunc:    noteHandler,
+		ChatAction:     models.ChatActionTyping,
+		GroupAdminOnly: true,
+	}
+}
+
+func noteHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	rewardId, note, ok := parseRewardArgs(update.Message.Text)
+	if !ok {
+		replyText(ctx, update, noteUsage)
+		return
+	}
+	if utf8.RuneCountInString(note) > maxNoteLength {
+		replyText(ctx, update, fmt.Sprintf("Notes can't be longer than %d characters", maxNoteLength))
+		return
+	}
+
+	tr, user := trackedRewardForCommand(ctx, update, rewardId)
+	if tr == nil {
+		return
+	}
+
+	if err := db.Db().Model(tr).Update("note", note).Error; err != nil {
+		logging.Errorf("Error saving note of reward %d for user %d: %v", rewardId, user.ID, err)
+		replyText(ctx, update, "Error saving the note")
+		return
+	}
+
+	text := fmt.Sprintf("Note of reward %d saved", rewardId)
+	if note == "" {
+		text = fmt.Sprintf("Note of reward %d removed", rewardId)
+	}
+	replyText(ctx, update, text)
+	logging.Infof("Updated note of reward %d for user %d (Chat ID: %d)", rewardId, user.ID, user.TelegramChatId)
+}
+
+func tagCommand() *CommandHandler {
+	return &CommandHandler{
+		Pattern:     "/tag",
+		Description: "Adds tags to a tracked reward, which can be used to filter /list and /priority",
+		HandlerType: bot.HandlerTypeMessageText,
+		MatchType:   bot.MatchTypePrefix,
+		HandlerFunc: func(ctx context.Context, b *bot.Bot, update *models.Update) {
+			updateRewardTags(ctx, update, true)
+		},
+		ChatAction:     models.ChatActionTyping,
+		GroupAdminOnly: true,
+	}
+}
+
+func untagCommand() *CommandHandler {
+	return &CommandHandler{
+		Pattern:     "/untag",
+		Description: "Removes tags from a tracked reward",
+		HandlerType: bot.HandlerTypeMessageText,
+		MatchType:   bot.MatchTypePrefix,
+		HandlerFunc: func(ctx context.Context, b *bot.Bot, update *models.Update) {
+			updateRewardTags(ctx, update, false)
+		},
+		ChatAction:     models.ChatActionTyping,
+		GroupAdminOnly: true,
+	}
+}
+
+func updateRewardTags(ctx context.Context, update *models.Update, add bool) {
+	usage := tagUsage
+	if !add {
+		usage = untagUsage
+	}
+
+	rewardId, rest, ok := parseRewardArgs(update.Message.Text)
+	var tags []string
+	for _, tag := range strings.Fields(rest) {
+		if tag = db.NormalizeTag(strings.TrimPrefix(tag, "#")); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	if !ok || len(tags) == 0 {
+		replyText(ctx, update, usage)
+		return
+	}
+
+	tr, user := trackedRewardForCommand(ctx, update, rewardId)
+	if tr == nil {
+		return
+	}
+
+	if add {
+		tr.SetTags(append(tr.TagList(), tags...))
+	} else {
+		tr.SetTags(slices.DeleteFunc(tr.TagList(), func(tag string) bool {
+			return slices.Contains(tags, tag)
+		}))
+	}
+
+	if err := db.Db().Model(tr).Update("tags", tr.Tags).Error; err != nil {
+		logging.Errorf("Error saving tags of reward %d for user %d: %v", rewardId, user.ID, err)
+		replyText(ctx, update, "Error saving the tags")
+		return
+	}
+
+	text := fmt.Sprintf("Reward %d has no tags", rewardId)
+	if tr.Tags != "" {
+		text = fmt.Sprintf("Tags of reward %d: %s", rewardId, strings.Join(tr.TagList(), ", "))
+	}
+	replyText(ctx, update, text)
+	logging.Infof("Updated tags of reward %d for user %d (Chat ID: %d)", rewardId, user.ID, user.TelegramChatId)
+}
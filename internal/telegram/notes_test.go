@@ -0,0 +1,44 @@
+package telegram
+
+import (
+	"testing"
+
+	"github.com/fanonwue/patreon-gobot/internal/db"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRewardArgs(t *testing.T) {
+	id, rest, ok := parseRewardArgs("/note 123  Wait for the  next month ")
+	assert.True(t, ok)
+	assert.Equal(t, 123, id)
+	assert.Equal(t, "Wait for the  next month", rest)
+
+	id, rest, ok = parseRewardArgs("/note https://www.patreon.com/checkout/creator?rid=456")
+	assert.True(t, ok)
+	assert.Equal(t, 456, id)
+	assert.Empty(t, rest)
+
+	_, _, ok = parseRewardArgs("/note")
+	assert.False(t, ok)
+	_, _, ok = parseRewardArgs("/note foo bar")
+	assert.False(t, ok)
+}
+
+func TestParseTagFilters(t *testing.T) {
+	assert.Equal(t, []string{"art", "comics"}, parseTagFilters([]string{"1", "tag:Art", "TAG:comics", "tag:"}))
+}
+
+func TestListOptions_Tags(t *testing.T) {
+	opts, err := parseListOptions([]string{"tag:Art"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"art"}, opts.tags)
+
+	tr := &db.TrackedReward{}
+	assert.False(t, opts.matchesTracked(tr))
+	tr.SetTags([]string{"comics", " ART ", "art", ""})
+	assert.Equal(t, "comics,art", tr.Tags)
+	assert.True(t, opts.matchesTracked(tr))
+
+	_, err = parseListOptions([]string{"tag:"})
+	assert.Error(t, err)
+}
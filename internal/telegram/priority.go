@@ -0,0 +1,142 @@
+package telegram
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/fanonwue/goutils/logging"
+	"github.com/fanonwue/patreon-gobot/internal/db"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+const (
+	callbackAcknowledgePrefix = "ack:"
+	priorityUsage             = "Usage: /priority <reward ID|tag:<tag>> [...] <low|normal|high>\n" +
+		"Multiple tags apply to the rewards carrying any of them"
+)
+
+func acknowledgeKeyboard(tr *db.TrackedReward) *models.InlineKeyboardMarkup {
+	return &models.InlineKeyboardMarkup{
+		InlineKeyboard: [][]models.InlineKeyboardButton{{
+			{Text: "Got it", CallbackData: callbackAcknowledgePrefix + strconv.FormatUint(uint64(tr.ID), 10)},
+		}},
+	}
+}
+
+// parsePriorityArgs splits the arguments of /priority into the reward IDs, the tags and the priority,
+// which is expected last
+func parsePriorityArgs(message string) ([]int, []string, db.Priority, bool) {
+	args := commandArgs(message)
+	if len(args) < 2 {
+		return nil, nil, "", false
+	}
+	priority := db.Priority(strings.ToLower(args[len(args)-1]))
+	if !priority.IsValid() {
+		return nil, nil, "", false
+	}
+	targets := args[:len(args)-1]
+	return parseIdList(strings.Join(targets, " ")), parseTagFilters(targets), priority, true
+}
+
+func priorityCommand() *CommandHandler {
+	return &CommandHandler{
+		Pattern:        "/priority",
+		Description:    "Sets the priority of rewards. High priority re-alerts until acknowledged, low priority only appears in digests.",
+		HandlerType:    bot.HandlerTypeMessageText,
+		MatchType:      bot.MatchTypePrefix,
+		HandlerFunc:    priorityHandler,
+		ChatAction:     models.ChatActionTyping,
+		GroupAdminOnly: true,
+	}
+}
+
+func priorityHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	ids, tags, priority, ok := parsePriorityArgs(update.Message.Text)
+	if !ok {
+		replyText(ctx, update, priorityUsage)
+		return
+	}
+
+	user, _ := userFromChatId(update.Message.Chat.ID, nil)
+	if len(tags) > 0 {
+		ids = append(ids, rewardIdsWithTags(user, tags)...)
+	}
+	if len(ids) == 0 {
+		replyText(ctx, update, "No valid reward IDs or matching tags provided")
+		return
+	}
+
+	result := db.Db().Model(&db.TrackedReward{}).
+		Where("user_id = ? AND reward_id IN ?", user.ID, slices.Compact(slices.Sorted(slices.Values(ids)))).
+		// Reset the schedule, so the new priority applies right away
+		Updates(map[string]any{"priority": priority, "realerts": 0, "acknowledged": false, "next_check": nil})
+	if result.Error != nil {
+		logging.Errorf("Error updating priority for user %d: %v", user.ID, result.Error)
+		replyText(ctx, update, "Error updating the priority")
+		return
+	}
+
+	replyText(ctx, update, fmt.Sprintf("Set the priority of %d rewards to %s", result.RowsAffected, priority))
+	logging.Infof("Set priority of %d rewards to %s for user %d (Chat ID: %d)", result.RowsAffected, priority, user.ID, user.TelegramChatId)
+}
+
+// mayAcknowledge checks whether the sender of the callback may acknowledge notifications of the user sent to the
+// chat. The user needs access to the bot. In private chats, only the user may acknowledge, in groups and channels
+// only their administrators.
+func mayAcknowledge(ctx context.Context, b *bot.Bot, user *db.User, chatId int64, senderId int64) bool {
+	if !user.HasAccess() {
+		return false
+	}
+	if chatId != user.NotificationChatId() && chatId != user.TelegramChatId {
+		return false
+	}
+	if senderId == user.TelegramChatId {
+		return true
+	}
+	return chatId != senderId && isChatAdmin(ctx, b, chatId, senderId)
+}
+
+// acknowledgeCallbackHandler handles the button attached to high priority notifications, stopping any re-alerts
+// for the reward until it becomes available again
+func acknowledgeCallbackHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	query := update.CallbackQuery
+	message := query.Message.Message
+	trackedRewardId, err := strconv.ParseUint(strings.TrimPrefix(query.Data, callbackAcknowledgePrefix), 10, 64)
+	if message == nil || err != nil {
+		_, _ = b.AnswerCallbackQuery(ctx, &bot.AnswerCallbackQueryParams{CallbackQueryID: query.ID})
+		return
+	}
+
+	tr := &db.TrackedReward{}
+	db.Db().Limit(1).Find(tr, trackedRewardId)
+	user := &db.User{}
+	if tr.ID > 0 {
+		db.Db().Limit(1).Find(user, tr.UserID)
+	}
+
+	var text string
+	switch {
+	case user.ID == 0:
+		text = "This reward is not tracked anymore"
+	case !mayAcknowledge(ctx, b, user, message.Chat.ID, query.From.ID):
+		_, _ = b.AnswerCallbackQuery(ctx, &bot.AnswerCallbackQueryParams{CallbackQueryID: query.ID})
+		return
+	default:
+		text = "Acknowledged, you won't be reminded about this reward again"
+		if err = db.Db().Model(tr).Update("acknowledged", true).Error; err != nil {
+			logging.Errorf("Error acknowledging reward %d for user %d: %v", tr.RewardId, user.ID, err)
+			_, _ = b.AnswerCallbackQuery(ctx, &bot.AnswerCallbackQueryParams{CallbackQueryID: query.ID, Text: "Error acknowledging the notification"})
+			return
+		}
+	}
+
+	_, _ = b.AnswerCallbackQuery(ctx, &bot.AnswerCallbackQueryParams{CallbackQueryID: query.ID, Text: text})
+	_, _ = b.EditMessageReplyMarkup(ctx, &bot.EditMessageReplyMarkupParams{
+		ChatID:    message.Chat.ID,
+		MessageID: message.ID,
+	})
+}
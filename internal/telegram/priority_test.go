@@ -0,0 +1,49 @@
+package telegram
+
+import (
+	"context"
+	"testing"
+
+	"github.com/fanonwue/patreon-gobot/internal/db"
+	"github.com/fanonwue/patreon-gobot/internal/patreon"
+	"github.com/fanonwue/patreon-gobot/internal/tmpl"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePriorityArgs(t *testing.T) {
+	ids, tags, priority, ok := parsePriorityArgs("/priority 1, 2 tag:Art HIGH")
+	assert.True(t, ok)
+	assert.Equal(t, []int{1, 2}, ids)
+	assert.Equal(t, []string{"art"}, tags)
+	assert.Equal(t, db.PriorityHigh, priority)
+
+	_, _, _, ok = parsePriorityArgs("/priority 1 urgent")
+	assert.False(t, ok)
+	_, _, _, ok = parsePriorityArgs("/priority low")
+	assert.False(t, ok)
+}
+
+func TestMayAcknowledge(t *testing.T) {
+	channel := int64(-1001)
+	user := &db.User{TelegramChatId: 4001, Role: db.RoleUser, NotificationChat: &channel}
+	assert.True(t, mayAcknowledge(context.Background(), nil, user, 4001, 4001))
+	assert.True(t, mayAcknowledge(context.Background(), nil, user, channel, 4001))
+	// Other chats and users without access can't acknowledge
+	assert.False(t, mayAcknowledge(context.Background(), nil, user, 4002, 4002))
+	user.Role = db.RoleBanned
+	assert.False(t, mayAcknowledge(context.Background(), nil, user, 4001, 4001))
+}
+
+func TestNotifyDigest_IncludesTags(t *testing.T) {
+	user := &db.User{TelegramChatId: 4003}
+	reward := &patreon.Reward{Id: 1, Attributes: patreon.RewardAttributes{Title: "Tier", Remaining: 1}}
+	NotifyDigest(user, []*tmpl.RewardAvailableData{
+		{Reward: reward, Campaign: &patreon.Campaign{}, Note: "note", Tags: []string{"art", "comics"}},
+	})
+	t.Cleanup(func() { db.Db().Unscoped().Delete(&db.PendingMessage{}, "chat_id = ?", user.TelegramChatId) })
+
+	message := &db.PendingMessage{}
+	assert.NoError(t, db.Db().First(message, "chat_id = ?", user.TelegramChatId).Error)
+	assert.Contains(t, message.Text, "<i>note</i>")
+	assert.Contains(t, message.Text, "#art, #comics")
+}
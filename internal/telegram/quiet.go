@@ -0,0 +1,98 @@
+package telegram
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fanonwue/goutils/logging"
+	"github.com/fanonwue/patreon-gobot/internal/db"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+const (
+	quietOff   = "off"
+	quietUsage = "Usage: /quiet <from hour> <until hour> [time zone], e.g. /quiet 23 7 Europe/Berlin, or /quiet off"
+)
+
+func quietCommand() *CommandHandler {
+	return &CommandHandler{
+		Pattern:        "/quiet",
+		Description:    "Shows or sets quiet hours, during which notifications are sent silently. High priority rewards bypass them.",
+		HandlerType:    bot.HandlerTypeMessageText,
+		MatchType:      bot.MatchTypePrefix,
+		HandlerFunc:    quietHandler,
+		ChatAction:     models.ChatActionTyping,
+		GroupAdminOnly: true,
+	}
+}
+
+// parseQuietArgs parses the hours and the optional time zone of /quiet
+func parseQuietArgs(args []string) (int, int, string, error) {
+	if len(args) < 2 || len(args) > 3 {
+		return 0, 0, "", fmt.Errorf("invalid number of arguments")
+	}
+	var hours [2]int
+	for i := range hours {
+		hour, err := strconv.Atoi(strings.TrimSuffix(args[i], ":00"))
+		if err != nil || hour < 0 || hour > 23 {
+			return 0, 0, "", fmt.Errorf("invalid hour %s", args[i])
+		}
+		hours[i] = hour
+	}
+	if hours[0] == hours[1] {
+		return 0, 0, "", fmt.Errorf("quiet hours have to start and end at different hours")
+	}
+
+	timeZone := ""
+	if len(args) == 3 {
+		loc, err := time.LoadLocation(args[2])
+		if err != nil {
+			return 0, 0, "", fmt.Errorf("unknown time zone %s", args[2])
+		}
+		timeZone = loc.String()
+	}
+	return hours[0], hours[1], timeZone, nil
+}
+
+func quietHoursText(user *db.User) string {
+	if user.QuietFrom == nil || user.QuietUntil == nil {
+		return "No quiet hours set"
+	}
+	return fmt.Sprintf("Quiet hours from %02d:00 until %02d:00 (%s)", *user.QuietFrom, *user.QuietUntil, user.Location())
+}
+
+func quietHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	user, _ := userFromChatId(update.Message.Chat.ID, nil)
+	args := commandArgs(update.Message.Text)
+	if len(args) == 0 {
+		replyText(ctx, update, quietHoursText(user))
+		return
+	}
+
+	if len(args) == 1 && strings.EqualFold(args[0], quietOff) {
+		user.QuietFrom, user.QuietUntil = nil, nil
+	} else {
+		from, until, timeZone, err := parseQuietArgs(args)
+		if err != nil {
+			replyText(ctx, update, fmt.Sprintf("Invalid quiet hours: %v\n%s", err, quietUsage))
+			return
+		}
+		user.QuietFrom, user.QuietUntil, user.TimeZone = &from, &until, timeZone
+	}
+
+	err := db.Db().Model(user).Updates(map[string]any{
+		"quiet_from":  user.QuietFrom,
+		"quiet_until": user.QuietUntil,
+		"time_zone":   user.TimeZone,
+	}).Error
+	if err != nil {
+		logging.Errorf("Error updating quiet hours of user %d: %v", user.ID, err)
+		replyText(ctx, update, "Error updating the quiet hours")
+		return
+	}
+	replyText(ctx, update, quietHoursText(user))
+}
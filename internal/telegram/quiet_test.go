@@ -0,0 +1,69 @@
+package telegram
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/fanonwue/patreon-gobot/internal/db"
+	"github.com/fanonwue/patreon-gobot/internal/patreon"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseQuietArgs(t *testing.T) {
+	from, until, timeZone, err := parseQuietArgs([]string{"23", "7"})
+	assert.NoError(t, err)
+	assert.Equal(t, 23, from)
+	assert.Equal(t, 7, until)
+	assert.Empty(t, timeZone)
+
+	_, _, timeZone, err = parseQuietArgs([]string{"22:00", "06:00", "Europe/Berlin"})
+	assert.NoError(t, err)
+	assert.Equal(t, "Europe/Berlin", timeZone)
+
+	for _, args := range [][]string{{"23"}, {"24", "7"}, {"7", "7"}, {"a", "7"}, {"23", "7", "Nowhere/City"}} {
+		_, _, _, err = parseQuietArgs(args)
+		assert.Error(t, err, args)
+	}
+}
+
+func TestQuietHandler(t *testing.T) {
+	fake := newFakeTelegram(t)
+	user := createTestUser(t, 4201, db.RoleUser)
+	ctx := context.Background()
+
+	quietHandler(ctx, nil, messageUpdate(user.TelegramChatId, "/quiet"))
+	assert.Equal(t, "No quiet hours set", fake.lastSentTo(user.TelegramChatId))
+
+	quietHandler(ctx, nil, messageUpdate(user.TelegramChatId, "/quiet 23 7 Europe/Berlin"))
+	assert.Equal(t, "Quiet hours from 23:00 until 07:00 (Europe/Berlin)", fake.lastSentTo(user.TelegramChatId))
+	stored, _ := userFromChatId(user.TelegramChatId, nil)
+	if assert.NotNil(t, stored.QuietFrom) {
+		assert.Equal(t, 23, *stored.QuietFrom)
+	}
+
+	quietHandler(ctx, nil, messageUpdate(user.TelegramChatId, "/quiet off"))
+	stored, _ = userFromChatId(user.TelegramChatId, nil)
+	assert.Nil(t, stored.QuietFrom)
+	assert.Nil(t, stored.QuietUntil)
+}
+
+func TestNotifyAvailable_QuietHours(t *testing.T) {
+	// Quiet all day long
+	hour := time.Now().UTC().Hour()
+	from, until := hour, (hour+1)%24
+	user := &db.User{TelegramChatId: 4202, QuietFrom: &from, QuietUntil: &until}
+	t.Cleanup(func() { db.Db().Unscoped().Delete(&db.PendingMessage{}, "chat_id = ?", user.TelegramChatId) })
+	reward := &patreon.RewardResult{Id: 1, Reward: &patreon.Reward{Id: 1, Attributes: patreon.RewardAttributes{Remaining: 1}}}
+
+	NotifyAvailable(user, reward, &db.TrackedReward{Priority: db.PriorityNormal}, &patreon.Campaign{})
+	NotifyAvailable(user, reward, &db.TrackedReward{Priority: db.PriorityHigh}, &patreon.Campaign{})
+
+	var messages []db.PendingMessage
+	assert.NoError(t, db.Db().Order("id").Find(&messages, "chat_id = ?", user.TelegramChatId).Error)
+	if assert.Len(t, messages, 2) {
+		assert.True(t, messages[0].DisableNotification)
+		// High priority rewards bypass the quiet hours
+		assert.False(t, messages[1].DisableNotification)
+	}
+}
@@ -0,0 +1,208 @@
+package telegram
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fanonwue/goutils/logging"
+	"github.com/fanonwue/patreon-gobot/internal/db"
+	"github.com/fanonwue/patreon-gobot/internal/patreon"
+	"github.com/fanonwue/patreon-gobot/internal/util"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"gorm.io/gorm"
+)
+
+// unlimited is used for quotas that are not limited
+const unlimited = -1
+
+const quotaDefault = "default"
+
+const addsWindow = time.Hour
+
+type (
+	quota struct {
+		maxTracked     int
+		maxAddsPerHour int
+	}
+
+	// quotaUsage describes how much of their quota a user has used up
+	quotaUsage struct {
+		quota
+		tracked        int
+		addsInLastHour int
+	}
+)
+
+var defaultQuota = quota{maxTracked: unlimited, maxAddsPerHour: unlimited}
+
+func quotaFromEnv() quota {
+	return quota{
+		maxTracked:     quotaLimitFromEnv("QUOTA_MAX_TRACKED"),
+		maxAddsPerHour: quotaLimitFromEnv("QUOTA_MAX_ADDS_PER_HOUR"),
+	}
+}
+
+func quotaLimitFromEnv(name string) int {
+	limit, err := strconv.Atoi(os.Getenv(util.PrefixEnvVar(name)))
+	if err != nil || limit < 0 {
+		return unlimited
+	}
+	return limit
+}
+
+// quotaForUser returns the quota of the user, taking admin overrides into account
+func quotaForUser(user *db.User) quota {
+	if user.IsAdmin() {
+		return quota{maxTracked: unlimited, maxAddsPerHour: unlimited}
+	}
+	q := defaultQuota
+	if user.MaxTrackedRewards != nil {
+		q.maxTracked = *user.MaxTrackedRewards
+	}
+	if user.MaxAddsPerHour != nil {
+		q.maxAddsPerHour = *user.MaxAddsPerHour
+	}
+	return q
+}
+
+func usageForUser(user *db.User) *quotaUsage {
+	return usageInTx(db.Db(), user)
+}
+
+// usageInTx determines the usage of the user within the transaction. Additions are counted from the recorded
+// additions instead of the tracked rewards, so removing rewards doesn't free up additions.
+func usageInTx(tx *gorm.DB, user *db.User) *quotaUsage {
+	var tracked, recentlyAdded int64
+	tx.Model(&db.TrackedReward{}).Where("user_id = ?", user.ID).Count(&tracked)
+	tx.Model(&db.RewardAddition{}).Where("user_id = ? AND created_at > ?", user.ID, time.Now().Add(-addsWindow)).
+		Count(&recentlyAdded)
+	return &quotaUsage{
+		quota:          quotaForUser(user),
+		tracked:        int(tracked),
+		addsInLastHour: int(recentlyAdded),
+	}
+}
+
+// splitByQuota splits the rewards into the ones that fit into the remaining quota and the ones that don't
+func splitByQuota(ids []patreon.RewardId, usage *quotaUsage) ([]patreon.RewardId, []patreon.RewardId) {
+	if remaining := usage.remaining(); remaining != unlimited && len(ids) > remaining {
+		return ids[:remaining], ids[remaining:]
+	}
+	return ids, nil
+}
+
+// remaining returns how many rewards can be added right now, or unlimited
+func (qu *quotaUsage) remaining() int {
+	remaining := unlimited
+	if qu.maxTracked != unlimited {
+		remaining = max(qu.maxTracked-qu.tracked, 0)
+	}
+	if qu.maxAddsPerHour != unlimited {
+		remainingAdds := max(qu.maxAddsPerHour-qu.addsInLastHour, 0)
+		if remaining == unlimited || remainingAdds < remaining {
+			remaining = remainingAdds
+		}
+	}
+	return remaining
+}
+
+func formatLimit(limit int) string {
+	if limit == unlimited {
+		return "unlimited"
+	}
+	return strconv.Itoa(limit)
+}
+
+func (qu *quotaUsage) String() string {
+	return fmt.Sprintf("%d of %s tracked rewards, %d of %s additions in the last hour",
+		qu.tracked, formatLimit(qu.maxTracked), qu.addsInLastHour, formatLimit(qu.maxAddsPerHour))
+}
+
+func quotaCommand() *CommandHandler {
+	return &CommandHandler{
+		Pattern:     "/quota",
+		Description: "Shows your current usage of the tracking quota",
+		HandlerType: bot.HandlerTypeMessageText,
+		MatchType:   bot.MatchTypePrefix,
+		HandlerFunc: quotaHandler,
+		ChatAction:  models.ChatActionTyping,
+	}
+}
+
+// quotaHandler shows the quota of the user. Admins can override the quota of other users by passing their
+// Chat ID, the quota to change (tracked or adds) and the new limit.
+func quotaHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	chatId := update.Message.Chat.ID
+	user, _ := userFromChatId(chatId, nil)
+
+	args := commandArgs(update.Message.Text)
+	if len(args) == 0 {
+		replyText(ctx, update, fmt.Sprintf("Quota: %s", usageForUser(user)))
+		return
+	}
+
+	if !user.IsAdmin() {
+		replyText(ctx, update, "Only admins can change quotas")
+		return
+	}
+
+	const usage = "Usage: /quota <Chat ID> <tracked|adds> <limit|unlimited|default>"
+	if len(args) < 3 {
+		replyText(ctx, update, usage)
+		return
+	}
+
+	targetChatId, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		replyText(ctx, update, usage)
+		return
+	}
+
+	var column string
+	switch strings.ToLower(args[1]) {
+	case "tracked":
+		column = "max_tracked_rewards"
+	case "adds":
+		column = "max_adds_per_hour"
+	default:
+		replyText(ctx, update, usage)
+		return
+	}
+
+	var limit *int
+	switch strings.ToLower(args[2]) {
+	case quotaDefault:
+		limit = nil
+	case "unlimited":
+		limit = new(int)
+		*limit = unlimited
+	default:
+		parsedLimit, err := strconv.Atoi(args[2])
+		if err != nil || parsedLimit < 0 {
+			replyText(ctx, update, usage)
+			return
+		}
+		limit = &parsedLimit
+	}
+
+	target, found := userFromChatId(targetChatId, nil)
+	if !found {
+		replyText(ctx, update, fmt.Sprintf("No user found for Chat ID %d", targetChatId))
+		return
+	}
+
+	if err = db.Db().Model(target).Update(column, limit).Error; err != nil {
+		logging.Errorf("Error updating quota of user %d: %v", target.ID, err)
+		replyText(ctx, update, "Error updating quota")
+		return
+	}
+
+	db.Db().First(target, target.ID)
+	replyText(ctx, update, fmt.Sprintf("Quota of user %d: %s", targetChatId, usageForUser(target)))
+	logging.Infof("Quota %s of user %d (Chat ID: %d) set to %s", column, target.ID, target.TelegramChatId, args[2])
+}
@@ -0,0 +1,90 @@
+package telegram
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/fanonwue/patreon-gobot/internal/db"
+	"github.com/fanonwue/patreon-gobot/internal/patreon"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrackRewards_Quota(t *testing.T) {
+	user := createTestUser(t, 3401, db.RoleUser)
+	maxTracked, maxAdds := 4, 2
+	user.MaxTrackedRewards = &maxTracked
+	user.MaxAddsPerHour = &maxAdds
+
+	// Added before the window, so it only counts as tracked
+	old := &db.TrackedReward{UserID: user.ID, RewardId: 1}
+	old.CreatedAt = time.Now().Add(-2 * addsWindow)
+	assert.NoError(t, db.Db().Create(old).Error)
+
+	saved, skipped, err := trackRewards(user, []patreon.RewardId{2, 3, 4})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"2", "3"}, saved)
+	assert.Equal(t, []patreon.RewardId{4}, skipped)
+
+	// The additions are stored, so they survive restarts
+	usage := usageForUser(user)
+	assert.Equal(t, 3, usage.tracked)
+	assert.Equal(t, 2, usage.addsInLastHour)
+	assert.Equal(t, 0, usage.remaining())
+
+	saved, skipped, err = trackRewards(user, []patreon.RewardId{4})
+	assert.NoError(t, err)
+	assert.Empty(t, saved)
+	assert.Equal(t, []patreon.RewardId{4}, skipped)
+}
+
+func TestTrackRewards_QuotaAfterRemoving(t *testing.T) {
+	fake := newFakeTelegram(t)
+	user := createTestUser(t, 3402, db.RoleUser)
+	maxAdds := 2
+	user.MaxAddsPerHour = &maxAdds
+
+	saved, _, err := trackRewards(user, []patreon.RewardId{1, 2})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1", "2"}, saved)
+
+	removeRewardsHandler(context.Background(), nil, messageUpdate(user.TelegramChatId, "/remove 1 2"))
+	assert.Equal(t, "Removed rewards [1, 2]", fake.lastSentTo(user.TelegramChatId))
+
+	// Removed rewards still count as added, so adding them again exceeds the quota
+	usage := usageForUser(user)
+	assert.Equal(t, 0, usage.tracked)
+	assert.Equal(t, 2, usage.addsInLastHour)
+	saved, skipped, err := trackRewards(user, []patreon.RewardId{1})
+	assert.NoError(t, err)
+	assert.Empty(t, saved)
+	assert.Equal(t, []patreon.RewardId{1}, skipped)
+}
+
+func TestQuotaUsage_Remaining(t *testing.T) {
+	usage := &quotaUsage{quota: quota{maxTracked: 10, maxAddsPerHour: unlimited}, tracked: 7}
+	assert.Equal(t, 3, usage.remaining())
+
+	usage.maxAddsPerHour = 5
+	usage.addsInLastHour = 4
+	assert.Equal(t, 1, usage.remaining())
+
+	usage = &quotaUsage{quota: defaultQuota, tracked: 100, addsInLastHour: 100}
+	assert.Equal(t, unlimited, usage.remaining())
+
+	ids := []patreon.RewardId{1, 2, 3}
+	allowed, skipped := splitByQuota(ids, &quotaUsage{quota: quota{maxTracked: 2, maxAddsPerHour: unlimited}})
+	assert.Equal(t, []patreon.RewardId{1, 2}, allowed)
+	assert.Equal(t, []patreon.RewardId{3}, skipped)
+}
+
+func TestQuotaForUser(t *testing.T) {
+	original := defaultQuota
+	defer func() { defaultQuota = original }()
+	defaultQuota = quota{maxTracked: 20, maxAddsPerHour: 5}
+
+	override := 50
+	assert.Equal(t, quota{maxTracked: 20, maxAddsPerHour: 5}, quotaForUser(&db.User{Role: db.RoleUser}))
+	assert.Equal(t, quota{maxTracked: 50, maxAddsPerHour: 5}, quotaForUser(&db.User{Role: db.RoleUser, MaxTrackedRewards: &override}))
+	assert.Equal(t, quota{maxTracked: unlimited, maxAddsPerHour: unlimited}, quotaForUser(&db.User{Role: db.RoleAdmin}))
+}
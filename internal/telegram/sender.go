@@ -0,0 +1,338 @@
+package telegram
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fanonwue/goutils/logging"
+	"github.com/fanonwue/patreon-gobot/internal/db"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+const (
+	// globalMessageInterval keeps the bot below Telegram's limit of 30 messages per second
+	globalMessageInterval = time.Second / 30
+	// chatMessageInterval keeps the bot below Telegram's limit of 1 message per second and chat
+	chatMessageInterval = time.Second
+	// chatSlotsCleanupSize is the number of tracked chats at which outdated chat slots get removed
+	chatSlotsCleanupSize = 1000
+	maxDeliveryAttempts  = 5
+	deliveryRetryBackoff = 10 * time.Second
+)
+
+type (
+	// rateLimiter hands out send slots, making sure both the global and the per-chat limits are respected
+	rateLimiter struct {
+		mu             sync.Mutex
+		globalInterval time.Duration
+		chatInterval   time.Duration
+		nextGlobalSlot time.Time
+		nextChatSlots  map[int64]time.Time
+	}
+
+	// messageQueue delivers messages asynchronously. Queued messages are persisted until delivered, so they
+	// survive restarts. Messages for the same chat are delivered in order.
+	messageQueue struct {
+		mu         sync.Mutex
+		ctx        context.Context
+		chatQueues map[int64][]*db.PendingMessage
+	}
+)
+
+var limiter = newRateLimiter(globalMessageInterval, chatMessageInterval)
+var outbox = &messageQueue{chatQueues: make(map[int64][]*db.PendingMessage)}
+
+func newRateLimiter(globalInterval time.Duration, chatInterval time.Duration) *rateLimiter {
+	return &rateLimiter{
+		globalInterval: globalInterval,
+		chatInterval:   chatInterval,
+		nextChatSlots:  make(map[int64]time.Time),
+	}
+}
+
+// wait blocks until the next send slot for the chat is reached
+func (rl *rateLimiter) wait(ctx context.Context, chatId int64) error {
+	rl.mu.Lock()
+	now := time.Now()
+	slot := now
+	if rl.nextGlobalSlot.After(slot) {
+		slot = rl.nextGlobalSlot
+	}
+	if chatSlot := rl.nextChatSlots[chatId]; chatSlot.After(slot) {
+		slot = chatSlot
+	}
+	rl.nextGlobalSlot = slot.Add(rl.globalInterval)
+	rl.nextChatSlots[chatId] = slot.Add(rl.chatInterval)
+	if len(rl.nextChatSlots) >= chatSlotsCleanupSize {
+		rl.cleanup(now)
+	}
+	rl.mu.Unlock()
+
+	timer := time.NewTimer(time.Until(slot))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// pause delays all following sends, used when Telegram tells us to back off
+func (rl *rateLimiter) pause(duration time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if until := time.Now().Add(duration); until.After(rl.nextGlobalSlot) {
+		rl.nextGlobalSlot = until
+	}
+}
+
+// cleanup removes chat slots in the past, has to be called with the lock held
+func (rl *rateLimiter) cleanup(now time.Time) {
+	for chatId, slot := range rl.nextChatSlots {
+		if slot.Before(now) {
+			delete(rl.nextChatSlots, chatId)
+		}
+	}
+}
+
+// sendPaced sends a single message once a send slot is available, retrying as long as Telegram responds
+// with "429 Too Many Requests", up to maxDeliveryAttempts times
+func sendPaced(ctx context.Context, params *bot.SendMessageParams) (*models.Message, error) {
+	for attempt := 1; ; attempt++ {
+		m, err := sendOnce(ctx, params)
+		if !isTooManyRequests(err) || attempt >= maxDeliveryAttempts {
+			return m, err
+		}
+	}
+}
+
+// sendOnce sends a single message once a send slot is available. If Telegram responds with
+// "429 Too Many Requests", all following sends are paused as long as requested.
+func sendOnce(ctx context.Context, params *bot.SendMessageParams) (*models.Message, error) {
+	chatId, _ := params.ChatID.(int64)
+	if err := limiter.wait(ctx, chatId); err != nil {
+		return nil, err
+	}
+
+	m, err := botInstance.SendMessage(ctx, params)
+	var tooManyRequests *bot.TooManyRequestsError
+	if errors.As(err, &tooManyRequests) {
+		retryAfter := time.Duration(tooManyRequests.RetryAfter) * time.Second
+		logging.Warnf("Hit Telegram rate limit, retrying in %.0f seconds", retryAfter.Seconds())
+		limiter.pause(retryAfter)
+	}
+	return m, err
+}
+
+func isTooManyRequests(err error) bool {
+	var tooManyRequests *bot.TooManyRequestsError
+	return errors.As(err, &tooManyRequests)
+}
+
+// start loads all undelivered messages from the database and starts delivering them
+func (q *messageQueue) start(ctx context.Context) {
+	q.mu.Lock()
+	q.ctx = ctx
+	// Anything queued before starting has been persisted and is loaded below
+	clear(q.chatQueues)
+	q.mu.Unlock()
+
+	var pending []*db.PendingMessage
+	db.Db().Order("id").Find(&pending)
+	if len(pending) > 0 {
+		logging.Infof("Resuming delivery of %d pending messages", len(pending))
+	}
+	for _, message := range pending {
+		q.push(message)
+	}
+}
+
+// enqueue persists the message and queues it for delivery. Long messages are split beforehand, so every
+// part gets delivered (and retried) on its own. Only inline keyboards are supported as reply markup, they are
+// attached to the last part.
+func (q *messageQueue) enqueue(params *bot.SendMessageParams) {
+	chatId, _ := params.ChatID.(int64)
+	disableLinkPreview := params.LinkPreviewOptions != nil && params.LinkPreviewOptions.IsDisabled != nil && *params.LinkPreviewOptions.IsDisabled
+
+	replyMarkup := ""
+	if keyboard, ok := params.ReplyMarkup.(*models.InlineKeyboardMarkup); ok {
+		encoded, err := json.Marshal(keyboard)
+		if err != nil {
+			logging.Errorf("Error encoding reply markup for chat %d: %v", chatId, err)
+		}
+		replyMarkup = string(encoded)
+	}
+
+	chunks := splitMessage(params.Text, maxMessageLength, params.ParseMode == models.ParseModeHTML)
+	for i, chunk := range chunks {
+		message := &db.PendingMessage{
+			ChatId:              chatId,
+			Text:                chunk,
+			ParseMode:           string(params.ParseMode),
+			DisableLinkPreview:  disableLinkPreview,
+			DisableNotification: params.DisableNotification,
+		}
+		if i == len(chunks)-1 {
+			message.ReplyMarkup = replyMarkup
+		}
+		if err := db.Db().Create(message).Error; err != nil {
+			logging.Errorf("Error persisting message for chat %d: %v", chatId, err)
+		}
+		q.push(message)
+	}
+}
+
+func (q *messageQueue) push(message *db.PendingMessage) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	queue, running := q.chatQueues[message.ChatId]
+	q.chatQueues[message.ChatId] = append(queue, message)
+	if !running && q.ctx != nil {
+		go q.drain(message.ChatId)
+	}
+}
+
+func (q *messageQueue) pop(chatId int64) *db.PendingMessage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	queue := q.chatQueues[chatId]
+	if len(queue) == 0 {
+		delete(q.chatQueues, chatId)
+		return nil
+	}
+	q.chatQueues[chatId] = queue[1:]
+	return queue[0]
+}
+
+// drain delivers all queued messages of the chat in order. There's at most one drain goroutine per chat.
+func (q *messageQueue) drain(chatId int64) {
+	for message := q.pop(chatId); message != nil; message = q.pop(chatId) {
+		q.deliver(message)
+	}
+}
+
+// discard drops all queued messages of the chat
+func (q *messageQueue) discard(chatId int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if queue, found := q.chatQueues[chatId]; found {
+		q.chatQueues[chatId] = queue[:0]
+	}
+	db.Db().Unscoped().Delete(&db.PendingMessage{}, "chat_id = ?", chatId)
+}
+
+func (q *messageQueue) deliver(message *db.PendingMessage) {
+	params := &bot.SendMessageParams{
+		ChatID:              message.ChatId,
+		Text:                message.Text,
+		ParseMode:           models.ParseMode(message.ParseMode),
+		DisableNotification: message.DisableNotification,
+	}
+	if message.DisableLinkPreview {
+		params.LinkPreviewOptions = &models.LinkPreviewOptions{IsDisabled: bot.True()}
+	}
+	if message.ReplyMarkup != "" {
+		keyboard := &models.InlineKeyboardMarkup{}
+		if err := json.Unmarshal([]byte(message.ReplyMarkup), keyboard); err != nil {
+			logging.Errorf("Error decoding reply markup of message %d: %v", message.ID, err)
+		} else {
+			params.ReplyMarkup = keyboard
+		}
+	}
+
+	for message.Attempts < maxDeliveryAttempts {
+		// Rate limited attempts count as well, so a message can't be retried forever
+		_, err := sendOnce(q.ctx, params)
+		if err == nil {
+			break
+		}
+		if q.ctx.Err() != nil {
+			// Shutting down, the message stays persisted and will be delivered after the next start
+			return
+		}
+		if isChatUnreachable(err) {
+			deactivateChat(message.ChatId, err)
+			q.discard(message.ChatId)
+			break
+		}
+
+		message.Attempts++
+		logging.Errorf("Error delivering message to chat %d (attempt %d of %d): %v", message.ChatId, message.Attempts, maxDeliveryAttempts, err)
+		db.Db().Model(message).Update("attempts", message.Attempts)
+		// The rate limiter already waits as long as Telegram asked for
+		if message.Attempts < maxDeliveryAttempts && !isTooManyRequests(err) {
+			select {
+			case <-q.ctx.Done():
+				return
+			case <-time.After(deliveryRetryBackoff * time.Duration(message.Attempts)):
+			}
+		}
+	}
+
+	if message.ID > 0 {
+		db.Db().Unscoped().Delete(message)
+	}
+}
+
+// queueMessage sends the message asynchronously through the persistent message queue
+func queueMessage(params *bot.SendMessageParams) {
+	outbox.enqueue(params)
+}
+
+// isChatUnreachable checks whether the error indicates that the bot can't send messages to the chat anymore,
+// e.g. because the user blocked the bot or the bot got removed from a channel. Other errors, like missing
+// permissions, are retried as usual.
+func isChatUnreachable(err error) bool {
+	if isUserUnreachable(err) {
+		return true
+	}
+	description := strings.ToLower(err.Error())
+	if errors.Is(err, bot.ErrorForbidden) {
+		return strings.Contains(description, "bot is not a member") || strings.Contains(description, "bot was kicked")
+	}
+	return errors.Is(err, bot.ErrorBadRequest) && strings.Contains(description, "chat not found")
+}
+
+// isUserUnreachable checks whether the error indicates that the user blocked the bot or deleted their account
+func isUserUnreachable(err error) bool {
+	if !errors.Is(err, bot.ErrorForbidden) {
+		return false
+	}
+	description := strings.ToLower(err.Error())
+	return strings.Contains(description, "bot was blocked by the user") || strings.Contains(description, "user is deactivated")
+}
+
+// deactivateChat stops sending messages to the chat. Users routing their notifications to the chat get them in
+// their own chat again. If the user blocked the bot or deleted their account, they are marked as inactive, excluding
+// them from updates until they start the bot again.
+func deactivateChat(chatId int64, reason error) {
+	result := db.Db().Model(&db.User{}).Where("notification_chat = ?", chatId).Update("notification_chat", nil)
+	if result.Error != nil {
+		logging.Errorf("Error resetting notification chat %d: %v", chatId, result.Error)
+	} else if result.RowsAffected > 0 {
+		logging.Infof("Reset notification chat %d for %d users: %v", chatId, result.RowsAffected, reason)
+	}
+
+	if !isUserUnreachable(reason) {
+		return
+	}
+	result = db.Db().Model(&db.User{}).
+		Where("telegram_chat_id = ? AND is_inactive = ?", chatId, false).
+		Update("is_inactive", true)
+	if result.Error != nil {
+		logging.Errorf("Error deactivating user with Chat ID %d: %v", chatId, result.Error)
+		return
+	}
+	if result.RowsAffected > 0 {
+		logging.Infof("Deactivated user with Chat ID %d: %v", chatId, reason)
+	}
+}
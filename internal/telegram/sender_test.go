@@ -0,0 +1,167 @@
+package telegram
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/fanonwue/patreon-gobot/internal/db"
+	"github.com/go-telegram/bot"
+	"github.com/stretchr/testify/assert"
+)
+
+// startTestQueue starts a message queue that stops delivering once the test is done
+func startTestQueue(t *testing.T) *messageQueue {
+	q := &messageQueue{chatQueues: make(map[int64][]*db.PendingMessage)}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	q.start(ctx)
+	return q
+}
+
+func pendingMessageCount(chatId int64) int64 {
+	var count int64
+	db.Db().Model(&db.PendingMessage{}).Where("chat_id = ?", chatId).Count(&count)
+	return count
+}
+
+func TestMessageQueue_DeliversInOrder(t *testing.T) {
+	fake := newFakeTelegram(t)
+	q := startTestQueue(t)
+	const chatId = int64(7001)
+
+	for _, text := range []string{"first", "second", "third"} {
+		q.enqueue(&bot.SendMessageParams{ChatID: chatId, Text: text})
+	}
+	fake.waitForMessages(t, chatId, 3)
+	assert.Equal(t, []string{"first", "second", "third"}, fake.sentTo(chatId))
+
+	// Delivered messages are removed from the database
+	assert.Eventually(t, func() bool { return pendingMessageCount(chatId) == 0 }, time.Second, 10*time.Millisecond)
+}
+
+func TestSendPaced_RetriesTooManyRequests(t *testing.T) {
+	fake := newFakeTelegram(t)
+	const chatId = int64(7002)
+	fake.fail(chatId, 429, "Too Many Requests: retry after 1", 1)
+
+	start := time.Now()
+	_, err := sendPaced(context.Background(), &bot.SendMessageParams{ChatID: chatId, Text: "hello"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"hello"}, fake.sentTo(chatId))
+	assert.Equal(t, 2, fake.requestCount("sendMessage"))
+	// The retry waits as long as Telegram asked for
+	assert.GreaterOrEqual(t, time.Since(start), time.Second)
+}
+
+func TestMessageQueue_CountsTooManyRequests(t *testing.T) {
+	fake := newFakeTelegram(t)
+	q := startTestQueue(t)
+	const chatId = int64(7004)
+	for range maxDeliveryAttempts {
+		fake.fail(chatId, 429, "Too Many Requests: retry after 0", 0)
+	}
+
+	q.enqueue(&bot.SendMessageParams{ChatID: chatId, Text: "rate limited"})
+	// The message is dropped once all attempts are used up
+	assert.Eventually(t, func() bool { return pendingMessageCount(chatId) == 0 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, maxDeliveryAttempts, fake.requestCount("sendMessage"))
+	assert.Empty(t, fake.sentTo(chatId))
+}
+
+func TestMessageQueue_RestoresPendingMessages(t *testing.T) {
+	fake := newFakeTelegram(t)
+	const chatId = int64(7003)
+
+	// Left over from the last run
+	assert.NoError(t, db.Db().Create(&db.PendingMessage{ChatId: chatId, Text: "persisted"}).Error)
+	// Queued before the queue got started, e.g. during startup
+	q := &messageQueue{chatQueues: make(map[int64][]*db.PendingMessage)}
+	q.enqueue(&bot.SendMessageParams{ChatID: chatId, Text: "queued before start"})
+	assert.Empty(t, fake.sentTo(chatId))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	q.start(ctx)
+	fake.waitForMessages(t, chatId, 2)
+	assert.Eventually(t, func() bool { return pendingMessageCount(chatId) == 0 }, time.Second, 10*time.Millisecond)
+	// Every message is delivered exactly once
+	assert.Equal(t, []string{"persisted", "queued before start"}, fake.sentTo(chatId))
+}
+
+func TestMessageQueue_DeactivatesBlockedChats(t *testing.T) {
+	fake := newFakeTelegram(t)
+	q := startTestQueue(t)
+	user := createTestUser(t, 7011, db.RoleUser)
+	channel := int64(-7012)
+	routed := createTestUser(t, 7013, db.RoleUser)
+	assert.NoError(t, db.Db().Model(routed).Update("notification_chat", channel).Error)
+
+	fake.fail(user.TelegramChatId, 403, "Forbidden: bot was blocked by the user", 0)
+	q.enqueue(&bot.SendMessageParams{ChatID: user.TelegramChatId, Text: "blocked"})
+	fake.fail(channel, 400, "Bad Request: chat not found", 0)
+	q.enqueue(&bot.SendMessageParams{ChatID: channel, Text: "removed channel"})
+
+	storedUser := func(id uint) *db.User {
+		stored := &db.User{}
+		db.Db().First(stored, id)
+		return stored
+	}
+	assert.Eventually(t, func() bool { return storedUser(user.ID).IsInactive }, time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool { return storedUser(routed.ID).NotificationChat == nil }, time.Second, 10*time.Millisecond)
+	// Users routing their notifications elsewhere stay active
+	assert.False(t, storedUser(routed.ID).IsInactive)
+	// Messages for unreachable chats are dropped instead of retried
+	assert.Eventually(t, func() bool {
+		return pendingMessageCount(user.TelegramChatId) == 0 && pendingMessageCount(channel) == 0
+	}, time.Second, 10*time.Millisecond)
+	assert.Empty(t, fake.sentTo(user.TelegramChatId))
+}
+
+func TestMessageQueue_KeepsChannelOwnersActive(t *testing.T) {
+	fake := newFakeTelegram(t)
+	q := startTestQueue(t)
+	channel := int64(-7014)
+	owner := createTestUser(t, 7015, db.RoleUser)
+	assert.NoError(t, db.Db().Model(owner).Update("notification_chat", channel).Error)
+
+	fake.fail(channel, 403, "Forbidden: bot is not a member of the channel chat", 0)
+	q.enqueue(&bot.SendMessageParams{ChatID: channel, Text: "removed from channel"})
+
+	stored := &db.User{}
+	assert.Eventually(t, func() bool {
+		db.Db().First(stored, owner.ID)
+		return stored.NotificationChat == nil
+	}, time.Second, 10*time.Millisecond)
+	assert.False(t, stored.IsInactive)
+}
+
+func TestIsChatUnreachable(t *testing.T) {
+	forbidden := func(description string) error { return fmt.Errorf("%w, %s", bot.ErrorForbidden, description) }
+
+	assert.True(t, isChatUnreachable(forbidden("Forbidden: bot was blocked by the user")))
+	assert.True(t, isChatUnreachable(forbidden("Forbidden: user is deactivated")))
+	assert.True(t, isChatUnreachable(forbidden("Forbidden: bot is not a member of the channel chat")))
+	assert.True(t, isChatUnreachable(forbidden("Forbidden: bot was kicked from the supergroup chat")))
+	assert.True(t, isChatUnreachable(fmt.Errorf("%w, %s", bot.ErrorBadRequest, "Bad Request: chat not found")))
+	// Missing permissions might be fixed, so those messages are retried
+	assert.False(t, isChatUnreachable(forbidden("Forbidden: not enough rights to send text messages to the chat")))
+
+	// Only users that blocked the bot or deleted their account are deactivated
+	assert.True(t, isUserUnreachable(forbidden("Forbidden: bot was blocked by the user")))
+	assert.True(t, isUserUnreachable(forbidden("Forbidden: user is deactivated")))
+	assert.False(t, isUserUnreachable(forbidden("Forbidden: bot is not a member of the channel chat")))
+}
+
+func TestStartHandler_ReactivatesUser(t *testing.T) {
+	fake := newFakeTelegram(t)
+	user := createTestUser(t, 7021, db.RoleUser)
+	assert.NoError(t, db.Db().Model(user).Update("is_inactive", true).Error)
+
+	startHandler(context.Background(), nil, messageUpdate(user.TelegramChatId, "/start"))
+	stored := &db.User{}
+	db.Db().First(stored, user.ID)
+	assert.False(t, stored.IsInactive)
+	assert.Equal(t, "You are already registered. Welcome back!", fake.lastSentTo(user.TelegramChatId))
+}
@@ -0,0 +1,132 @@
+package telegram
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/fanonwue/goutils/logging"
+	"github.com/fanonwue/patreon-gobot/internal/db"
+	"github.com/fanonwue/patreon-gobot/internal/patreon"
+	"github.com/fanonwue/patreon-gobot/internal/util"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"gorm.io/gorm"
+)
+
+// sessionSecretName is the name the Patreon session is stored under
+const sessionSecretName = "patreon_session"
+
+const sessionUsage = "Usage: /session shows the status, /session <session_id cookie> sets the Patreon session, /session clear removes it"
+
+var patreonSession *patreon.Session
+
+// SetSession sets the Patreon session /session manages and loads the stored session into it
+func SetSession(session *patreon.Session) {
+	patreonSession = session
+	cookie, err := loadSecret(sessionSecretName)
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+	case err != nil:
+		logging.Errorf("Error loading the stored Patreon session: %v", err)
+	default:
+		session.Set(cookie)
+		logging.Info("Loaded the stored Patreon session")
+	}
+}
+
+// SessionExpiredHandler notifies the admins that the Patreon session has expired
+func SessionExpiredHandler() {
+	NotifyAdmins("The Patreon session has expired, rewards only accessible with a session can't be checked anymore. Use /session to set a new one.")
+}
+
+func loadSecret(name string) (string, error) {
+	secret := &db.Secret{}
+	if err := db.Db().First(secret, "name = ?", name).Error; err != nil {
+		return "", err
+	}
+	plaintext, err := util.Decrypt(util.SecretKey(), secret.Value)
+	return string(plaintext), err
+}
+
+func storeSecret(name string, value string) error {
+	ciphertext, err := util.Encrypt(util.SecretKey(), []byte(value))
+	if err != nil {
+		return err
+	}
+	return db.Db().Save(&db.Secret{Name: name, Value: ciphertext}).Error
+}
+
+// sessionHandler shows or changes the Patreon session. It only works in private chats, as the cookie grants
+// access to the Patreon account.
+func sessionHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	if update.Message.Chat.Type != models.ChatTypePrivate {
+		if args := commandArgs(update.Message.Text); len(args) > 0 && args[0] != "clear" {
+			deleteSessionMessage(ctx, b, update)
+		}
+		replyText(ctx, update, "The Patreon session can only be managed in a private chat with the bot")
+		return
+	}
+	if patreonSession == nil {
+		replyText(ctx, update, "Patreon sessions are not supported")
+		return
+	}
+
+	args := commandArgs(update.Message.Text)
+	if len(args) == 0 {
+		replyText(ctx, update, sessionStatusText(patreonSession.Status()))
+		return
+	}
+
+	if args[0] == "clear" {
+		if err := db.Db().Delete(&db.Secret{}, "name = ?", sessionSecretName).Error; err != nil {
+			logging.Errorf("Error deleting the Patreon session: %v", err)
+			replyText(ctx, update, "Error removing the session")
+			return
+		}
+		patreonSession.Clear()
+		replyText(ctx, update, "Session removed")
+		logging.Info("Patreon session removed")
+		return
+	}
+
+	deleteSessionMessage(ctx, b, update)
+
+	if err := storeSecret(sessionSecretName, args[0]); err != nil {
+		logging.Errorf("Error storing the Patreon session: %v", err)
+		sendMessage(ctx, &bot.SendMessageParams{ChatID: update.Message.Chat.ID, Text: fmt.Sprintf("Error storing the session: %v", err)})
+		return
+	}
+	patreonSession.Set(args[0])
+	logging.Info("Patreon session updated")
+
+	text := "Session stored, but Patreon could not be reached to validate it"
+	switch err := patreonClient().ValidateSession(ctx); {
+	case err == nil:
+		text = "Session stored and validated"
+	case errors.Is(err, patreon.ErrSessionExpired):
+		text = "Session stored, but Patreon rejected it"
+	}
+	sendMessage(ctx, &bot.SendMessageParams{ChatID: update.Message.Chat.ID, Text: text})
+}
+
+// deleteSessionMessage deletes the message containing the cookie, as it shouldn't stay in the chat history
+func deleteSessionMessage(ctx context.Context, b *bot.Bot, update *models.Update) {
+	_, err := b.DeleteMessage(ctx, &bot.DeleteMessageParams{ChatID: update.Message.Chat.ID, MessageID: update.Message.ID})
+	if err != nil {
+		logging.Warnf("Error deleting the message containing the Patreon session: %v", err)
+	}
+}
+
+func sessionStatusText(status patreon.SessionStatus) string {
+	switch {
+	case !status.Configured:
+		return "No Patreon session configured"
+	case status.Expired:
+		return "The Patreon session has expired"
+	case status.Validated.IsZero():
+		return "Patreon session configured, not validated yet"
+	default:
+		return fmt.Sprintf("Patreon session valid, last validated at %s", status.Validated.Format("2006-01-02 15:04"))
+	}
+}
@@ -0,0 +1,164 @@
+package telegram
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fanonwue/goutils/dsext"
+	"github.com/fanonwue/goutils/logging"
+	"github.com/fanonwue/patreon-gobot/internal/db"
+	"github.com/fanonwue/patreon-gobot/internal/patreon"
+	"github.com/fanonwue/patreon-gobot/internal/tmpl"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+const (
+	// statusEditInterval limits how often the status message gets updated while results are coming in
+	statusEditInterval = 2 * time.Second
+	// statusCooldown limits how often a chat can use /status, as it bypasses the cache for all its rewards
+	statusCooldown = time.Minute
+)
+
+// cooldownTracker remembers when each chat last used a command
+type cooldownTracker struct {
+	mu       sync.Mutex
+	cooldown time.Duration
+	lastUsed map[int64]time.Time
+}
+
+var statusCooldowns = &cooldownTracker{cooldown: statusCooldown, lastUsed: make(map[int64]time.Time)}
+
+// use records the chat using the command, unless its cooldown hasn't passed yet. In that case, the time left
+// until the command can be used again is returned instead.
+func (ct *cooldownTracker) use(chatId int64, now time.Time) (time.Duration, bool) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	if remaining := ct.lastUsed[chatId].Add(ct.cooldown).Sub(now); remaining > 0 {
+		return remaining, false
+	}
+	for id, lastUsed := range ct.lastUsed {
+		if now.Sub(lastUsed) >= ct.cooldown {
+			delete(ct.lastUsed, id)
+		}
+	}
+	ct.lastUsed[chatId] = now
+	return 0, true
+}
+
+func statusCommand() *CommandHandler {
+	return &CommandHandler{
+		Pattern:     "/status",
+		Description: "Checks all tracked rewards right now and shows which ones are available",
+		HandlerType: bot.HandlerTypeMessageText,
+		MatchType:   bot.MatchTypeExact,
+		HandlerFunc: statusHandler,
+		ChatAction:  models.ChatActionTyping,
+	}
+}
+
+// statusHandler fetches all tracked rewards of the user, bypassing the cache. A placeholder message is sent
+// right away and updated while the results are coming in. Chats can use it once per statusCooldown.
+func statusHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	chatId := update.Message.Chat.ID
+	if remaining, ok := statusCooldowns.use(chatId, time.Now()); !ok {
+		replyText(ctx, update, fmt.Sprintf("Please wait %.0f seconds before checking again", math.Ceil(remaining.Seconds())))
+		return
+	}
+
+	user, _ := userFromChatId(chatId, nil)
+	db.Db().Preload("Rewards").Find(user)
+
+	if len(user.Rewards) == 0 {
+		replyText(ctx, update, "You are not tracking any rewards yet. Use /add to start tracking rewards.")
+		return
+	}
+
+	data := &tmpl.StatusData{Total: len(user.Rewards)}
+	placeholder := sendMessage(ctx, &bot.SendMessageParams{
+		ChatID:          chatId,
+		ReplyParameters: &models.ReplyParameters{MessageID: update.Message.ID},
+		ParseMode:       models.ParseModeHTML,
+		Text:            renderStatus(data),
+	})
+	if placeholder == nil {
+		return
+	}
+
+	rewardIds := dsext.Map(user.Rewards, func(r db.TrackedReward) patreon.RewardId {
+		return patreon.RewardId(r.RewardId)
+	})
+
+	lastEdit := time.Now()
+	for result := range patreonClient().FetchRewardsSlice(rewardIds, true, ctx) {
+		data.Checked++
+		switch {
+		case !result.IsPresent():
+			data.Missing++
+		case result.IsAvailable():
+			data.Available++
+			data.AvailableRewards = append(data.AvailableRewards, result.Reward)
+		default:
+			data.Unavailable++
+		}
+
+		if data.Checked < data.Total && time.Since(lastEdit) >= statusEditInterval {
+			lastEdit = time.Now()
+			// Errors don't matter here, the final result is sent in any case
+			_, _ = b.EditMessageText(ctx, editTextParams(placeholder, renderStatus(data)))
+		}
+	}
+
+	data.Done = true
+	slices.SortFunc(data.AvailableRewards, func(a, b *patreon.Reward) int {
+		return strings.Compare(a.Title(), b.Title())
+	})
+	editMessageText(ctx, b, placeholder, renderStatus(data))
+	logging.Infof("Status checked for user %d (Chat ID: %d): %d available, %d unavailable, %d missing",
+		user.ID, user.TelegramChatId, data.Available, data.Unavailable, data.Missing)
+}
+
+func renderStatus(data *tmpl.StatusData) string {
+	buf := new(bytes.Buffer)
+	if err := statusTemplate.Execute(buf, data); err != nil {
+		logging.Errorf("Error executing template: %v", err)
+	}
+	return buf.String()
+}
+
+func editTextParams(message *models.Message, text string) *bot.EditMessageTextParams {
+	return &bot.EditMessageTextParams{
+		ChatID:             message.Chat.ID,
+		MessageID:          message.ID,
+		ParseMode:          models.ParseModeHTML,
+		LinkPreviewOptions: &models.LinkPreviewOptions{IsDisabled: bot.True()},
+		Text:               text,
+	}
+}
+
+// editMessageText replaces the text of the message. Parts exceeding Telegram's length limit are sent as
+// separate messages.
+func editMessageText(ctx context.Context, b *bot.Bot, message *models.Message, text string) {
+	chunks := splitMessage(text, maxMessageLength, true)
+	if len(chunks) == 0 {
+		return
+	}
+
+	if _, err := b.EditMessageText(ctx, editTextParams(message, chunks[0])); err != nil {
+		logging.Errorf("Error editing message: %v", err)
+	}
+	if len(chunks) > 1 {
+		sendMessage(ctx, &bot.SendMessageParams{
+			ChatID:             message.Chat.ID,
+			ParseMode:          models.ParseModeHTML,
+			LinkPreviewOptions: &models.LinkPreviewOptions{IsDisabled: bot.True()},
+			Text:               strings.Join(chunks[1:], "\n"),
+		})
+	}
+}
@@ -0,0 +1,31 @@
+package telegram
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCooldownTracker(t *testing.T) {
+	ct := &cooldownTracker{cooldown: time.Minute, lastUsed: make(map[int64]time.Time)}
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	_, ok := ct.use(1, now)
+	assert.True(t, ok)
+	remaining, ok := ct.use(1, now.Add(20*time.Second))
+	assert.False(t, ok)
+	assert.Equal(t, 40*time.Second, remaining)
+
+	// Other chats have their own cooldown
+	_, ok = ct.use(2, now.Add(20*time.Second))
+	assert.True(t, ok)
+
+	_, ok = ct.use(1, now.Add(time.Minute))
+	assert.True(t, ok)
+	// Expired entries get removed
+	assert.Len(t, ct.lastUsed, 2)
+	_, ok = ct.use(3, now.Add(3*time.Minute))
+	assert.True(t, ok)
+	assert.Len(t, ct.lastUsed, 1)
+}
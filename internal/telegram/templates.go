@@ -10,6 +10,14 @@ import (
 var listRewardsTemplate = template.Must(createTemplate(tmpl.TemplatePath("list.gohtml")))
 var missingRewardsTemplate = template.Must(createTemplate(tmpl.TemplatePath("missing-rewards.gohtml")))
 var rewardAvailableTemplate = template.Must(createTemplate(tmpl.TemplatePath("reward-available.gohtml")))
+var budgetTemplate = template.Must(createTemplate(tmpl.TemplatePath("budget.gohtml")))
+var statsTemplate = template.Must(createTemplate(tmpl.TemplatePath("stats.gohtml")))
+var usersTemplate = template.Must(createTemplate(tmpl.TemplatePath("users.gohtml")))
+var runsTemplate = template.Must(createTemplate(tmpl.TemplatePath("runs.gohtml")))
+var addPreviewTemplate = template.Must(createTemplate(tmpl.TemplatePath("add-preview.gohtml")))
+var sharedRewardTemplate = template.Must(createTemplate(tmpl.TemplatePath("shared-reward.gohtml")))
+var statusTemplate = template.Must(createTemplate(tmpl.TemplatePath("status.gohtml")))
+var digestTemplate = template.Must(createTemplate(tmpl.TemplatePath("digest.gohtml")))
 
 var privacyPolicyTemplate = util.TrimHtmlText(`
 This bot saves the following user information:
@@ -19,10 +27,16 @@ This bot saves the following user information:
 
 2. Your provided user information:
 	- Language
+	- The Chat ID of the channel notifications are sent to, if configured
+	- Your access role (admin, user or pending approval)
+	- When requesting access, your name and username are forwarded to the admins, but not saved
 
 3. Your tracked Patreon rewards (their IDs)
 	- These will be periodically checked via the Patreon API to see whether new slots are available
 	- This can be linked to the campaign and the creator they are associated with
+	- Notes, tags and priorities you attach to them
+
+4. Your budget settings (maximum prices, optionally per campaign)
 `)
 
 var baseTemplate = template.Must(
@@ -43,6 +57,9 @@ func templateFuncMap() template.FuncMap {
 		"rewardMissingReason": func(reason patreon.RewardStatus) string {
 			return reason.Text()
 		},
-		"tgEscape": func(s string) string { return Escape(s) },
+		"tgEscape":         func(s string) string { return Escape(s) },
+		"sectionSeparator": func() string { return sectionSeparator },
+		"emojiCheck":       func() string { return util.EmojiGreenCheck },
+		"emojiCross":       func() string { return util.EmojiCross },
 	}
 }
@@ -0,0 +1,495 @@
+package telegram
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fanonwue/goutils/dsext"
+	"github.com/fanonwue/goutils/logging"
+	"github.com/fanonwue/patreon-gobot/internal/db"
+	"github.com/fanonwue/patreon-gobot/internal/patreon"
+	"github.com/fanonwue/patreon-gobot/internal/util"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"gorm.io/gorm"
+)
+
+const (
+	exportFormatJson = "json"
+	exportFormatCsv  = "csv"
+	exportVersion    = 1
+	// maxImportSize limits the size of imported documents, exports of even large lists are way smaller
+	maxImportSize = 1 << 20
+	// downloadTimeout limits how long downloading an imported document may take
+	downloadTimeout = 30 * time.Second
+	// csvFormulaEscape is prepended to CSV cells that spreadsheet applications would interpret as formula
+	csvFormulaEscape = "'"
+)
+
+var downloadClient = &http.Client{Timeout: downloadTimeout}
+
+var csvHeader = []string{"reward_id", "campaign_id", "campaign", "title", "price_cents", "currency", "note", "tags", "priority"}
+
+type (
+	// exportedReward uses plain IDs, as the patreon ID types expect the string IDs used by the Patreon API
+	exportedReward struct {
+		RewardId   int64    `json:"rewardId"`
+		CampaignId int64    `json:"campaignId,omitempty"`
+		Campaign   string   `json:"campaign,omitempty"`
+		Title      string   `json:"title,omitempty"`
+		PriceCents int      `json:"priceCents,omitempty"`
+		Currency   string   `json:"currency,omitempty"`
+		Note       string   `json:"note,omitempty"`
+		Tags       []string `json:"tags,omitempty"`
+		Priority   string   `json:"priority,omitempty"`
+	}
+
+	exportedCampaignBudget struct {
+		CampaignId    int64 `json:"campaignId"`
+		MaxPriceCents int   `json:"maxPriceCents"`
+	}
+
+	exportedSettings struct {
+		BudgetCents     *int                     `json:"budgetCents,omitempty"`
+		BudgetCurrency  string                   `json:"budgetCurrency,omitempty"`
+		CampaignBudgets []exportedCampaignBudget `json:"campaignBudgets,omitempty"`
+	}
+
+	// exportData is the JSON export format. The CSV format only contains the rewards.
+	exportData struct {
+		Version    int              `json:"version"`
+		ExportedAt time.Time        `json:"exportedAt"`
+		Settings   exportedSettings `json:"settings"`
+		Rewards    []exportedReward `json:"rewards"`
+	}
+
+	// importData is the content of an imported document. Invalid contains the entries that could not be parsed.
+	importData struct {
+		Rewards  []exportedReward
+		Settings *exportedSettings
+		Invalid  []string
+	}
+)
+
+func exportCommand() *CommandHandler {
+	return &CommandHandler{
+		Pattern:     "/export",
+		Description: "Exports your tracked rewards and settings as JSON or CSV document",
+		HandlerType: bot.HandlerTypeMessageText,
+		MatchType:   bot.MatchTypePrefix,
+		HandlerFunc: exportHandler,
+		ChatAction:  models.ChatActionUploadDocument,
+	}
+}
+
+func exportHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	chatId := update.Message.Chat.ID
+
+	format := exportFormatJson
+	if args := commandArgs(update.Message.Text); len(args) > 0 {
+		format = strings.ToLower(args[0])
+	}
+	if format != exportFormatJson && format != exportFormatCsv {
+		replyText(ctx, update, "Usage: /export [json|csv]")
+		return
+	}
+
+	user, _ := userFromChatId(chatId, nil)
+	db.Db().Preload("Rewards").Preload("CampaignBudgets").Find(user)
+	data := collectExport(ctx, user)
+
+	var content []byte
+	var err error
+	if format == exportFormatCsv {
+		content, err = encodeCsvExport(data)
+	} else {
+		content, err = json.MarshalIndent(data, "", "  ")
+	}
+	if err != nil {
+		logging.Errorf("Error encoding export for user %d: %v", user.ID, err)
+		replyText(ctx, update, "Error creating the export")
+		return
+	}
+
+	_, err = b.SendDocument(ctx, &bot.SendDocumentParams{
+		ChatID: chatId,
+		Document: &models.InputFileUpload{
+			Filename: fmt.Sprintf("patreon-gobot-%s.%s", time.Now().Format(time.DateOnly), format),
+			Data:     bytes.NewReader(content),
+		},
+		Caption:         fmt.Sprintf("%d tracked rewards. Send this file with /import as caption to import it again.", len(data.Rewards)),
+		ReplyParameters: &models.ReplyParameters{MessageID: update.Message.ID},
+	})
+	if err != nil {
+		logging.Errorf("Error sending export to user %d (Chat ID: %d): %v", user.ID, user.TelegramChatId, err)
+		return
+	}
+	logging.Infof("Exported %d rewards as %s for user %d (Chat ID: %d)", len(data.Rewards), format, user.ID, user.TelegramChatId)
+}
+
+// collectExport gathers the tracked rewards and settings of the user. Rewards that can't be fetched from Patreon
+// are exported with their ID only. The user needs to have its Rewards and CampaignBudgets preloaded.
+func collectExport(ctx context.Context, user *db.User) *exportData {
+	data := &exportData{
+		Version:    exportVersion,
+		ExportedAt: time.Now().UTC(),
+		Settings: exportedSettings{
+			BudgetCents:    user.BudgetCents,
+			BudgetCurrency: user.BudgetCurrency,
+			CampaignBudgets: dsext.Map(user.CampaignBudgets, func(cb db.CampaignBudget) exportedCampaignBudget {
+				return exportedCampaignBudget{CampaignId: cb.CampaignId, MaxPriceCents: cb.MaxPriceCents}
+			}),
+		},
+		Rewards: []exportedReward{},
+	}
+
+	exported := make(map[patreon.RewardId]*exportedReward, len(user.Rewards))
+	for _, tr := range user.Rewards {
+		data.Rewards = append(data.Rewards, exportedReward{RewardId: tr.RewardId, Note: tr.Note, Tags: tr.TagList(), Priority: string(tr.Priority)})
+	}
+	for i := range data.Rewards {
+		exported[patreon.RewardId(data.Rewards[i].RewardId)] = &data.Rewards[i]
+	}
+
+	rewardIds := dsext.Map(data.Rewards, func(r exportedReward) patreon.RewardId {
+		return patreon.RewardId(r.RewardId)
+	})
+	for result := range patreonClient().FetchRewardsSlice(rewardIds, false, ctx) {
+		if !result.IsPresent() {
+			continue
+		}
+		entry := exported[result.Id]
+		entry.Title = result.Reward.Title()
+		entry.PriceCents = result.Reward.Attributes.AmountCents
+		entry.Currency = result.Reward.Attributes.Currency.String()
+		if campaignId, err := result.Reward.CampaignId(); err == nil {
+			entry.CampaignId = int64(campaignId)
+			if campaign, err := patreonClient().FetchCampaign(campaignId, false, ctx); err == nil {
+				entry.Campaign = campaign.Name()
+			}
+		}
+	}
+
+	return data
+}
+
+func encodeCsvExport(data *exportData) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	writer := csv.NewWriter(buf)
+	_ = writer.Write(csvHeader)
+	for _, r := range data.Rewards {
+		campaignId := ""
+		if r.CampaignId > 0 {
+			campaignId = strconv.FormatInt(r.CampaignId, 10)
+		}
+		_ = writer.Write([]string{
+			strconv.FormatInt(r.RewardId, 10), campaignId, escapeCsvFormula(r.Campaign), escapeCsvFormula(r.Title),
+			strconv.Itoa(r.PriceCents), r.Currency, escapeCsvFormula(r.Note),
+			escapeCsvFormula(strings.Join(r.Tags, ",")), r.Priority,
+		})
+	}
+	writer.Flush()
+	return buf.Bytes(), writer.Error()
+}
+
+// escapeCsvFormula prevents spreadsheet applications from evaluating the cell as formula
+func escapeCsvFormula(cell string) string {
+	if cell != "" && strings.ContainsRune("=+-@\t\r", rune(cell[0])) {
+		return csvFormulaEscape + cell
+	}
+	return cell
+}
+
+// unescapeCsvFormula reverts escapeCsvFormula
+func unescapeCsvFormula(cell string) string {
+	if unescaped, found := strings.CutPrefix(cell, csvFormulaEscape); found && escapeCsvFormula(unescaped) == cell {
+		return unescaped
+	}
+	return cell
+}
+
+// parseImport reads a document created by /export. JSON is detected by its content, everything else is read as
+// CSV. CSV files without header are expected to contain the reward ID in their first column.
+func parseImport(content []byte) (*importData, error) {
+	trimmed := bytes.TrimSpace(content)
+	if len(trimmed) == 0 {
+		return nil, errors.New("the file is empty")
+	}
+
+	if trimmed[0] == '{' {
+		export := &exportData{}
+		if err := json.Unmarshal(trimmed, export); err != nil {
+			return nil, fmt.Errorf("invalid JSON: %w", err)
+		}
+		data := &importData{Settings: &export.Settings}
+		for _, r := range export.Rewards {
+			if r.RewardId <= 0 {
+				data.Invalid = append(data.Invalid, strconv.FormatInt(r.RewardId, 10))
+				continue
+			}
+			data.Rewards = append(data.Rewards, r)
+		}
+		return data, nil
+	}
+
+	reader := csv.NewReader(bytes.NewReader(trimmed))
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("invalid CSV: %w", err)
+	}
+
+	idColumn, noteColumn, tagsColumn, priorityColumn := 0, -1, -1, -1
+	if len(records) > 0 {
+		if _, err = strconv.Atoi(strings.TrimSpace(records[0][0])); err != nil {
+			header := dsext.Map(records[0], func(column string) string {
+				return strings.ToLower(strings.TrimSpace(column))
+			})
+			idColumn = slices.Index(header, csvHeader[0])
+			noteColumn = slices.Index(header, "note")
+			tagsColumn = slices.Index(header, "tags")
+			priorityColumn = slices.Index(header, "priority")
+			if idColumn < 0 {
+				return nil, fmt.Errorf("missing column %s", csvHeader[0])
+			}
+			records = records[1:]
+		}
+	}
+
+	data := &importData{}
+	for _, record := range records {
+		if idColumn >= len(record) {
+			continue
+		}
+		rawId := strings.TrimSpace(record[idColumn])
+		id, err := strconv.Atoi(rawId)
+		if err != nil || id <= 0 {
+			data.Invalid = append(data.Invalid, rawId)
+			continue
+		}
+		reward := exportedReward{RewardId: int64(id)}
+		if noteColumn >= 0 && noteColumn < len(record) {
+			reward.Note = strings.TrimSpace(unescapeCsvFormula(record[noteColumn]))
+		}
+		if tagsColumn >= 0 && tagsColumn < len(record) && strings.TrimSpace(record[tagsColumn]) != "" {
+			reward.Tags = strings.Split(unescapeCsvFormula(record[tagsColumn]), ",")
+		}
+		if priorityColumn >= 0 && priorityColumn < len(record) {
+			reward.Priority = strings.ToLower(strings.TrimSpace(record[priorityColumn]))
+		}
+		data.Rewards = append(data.Rewards, reward)
+	}
+	return data, nil
+}
+
+func importCommand() *CommandHandler {
+	return &CommandHandler{
+		Pattern:        "/import",
+		Description:    "Imports rewards from a document created by /export",
+		HandlerType:    bot.HandlerTypeMessageText,
+		MatchType:      bot.MatchTypePrefix,
+		HandlerFunc:    importCommandHandler,
+		ChatAction:     models.ChatActionTyping,
+		GroupAdminOnly: true,
+	}
+}
+
+// isImportDocument matches documents sent with /import as caption
+func isImportDocument(update *models.Update) bool {
+	return update.Message != nil && update.Message.Document != nil && isCommand(update.Message.Caption, importCommand().Pattern)
+}
+
+// importCommandHandler imports the document the command replies to. Without document, it asks for one.
+func importCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	if reply := update.Message.ReplyToMessage; reply != nil && reply.Document != nil {
+		importDocument(ctx, b, update, reply.Document)
+		return
+	}
+
+	convHandler.SetActiveConversationStage(update.Message.Chat.ID, stageImportDocument)
+	replyText(ctx, update, "Send me the file created by /export (JSON or CSV). Send /cancel to abort.")
+}
+
+// importDocumentHandler handles documents sent with /import as caption
+func importDocumentHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	importDocument(ctx, b, update, update.Message.Document)
+}
+
+// importStageHandler waits for the document to import
+func importStageHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	chatId := update.Message.Chat.ID
+	if isGroupChat(update.Message.Chat) && !isGroupAdmin(ctx, b, update.Message) {
+		return
+	}
+	if update.Message.Document == nil {
+		if leaveConversationForCommand(ctx, b, update) {
+			return
+		}
+		convHandler.SetActiveConversationStage(chatId, stageImportDocument)
+		replyText(ctx, update, "Please send the file as document, or /cancel to abort.")
+		return
+	}
+
+	convHandler.EndConversation(chatId)
+	importDocument(ctx, b, update, update.Message.Document)
+}
+
+func importDocument(ctx context.Context, b *bot.Bot, update *models.Update, document *models.Document) {
+	chatId := update.Message.Chat.ID
+	if document.FileSize > maxImportSize {
+		replyText(ctx, update, "The file is too large to be imported")
+		return
+	}
+
+	b.SendChatAction(ctx, &bot.SendChatActionParams{ChatID: chatId, Action: models.ChatActionTyping})
+
+	content, err := downloadDocument(ctx, b, document)
+	if err != nil {
+		logging.Errorf("Error downloading document for chat %d: %v", chatId, err)
+		replyText(ctx, update, "Error downloading the file")
+		return
+	}
+
+	data, err := parseImport(content)
+	if err != nil {
+		replyText(ctx, update, fmt.Sprintf("The file could not be imported: %v", err))
+		return
+	}
+
+	user, _ := userFromChatId(chatId, nil)
+	imported := make(map[patreon.RewardId]exportedReward)
+	ids := make([]int, 0, len(data.Rewards))
+	for _, r := range data.Rewards {
+		ids = append(ids, int(r.RewardId))
+		imported[patreon.RewardId(r.RewardId)] = r
+	}
+
+	newRewardIds := untrackedRewardIds(user, ids)
+	alreadyTracked := len(slices.Compact(slices.Sorted(slices.Values(ids)))) - len(newRewardIds)
+	newRewardIds, quotaSkippedIds, usage := applyQuota(user, newRewardIds)
+
+	var foundIds []patreon.RewardId
+	invalid := data.Invalid
+	for result := range patreonClient().FetchRewardsSlice(newRewardIds, false, ctx) {
+		if result.IsPresent() {
+			foundIds = append(foundIds, result.Id)
+		} else {
+			invalid = append(invalid, strconv.Itoa(int(result.Id)))
+		}
+	}
+
+	savedRewards, skippedIds, err := trackRewards(user, foundIds)
+	if err != nil {
+		logging.Errorf("Error occured while importing rewards: %v", err)
+		replyText(ctx, update, fmt.Sprintf("Error saving rewards: %s", err))
+		return
+	}
+	if len(skippedIds) > 0 {
+		quotaSkippedIds = append(quotaSkippedIds, skippedIds...)
+		usage = usageForUser(user)
+	}
+
+	restoreRewardSettings(user, foundIds, imported)
+
+	settingsRestored := data.Settings != nil && restoreSettings(user, data.Settings)
+
+	lines := []string{fmt.Sprintf("Import finished. Added %d rewards: [%s]", len(savedRewards), strings.Join(savedRewards, ", "))}
+	if alreadyTracked > 0 {
+		lines = append(lines, fmt.Sprintf("Skipped %d rewards you are already tracking", alreadyTracked))
+	}
+	if len(quotaSkippedIds) > 0 {
+		lines = append(lines, fmt.Sprintf("Skipped [%s] due to your quota. Current usage: %s", dsext.Join(quotaSkippedIds, ", ", func(id patreon.RewardId) string {
+			return strconv.Itoa(int(id))
+		}), usage))
+	}
+	if len(invalid) > 0 {
+		lines = append(lines, fmt.Sprintf("Invalid entries: [%s]", strings.Join(invalid, ", ")))
+	}
+	if settingsRestored {
+		lines = append(lines, "Budget settings have been restored")
+	}
+	replyText(ctx, update, strings.Join(lines, "\n"))
+	logging.Infof("Imported rewards [%s] for user %d (Chat ID: %d)", strings.Join(savedRewards, ", "), user.ID, user.TelegramChatId)
+}
+
+func downloadDocument(ctx context.Context, b *bot.Bot, document *models.Document) ([]byte, error) {
+	file, err := b.GetFile(ctx, &bot.GetFileParams{FileID: document.FileID})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.FileDownloadLink(file), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := downloadClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(res.Body, maxImportSize))
+}
+
+// restoreRewardSettings applies the imported note, tags and priority to the newly tracked rewards
+func restoreRewardSettings(user *db.User, rewardIds []patreon.RewardId, imported map[patreon.RewardId]exportedReward) {
+	for _, id := range rewardIds {
+		r := imported[id]
+		priority := db.Priority(r.Priority)
+		if r.Note == "" && len(r.Tags) == 0 && !priority.IsValid() {
+			continue
+		}
+		tr := &db.TrackedReward{Note: r.Note, Priority: db.PriorityNormal}
+		tr.SetTags(r.Tags)
+		if priority.IsValid() {
+			tr.Priority = priority
+		}
+		db.Db().Model(&db.TrackedReward{}).Where("user_id = ? AND reward_id = ?", user.ID, r.RewardId).
+			Select("note", "tags", "priority").Updates(tr)
+	}
+}
+
+// restoreSettings applies imported budget settings the user hasn't configured yet. Returns true if anything
+// has been restored.
+func restoreSettings(user *db.User, settings *exportedSettings) bool {
+	db.Db().Preload("CampaignBudgets").Find(user)
+	restored := false
+	err := db.Db().Transaction(func(tx *gorm.DB) error {
+		if user.BudgetCents == nil && settings.BudgetCents != nil && util.Currency(settings.BudgetCurrency).IsKnown() {
+			user.BudgetCents = settings.BudgetCents
+			user.BudgetCurrency = settings.BudgetCurrency
+			if err := tx.Model(user).Select("budget_cents", "budget_currency").Updates(user).Error; err != nil {
+				return err
+			}
+			restored = true
+		}
+		for _, cb := range settings.CampaignBudgets {
+			if user.CampaignBudget(cb.CampaignId) != nil || cb.CampaignId <= 0 {
+				continue
+			}
+			budget := &db.CampaignBudget{UserID: user.ID, CampaignId: cb.CampaignId, MaxPriceCents: cb.MaxPriceCents}
+			if err := tx.Create(budget).Error; err != nil {
+				return err
+			}
+			restored = true
+		}
+		return nil
+	})
+	if err != nil {
+		logging.Errorf("Error restoring settings of user %d: %v", user.ID, err)
+		return false
+	}
+	return restored
+}
@@ -0,0 +1,83 @@
+package telegram
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseImport_CsvRoundTrip(t *testing.T) {
+	export := &exportData{Rewards: []exportedReward{
+		{RewardId: 7790866, CampaignId: 42, Campaign: "Campaign, with comma", Title: "Tier", PriceCents: 500, Currency: "USD", Note: "Note, with comma", Tags: []string{"art", "comics"}, Priority: "high"},
+		{RewardId: 10206990},
+	}}
+	content, err := encodeCsvExport(export)
+	assert.NoError(t, err)
+
+	data, err := parseImport(content)
+	assert.NoError(t, err)
+	assert.Empty(t, data.Invalid)
+	assert.Nil(t, data.Settings)
+	assert.Equal(t, []exportedReward{
+		{RewardId: 7790866, Note: "Note, with comma", Tags: []string{"art", "comics"}, Priority: "high"},
+		{RewardId: 10206990},
+	}, data.Rewards)
+}
+
+func TestEncodeCsvExport_EscapesFormulas(t *testing.T) {
+	export := &exportData{Rewards: []exportedReward{
+		{RewardId: 1, Campaign: "=HYPERLINK(\"x\")", Title: "+1", Note: "@SUM(A1)", Tags: []string{"-art", "music"}},
+	}}
+	content, err := encodeCsvExport(export)
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), "'=HYPERLINK")
+	assert.Contains(t, string(content), "'+1")
+	assert.Contains(t, string(content), "'@SUM(A1)")
+	assert.Contains(t, string(content), "'-art,music")
+
+	data, err := parseImport(content)
+	assert.NoError(t, err)
+	assert.Equal(t, []exportedReward{{RewardId: 1, Note: "@SUM(A1)", Tags: []string{"-art", "music"}}}, data.Rewards)
+}
+
+func TestUnescapeCsvFormula(t *testing.T) {
+	assert.Equal(t, "=1", unescapeCsvFormula("'=1"))
+	assert.Equal(t, "'quoted'", unescapeCsvFormula("'quoted'"))
+	assert.Equal(t, "plain", unescapeCsvFormula("plain"))
+}
+
+func TestParseImport_CsvWithoutHeader(t *testing.T) {
+	data, err := parseImport([]byte("1\nfoo\n2,ignored\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"foo"}, data.Invalid)
+	assert.Equal(t, []exportedReward{{RewardId: 1}, {RewardId: 2}}, data.Rewards)
+}
+
+func TestParseImport_Json(t *testing.T) {
+	budget := 1000
+	export := &exportData{
+		Version:  exportVersion,
+		Settings: exportedSettings{BudgetCents: &budget, BudgetCurrency: "EUR"},
+		Rewards:  []exportedReward{{RewardId: 1, Note: "note"}, {RewardId: -1}},
+	}
+	content, err := json.Marshal(export)
+	assert.NoError(t, err)
+
+	data, err := parseImport(content)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"-1"}, data.Invalid)
+	assert.Equal(t, []exportedReward{{RewardId: 1, Note: "note"}}, data.Rewards)
+	assert.Equal(t, &budget, data.Settings.BudgetCents)
+}
+
+func TestParseImport_Invalid(t *testing.T) {
+	_, err := parseImport([]byte("  "))
+	assert.Error(t, err)
+
+	_, err = parseImport([]byte("{invalid"))
+	assert.Error(t, err)
+
+	_, err = parseImport([]byte("campaign,title\nfoo,bar"))
+	assert.Error(t, err)
+}
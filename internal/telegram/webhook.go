@@ -0,0 +1,130 @@
+package telegram
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/fanonwue/goutils/logging"
+	"github.com/fanonwue/patreon-gobot/internal/util"
+	"github.com/go-telegram/bot"
+)
+
+const defaultHttpPort = "3000"
+const webhookShutdownTimeout = 10 * time.Second
+
+// webhookSecretPattern matches the secret tokens Telegram accepts
+var webhookSecretPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,256}$`)
+
+type webhookConfig struct {
+	url         *url.URL
+	secretToken string
+	port        string
+	// keepOnShutdown leaves the webhook registered on shutdown, so Telegram keeps the updates sent during a restart
+	keepOnShutdown bool
+}
+
+var webhookServer *http.Server
+var activeWebhook *webhookConfig
+
+// webhookConfigFromEnv reads the webhook configuration. Returns nil if no public URL is configured,
+// in which case the bot falls back to long polling.
+func webhookConfigFromEnv() (*webhookConfig, error) {
+	rawUrl := os.Getenv(util.PrefixEnvVar("TELEGRAM_WEBHOOK_URL"))
+	if rawUrl == "" {
+		return nil, nil
+	}
+
+	webhookUrl, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+	if webhookUrl.Scheme != "https" {
+		return nil, errors.New("webhook URL has to use HTTPS")
+	}
+
+	secretToken := os.Getenv(util.PrefixEnvVar("TELEGRAM_WEBHOOK_SECRET"))
+	if secretToken == "" {
+		// Telegram sends the token with every update, so a random one per run is just as good
+		secretBytes := make([]byte, 32)
+		_, _ = rand.Read(secretBytes)
+		secretToken = hex.EncodeToString(secretBytes)
+	} else if !webhookSecretPattern.MatchString(secretToken) {
+		return nil, errors.New("webhook secret may only contain A-Z, a-z, 0-9, _ and - and be at most 256 characters long")
+	}
+
+	port := os.Getenv(util.PrefixEnvVar("HTTP_PORT"))
+	if port == "" {
+		port = defaultHttpPort
+	}
+
+	keepOnShutdown, _ := strconv.ParseBool(os.Getenv(util.PrefixEnvVar("TELEGRAM_WEBHOOK_KEEP")))
+
+	return &webhookConfig{url: webhookUrl, secretToken: secretToken, port: port, keepOnShutdown: keepOnShutdown}, nil
+}
+
+func (wc *webhookConfig) path() string {
+	if wc.url.Path == "" {
+		return "/"
+	}
+	return wc.url.Path
+}
+
+// startWebhook registers the webhook at Telegram and starts serving updates on the configured port
+func startWebhook(ctx context.Context, b *bot.Bot, config *webhookConfig) error {
+	_, err := b.SetWebhook(ctx, &bot.SetWebhookParams{
+		URL:         config.url.String(),
+		SecretToken: config.secretToken,
+	})
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("POST "+config.path(), b.WebhookHandler())
+	webhookServer = &http.Server{
+		Addr:              ":" + config.port,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		logging.Infof("Serving webhook updates on port %s", config.port)
+		if err := webhookServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logging.Errorf("Error serving webhook: %v", err)
+		}
+	}()
+
+	activeWebhook = config
+	go b.StartWebhook(ctx)
+	return nil
+}
+
+// stopWebhook stops the HTTP server and removes the webhook at Telegram, unless it should be kept on shutdown
+func stopWebhook() {
+	if webhookServer == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), webhookShutdownTimeout)
+	defer cancel()
+
+	if err := webhookServer.Shutdown(ctx); err != nil {
+		logging.Errorf("Error shutting down webhook server: %v", err)
+	}
+	webhookServer = nil
+
+	if !activeWebhook.keepOnShutdown {
+		if _, err := botInstance.DeleteWebhook(ctx, &bot.DeleteWebhookParams{}); err != nil {
+			logging.Errorf("Error deleting webhook: %v", err)
+		}
+	}
+	activeWebhook = nil
+}
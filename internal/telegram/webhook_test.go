@@ -0,0 +1,59 @@
+package telegram
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/fanonwue/patreon-gobot/internal/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookConfigFromEnv(t *testing.T) {
+	config, err := webhookConfigFromEnv()
+	assert.NoError(t, err)
+	assert.Nil(t, config)
+
+	t.Setenv(util.PrefixEnvVar("TELEGRAM_WEBHOOK_URL"), "https://example.com/telegram")
+	config, err = webhookConfigFromEnv()
+	assert.NoError(t, err)
+	assert.Equal(t, "/telegram", config.path())
+	assert.Equal(t, defaultHttpPort, config.port)
+	assert.Regexp(t, webhookSecretPattern, config.secretToken)
+
+	t.Setenv(util.PrefixEnvVar("TELEGRAM_WEBHOOK_SECRET"), "valid_Secret-123")
+	t.Setenv(util.PrefixEnvVar("HTTP_PORT"), "8080")
+	config, err = webhookConfigFromEnv()
+	assert.NoError(t, err)
+	assert.Equal(t, "valid_Secret-123", config.secretToken)
+	assert.Equal(t, "8080", config.port)
+	assert.False(t, config.keepOnShutdown)
+
+	t.Setenv(util.PrefixEnvVar("TELEGRAM_WEBHOOK_KEEP"), "true")
+	config, err = webhookConfigFromEnv()
+	assert.NoError(t, err)
+	assert.True(t, config.keepOnShutdown)
+
+	for _, secret := range []string{"has spaces", "semi;colon", strings.Repeat("a", 257)} {
+		t.Setenv(util.PrefixEnvVar("TELEGRAM_WEBHOOK_SECRET"), secret)
+		_, err = webhookConfigFromEnv()
+		assert.Error(t, err, secret)
+	}
+
+	t.Setenv(util.PrefixEnvVar("TELEGRAM_WEBHOOK_URL"), "http://example.com/telegram")
+	_, err = webhookConfigFromEnv()
+	assert.Error(t, err)
+}
+
+func TestStopWebhook(t *testing.T) {
+	fake := newFakeTelegram(t)
+
+	webhookServer, activeWebhook = &http.Server{}, &webhookConfig{}
+	stopWebhook()
+	assert.Equal(t, 1, fake.requestCount("deleteWebhook"))
+	assert.Nil(t, webhookServer)
+
+	webhookServer, activeWebhook = &http.Server{}, &webhookConfig{keepOnShutdown: true}
+	stopWebhook()
+	assert.Equal(t, 1, fake.requestCount("deleteWebhook"))
+}
@@ -4,16 +4,56 @@ import (
 	"cmp"
 	"github.com/fanonwue/patreon-gobot/internal/patreon"
 	"slices"
+	"time"
 )
 
+type ListSort string
+
+const (
+	ListSortPrice     ListSort = "price"
+	ListSortPriceDesc ListSort = "price_desc"
+	ListSortName      ListSort = "name"
+	ListSortRecent    ListSort = "recent"
+	ListSortRemaining ListSort = "remaining"
+	DefaultListSort            = ListSortPrice
+)
+
+var ListSorts = []ListSort{ListSortPrice, ListSortPriceDesc, ListSortName, ListSortRecent, ListSortRemaining}
+
 type (
+	ListReward struct {
+		*patreon.Reward
+		AboveBudget    bool
+		AvailableSince *time.Time
+		Note           string
+		Tags           []string
+		Priority       string
+	}
+
 	ListCampaign struct {
 		Campaign *patreon.Campaign
-		Rewards  []*patreon.Reward
+		Rewards  []*ListReward
 	}
 
 	ListTemplateData struct {
 		Campaigns []*ListCampaign
+		Filters   []string
+	}
+
+	AddPreviewData struct {
+		Campaigns []*ListCampaign
+		Missing   []*patreon.RewardResult
+		Skipped   []patreon.RewardId
+	}
+
+	StatusData struct {
+		Total            int
+		Checked          int
+		Available        int
+		Unavailable      int
+		Missing          int
+		AvailableRewards []*patreon.Reward
+		Done             bool
 	}
 
 	MissingRewardsData struct {
@@ -23,14 +63,88 @@ type (
 	RewardAvailableData struct {
 		Reward   *patreon.Reward
 		Campaign *patreon.Campaign
+		Note     string
+		Tags     []string
+		Realert  bool
+	}
+
+	DigestData struct {
+		Rewards []*RewardAvailableData
+	}
+
+	BudgetData struct {
+		Budget          string
+		CampaignBudgets []*CampaignBudget
+	}
+
+	StatsData struct {
+		UsersByRole       map[string]int64
+		InactiveUsers     int64
+		TrackedRewards    int64
+		DistinctRewards   int64
+		PendingMessages   int64
+		RequestsLastHour  []*RequestCount
+		TotalRequests     int
+		RequestsPerMinute []int
+		CacheSizes        map[string]int
+		Proxies           []*ProxyStats
+	}
+
+	ProxyStats struct {
+		Url          string
+		Requests     int
+		Succeeded    int
+		Forbidden    int
+		RateLimited  int
+		Errors       int
+		EjectedUntil string
+	}
+
+	RequestCount struct {
+		Status string
+		Count  int
+	}
+
+	UserListEntry struct {
+		ChatId         int64
+		Role           string
+		Inactive       bool
+		TrackedRewards int64
+	}
+
+	UserListData struct {
+		Users []*UserListEntry
+	}
+
+	RunSummary struct {
+		Start            time.Time
+		Duration         string
+		Forced           bool
+		Due              int
+		Checked          int
+		Statuses         string
+		Notifications    int
+		TimedOutUsers    int
+		DeadlineExceeded bool
+		Circuit          string
+	}
+
+	RunHistoryData struct {
+		Runs []*RunSummary
+	}
+
+	CampaignBudget struct {
+		CampaignId patreon.CampaignId
+		Campaign   *patreon.Campaign
+		MaxPrice   string
 	}
 )
 
-func (lc *ListCampaign) AddReward(reward *patreon.Reward) {
+func (lc *ListCampaign) AddReward(reward *ListReward) {
 	lc.Rewards = append(lc.Rewards, reward)
 }
 
-func compareByAmount(first, last *patreon.Reward) int {
+func compareByAmount(first, last *ListReward) int {
 	result := cmp.Compare(first.Attributes.AmountCents, last.Attributes.AmountCents)
 	if result == 0 {
 		result = cmp.Compare(first.Title(), last.Title())
@@ -38,14 +152,60 @@ func compareByAmount(first, last *patreon.Reward) int {
 	return result
 }
 
-func (lc *ListCampaign) RewardsSortedByAmountAscending() []*patreon.Reward {
-	return slices.SortedFunc(slices.Values(lc.Rewards), func(a, b *patreon.Reward) int {
-		return compareByAmount(a, b)
-	})
+func compareByRecentlyAvailable(a, b *ListReward) int {
+	// Rewards that have never been available are sorted last
+	switch {
+	case a.AvailableSince == nil && b.AvailableSince == nil:
+		return 0
+	case a.AvailableSince == nil:
+		return 1
+	case b.AvailableSince == nil:
+		return -1
+	}
+	return b.AvailableSince.Compare(*a.AvailableSince)
 }
 
-func (lc *ListCampaign) RewardsSortedByAmountDescending() []*patreon.Reward {
-	return slices.SortedFunc(slices.Values(lc.Rewards), func(a, b *patreon.Reward) int {
+// Compare compares two rewards according to the sort order, falling back to the price for equal rewards
+func (s ListSort) Compare(a, b *ListReward) int {
+	var result int
+	switch s {
+	case ListSortPriceDesc:
 		return compareByAmount(b, a)
+	case ListSortName:
+		result = cmp.Compare(a.Title(), b.Title())
+	case ListSortRecent:
+		result = compareByRecentlyAvailable(a, b)
+	case ListSortRemaining:
+		result = cmp.Compare(b.Attributes.Remaining, a.Attributes.Remaining)
+	}
+
+	if result == 0 {
+		result = compareByAmount(a, b)
+	}
+	return result
+}
+
+// IsValid checks whether the sort order is one of ListSorts
+func (s ListSort) IsValid() bool {
+	return slices.Contains(ListSorts, s)
+}
+
+// SortListCampaigns sorts the rewards of every campaign according to the sort order. Campaigns are sorted by name,
+// unless sorting by recent availability or remaining slots, in which case the campaign with the best matching
+// reward comes first.
+func SortListCampaigns(campaigns []*ListCampaign, sort ListSort) []*ListCampaign {
+	for _, lc := range campaigns {
+		slices.SortFunc(lc.Rewards, sort.Compare)
+	}
+
+	return slices.SortedFunc(slices.Values(campaigns), func(a, b *ListCampaign) int {
+		result := 0
+		if (sort == ListSortRecent || sort == ListSortRemaining) && len(a.Rewards) > 0 && len(b.Rewards) > 0 {
+			result = sort.Compare(a.Rewards[0], b.Rewards[0])
+		}
+		if result == 0 {
+			result = cmp.Compare(a.Campaign.Name(), b.Campaign.Name())
+		}
+		return result
 	})
 }
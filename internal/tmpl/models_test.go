@@ -0,0 +1,77 @@
+package tmpl
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fanonwue/patreon-gobot/internal/patreon"
+	"github.com/stretchr/testify/assert"
+)
+
+func listReward(title string, amountCents int, remaining int, availableSince *time.Time) *ListReward {
+	return &ListReward{
+		Reward: &patreon.Reward{Attributes: patreon.RewardAttributes{
+			Title: title, AmountCents: amountCents, Remaining: remaining,
+		}},
+		AvailableSince: availableSince,
+	}
+}
+
+func listCampaign(name string, rewards ...*ListReward) *ListCampaign {
+	return &ListCampaign{
+		Campaign: &patreon.Campaign{Attributes: patreon.CampaignAttributes{Name: name}},
+		Rewards:  rewards,
+	}
+}
+
+func rewardTitles(campaigns []*ListCampaign) [][]string {
+	var titles [][]string
+	for _, lc := range campaigns {
+		var campaignTitles []string
+		for _, r := range lc.Rewards {
+			campaignTitles = append(campaignTitles, r.Title())
+		}
+		titles = append(titles, campaignTitles)
+	}
+	return titles
+}
+
+func TestSortListCampaigns(t *testing.T) {
+	earlier := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	later := earlier.Add(time.Hour)
+	campaigns := func() []*ListCampaign {
+		return []*ListCampaign{
+			listCampaign("Zeta",
+				listReward("Gold", 1000, 0, nil),
+				listReward("Bronze", 300, 5, &later)),
+			listCampaign("Alpha",
+				listReward("Silver", 500, 1, &earlier),
+				listReward("Copper", 500, 10, nil)),
+		}
+	}
+
+	tests := []struct {
+		sort     ListSort
+		expected [][]string
+	}{
+		{ListSortPrice, [][]string{{"Copper", "Silver"}, {"Bronze", "Gold"}}},
+		{ListSortPriceDesc, [][]string{{"Silver", "Copper"}, {"Gold", "Bronze"}}},
+		{ListSortName, [][]string{{"Copper", "Silver"}, {"Bronze", "Gold"}}},
+		// Campaigns are ordered by their best matching reward
+		{ListSortRecent, [][]string{{"Bronze", "Gold"}, {"Silver", "Copper"}}},
+		{ListSortRemaining, [][]string{{"Copper", "Silver"}, {"Bronze", "Gold"}}},
+	}
+	for _, test := range tests {
+		t.Run(string(test.sort), func(t *testing.T) {
+			assert.Equal(t, test.expected, rewardTitles(SortListCampaigns(campaigns(), test.sort)))
+		})
+	}
+}
+
+func TestListSort_IsValid(t *testing.T) {
+	for _, sort := range ListSorts {
+		assert.True(t, sort.IsValid())
+	}
+	assert.False(t, ListSort("cheapest").IsValid())
+	assert.False(t, ListSort("").IsValid())
+}
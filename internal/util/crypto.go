@@ -0,0 +1,61 @@
+package util
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"os"
+)
+
+// ErrNoSecretKey is returned if secrets need to be stored, but no SECRET_KEY has been configured
+var ErrNoSecretKey = errors.New("no secret key configured, set " + EnvPrefix + "SECRET_KEY")
+
+// SecretKey derives the key used to encrypt stored secrets from the SECRET_KEY environment variable.
+// Returns nil if it is not set.
+func SecretKey() []byte {
+	raw := os.Getenv(PrefixEnvVar("SECRET_KEY"))
+	if raw == "" {
+		return nil
+	}
+	key := sha256.Sum256([]byte(raw))
+	return key[:]
+}
+
+func newGcm(key []byte) (cipher.AEAD, error) {
+	if len(key) == 0 {
+		return nil, ErrNoSecretKey
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypt encrypts the plaintext with AES-GCM, prepending the random nonce to the result
+func Encrypt(key []byte, plaintext []byte) ([]byte, error) {
+	gcm, err := newGcm(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// Decrypt reverses Encrypt, failing if the ciphertext has been tampered with or the key doesn't match
+func Decrypt(key []byte, ciphertext []byte) ([]byte, error) {
+	gcm, err := newGcm(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, sealed := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, sealed, nil)
+}
@@ -0,0 +1,30 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	t.Setenv(PrefixEnvVar("SECRET_KEY"), "correct horse battery staple")
+	key := SecretKey()
+	assert.Len(t, key, 32)
+
+	ciphertext, err := Encrypt(key, []byte("session"))
+	assert.NoError(t, err)
+	assert.NotContains(t, string(ciphertext), "session")
+
+	plaintext, err := Decrypt(key, ciphertext)
+	assert.NoError(t, err)
+	assert.Equal(t, "session", string(plaintext))
+
+	t.Setenv(PrefixEnvVar("SECRET_KEY"), "another key")
+	_, err = Decrypt(SecretKey(), ciphertext)
+	assert.Error(t, err)
+}
+
+func TestEncrypt_NoKey(t *testing.T) {
+	_, err := Encrypt(nil, []byte("session"))
+	assert.ErrorIs(t, err, ErrNoSecretKey)
+}
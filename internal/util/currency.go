@@ -2,12 +2,20 @@ package util
 
 import (
 	"fmt"
+	"math"
 	"math/big"
+	"slices"
 	"strings"
 )
 
 type Currency string
 
+// maxMoneyCents is the largest amount ParseMoney accepts, so amounts fit into every integer column
+const maxMoneyCents = math.MaxInt32
+
+// KnownCurrencies are the currencies Patreon prices rewards in
+var KnownCurrencies = []Currency{"USD", "EUR", "GBP", "AUD", "CAD", "NZD", "CHF", "SEK", "DKK", "NOK", "PLN", "CZK", "HUF", "MXN", "BRL", "JPY"}
+
 func (c Currency) Symbol() string {
 	// Make sure the currency name is uppercase
 	currencyString := c.String()
@@ -27,6 +35,11 @@ func (c Currency) String() string {
 	return strings.ToUpper(string(c))
 }
 
+// IsKnown checks whether the currency is one of KnownCurrencies, ignoring the case
+func (c Currency) IsKnown() bool {
+	return slices.Contains(KnownCurrencies, Currency(c.String()))
+}
+
 func CurrencySymbol(currency string) string {
 	return Currency(currency).Symbol()
 }
@@ -38,3 +51,23 @@ func FormatMoney(money float64, currency Currency) string {
 func FormatMoneyBig(money *big.Float, currency Currency) string {
 	return money.Text('f', 2) + " " + currency.Symbol()
 }
+
+// ParseMoney parses a decimal amount like "12", "12.5" or "12,50" and returns it in cents. Negative, infinite
+// and amounts above maxMoneyCents are rejected.
+func ParseMoney(s string) (int, error) {
+	normalized := strings.ReplaceAll(strings.TrimSpace(s), ",", ".")
+	amount, ok := new(big.Float).SetString(normalized)
+	if !ok || amount.IsInf() || amount.Sign() < 0 {
+		return 0, fmt.Errorf("invalid amount: %s", s)
+	}
+	cents, _ := new(big.Float).Mul(amount, big.NewFloat(100)).Float64()
+	cents = math.Round(cents)
+	if math.IsInf(cents, 0) || math.IsNaN(cents) || cents > maxMoneyCents {
+		return 0, fmt.Errorf("amount out of range: %s", s)
+	}
+	return int(cents), nil
+}
+
+func FormatCents(cents int, currency Currency) string {
+	return FormatMoney(float64(cents)/100, currency)
+}
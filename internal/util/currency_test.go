@@ -0,0 +1,35 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMoney(t *testing.T) {
+	valid := map[string]int{
+		"12":       1200,
+		"12.5":     1250,
+		"12,50":    1250,
+		" 0.015 ":  2,
+		"0":        0,
+		"21474836": 2147483600,
+	}
+	for input, expected := range valid {
+		cents, err := ParseMoney(input)
+		assert.NoError(t, err, input)
+		assert.Equal(t, expected, cents, input)
+	}
+
+	for _, input := range []string{"", "abc", "-1", "Inf", "+Inf", "-Inf", "NaN", "1e400", "21474837", "12.5.0"} {
+		_, err := ParseMoney(input)
+		assert.Error(t, err, input)
+	}
+}
+
+func TestCurrency_IsKnown(t *testing.T) {
+	assert.True(t, Currency("USD").IsKnown())
+	assert.True(t, Currency("eur").IsKnown())
+	assert.False(t, Currency("XYZ").IsKnown())
+	assert.False(t, Currency("").IsKnown())
+}
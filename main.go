@@ -2,26 +2,54 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
 	"os"
 	"os/signal"
 	"strconv"
-	"sync"
 	"syscall"
 	"time"
 
-	"github.com/fanonwue/goutils/dsext"
 	"github.com/fanonwue/goutils/logging"
 	"github.com/fanonwue/patreon-gobot/internal/db"
 	"github.com/fanonwue/patreon-gobot/internal/patreon"
 	"github.com/fanonwue/patreon-gobot/internal/telegram"
+	"github.com/fanonwue/patreon-gobot/internal/tmpl"
 	"github.com/fanonwue/patreon-gobot/internal/util"
 	"github.com/joho/godotenv"
+	"gorm.io/gorm"
 )
 
-const minimumUpdateInterval = 30 * time.Second
+const (
+	minimumUpdateInterval = 30 * time.Second
+	// sessionValidationInterval is the interval the Patreon session is checked at
+	sessionValidationInterval = time.Hour
+	// proxyProbeInterval is the interval ejected proxies are checked for being probed again at
+	proxyProbeInterval = time.Minute
+	// maxRealerts limits the number of reminders for unacknowledged high priority notifications
+	maxRealerts = 3
+)
+
+var (
+	// baseCheckInterval is the interval of update runs and the shortest interval a reward gets checked at
+	baseCheckInterval = 2 * time.Minute
+	realertInterval   = 10 * time.Minute
+	digestInterval    = 24 * time.Hour
+	// proxyPool routes requests to Patreon through the configured proxies, nil if none are configured
+	proxyPool *patreon.ProxyPool
+	// clientOptions configure every Patreon client
+	clientOptions []patreon.ClientOption
+	// patreonSession is used for rewards that are forbidden for anonymous requests, if configured
+	patreonSession = patreon.NewSession(telegram.SessionExpiredHandler)
+)
 
 func main() {
 	appContext, _ := setup()
+	telegram.SetForceCheckHandler(func() error {
+		return startForcedUpdate(appContext)
+	})
+	telegram.SetRunHistoryHandler(recentRuns.recent)
 	_ = telegram.StartBot(appContext)
 
 	//user := db.User{}
@@ -37,9 +65,12 @@ func main() {
 	//	})
 	//}
 
-	go StartBackgroundUpdates(appContext, updateInterval())
+	go StartBackgroundUpdates(appContext, baseCheckInterval)
+	go StartSessionValidation(appContext, sessionValidationInterval)
+	go StartProxyProbing(appContext, proxyProbeInterval)
 
 	<-appContext.Done()
+	telegram.StopBot()
 	logging.Info("Bot exiting!")
 }
 
@@ -65,6 +96,21 @@ func setup() (context.Context, context.CancelFunc) {
 	)
 
 	patreon.OnStartup(appContext)
+	var err error
+	if proxyPool, err = patreon.ProxyPoolFromEnv(); err != nil {
+		panic(fmt.Sprintf("invalid proxy configuration: %v", err))
+	}
+	requestLimiter = patreon.NewRequestLimiter(requestBudgetFromEnv())
+	clientOptions = append(patreon.ClientOptionsFromEnv(),
+		patreon.WithProxyPool(proxyPool), patreon.WithSession(patreonSession), patreon.WithRequestLimiter(requestLimiter))
+	telegram.SetProxyPool(proxyPool)
+	telegram.SetSession(patreonSession)
+	telegram.SetClientOptions(clientOptions...)
+	realertInterval = durationFromEnv("REALERT_INTERVAL", time.Minute, realertInterval)
+	digestInterval = durationFromEnv("DIGEST_INTERVAL", time.Hour, digestInterval)
+	baseCheckInterval = updateInterval()
+	breaker = circuitBreakerFromEnv()
+	notifyAdminsOnBreakerChanges(breaker)
 
 	return appContext, cancel
 }
@@ -82,9 +128,23 @@ func updateInterval() time.Duration {
 	return interval
 }
 
+// durationFromEnv reads a positive number of units from the environment variable, falling back to the default
+func durationFromEnv(name string, unit time.Duration, defaultValue time.Duration) time.Duration {
+	raw := os.Getenv(util.PrefixEnvVar(name))
+	if raw == "" {
+		return defaultValue
+	}
+	value, err := strconv.Atoi(raw)
+	if err != nil || value <= 0 {
+		logging.Warnf("Invalid value for %s, using the default of %s", name, defaultValue)
+		return defaultValue
+	}
+	return time.Duration(value) * unit
+}
+
 func StartBackgroundUpdates(ctx context.Context, interval time.Duration) {
-	UpdateJob(ctx)
-	logging.Infof("Starting background updates at an interval of %.0f seconds", interval.Seconds())
+	runScheduledUpdate(ctx)
+	logging.Infof("Starting background updates at an interval of %.0f seconds with a budget of %d requests per minute", interval.Seconds(), requestLimiter.PerMinute())
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 	for {
@@ -94,83 +154,420 @@ func StartBackgroundUpdates(ctx context.Context, interval time.Duration) {
 			// The context is over, stop processing results
 			return
 		case <-ticker.C:
-			UpdateJob(ctx)
+			runScheduledUpdate(ctx)
 		}
 	}
 }
 
-func UpdateJob(ctx context.Context) {
-	logging.Debug("Checking for available rewards")
-	users := make([]db.User, 0)
-	db.Db().Find(&users)
+// StartSessionValidation periodically checks whether the Patreon session is still valid, so admins get alerted
+// about an expired session even if no request needed it lately
+func StartSessionValidation(ctx context.Context, interval time.Duration) {
+	validateSession(ctx)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			validateSession(ctx)
+		}
+	}
+}
 
-	wg := sync.WaitGroup{}
-	for _, user := range users {
-		wg.Go(func() {
-			updateForUser(&user, ctx)
-		})
+// StartProxyProbing periodically probes the proxies whose ejection is over, so they are restored even while no
+// rewards are due
+func StartProxyProbing(ctx context.Context, interval time.Duration) {
+	if proxyPool == nil {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			patreon.NewClient(1, clientOptions...).ProbeProxies(ctx)
+		}
 	}
+}
 
-	wg.Wait()
+func validateSession(ctx context.Context) {
+	if status := patreonSession.Status(); !status.Configured || status.Expired {
+		return
+	}
+	if err := patreon.NewClient(1, clientOptions...).ValidateSession(ctx); err != nil && !errors.Is(err, patreon.ErrSessionExpired) {
+		logging.Warnf("Error validating the Patreon session: %v", err)
+	}
 }
 
-func updateForUser(user *db.User, ctx context.Context) {
-	db.Db().Preload("Rewards").First(&user)
-	c := patreon.NewClient(4)
-	rewards := c.FetchRewardsSlice(dsext.Map(user.Rewards, func(tr db.TrackedReward) patreon.RewardId {
-		return patreon.RewardId(tr.RewardId)
-	}), true, ctx)
+func runScheduledUpdate(ctx context.Context) {
+	if _, err := UpdateJob(ctx, false); err != nil {
+		logging.Warnf("Skipping scheduled update: %v", err)
+	}
+}
 
-	tx := db.Db().Begin()
-	// Make sure the transaction always gets closed at the end, discarding any uncommitted changes
-	rollback := true
-	defer func() {
-		if rollback {
-			tx.Rollback()
-		}
+// startForcedUpdate starts an update run in the background, considering all rewards due. Fails if a run is
+// in progress already.
+func startForcedUpdate(ctx context.Context) error {
+	if !updateRunMu.TryLock() {
+		return errUpdateRunning
+	}
+	go func() {
+		defer updateRunMu.Unlock()
+		runUpdate(ctx, true)
 	}()
+	return nil
+}
 
-	missingRewards := make([]*patreon.RewardResult, 0)
-	for r := range rewards {
-		tr := db.TrackedReward{}
-		tx.First(&tr, "user_id = ? AND reward_id = ?", user.ID, r.Id)
-		if tx.Error != nil || tr.ID == 0 {
-			logging.Warnf("Could not find tracked reward %d for user %d", r.Id, user.ID)
-			continue
+// UpdateJob runs a single update, unless another one is still in progress
+func UpdateJob(ctx context.Context, force bool) (*runSummary, error) {
+	if !updateRunMu.TryLock() {
+		return nil, errUpdateRunning
+	}
+	defer updateRunMu.Unlock()
+	return runUpdate(ctx, force), nil
+}
+
+// userUpdate collects the changes for a single user during an update run. Results are processed by a
+// separate goroutine per user, so a user whose processing hangs doesn't hold up the others.
+type userUpdate struct {
+	user      *db.User
+	digestDue bool
+	// digestPending is set if a low priority reward became available that waits for the next digest
+	digestPending bool
+	missing       []*patreon.RewardResult
+	digest        []*tmpl.RewardAvailableData
+	notifications int
+	timedOut      bool
+	processed     time.Duration
+	results       chan checkedReward
+	done          chan struct{}
+	// outageResults are results with an outage status, which are only applied if the circuit breaker is
+	// closed by the end of the run, so rewards don't get flagged as missing while Patreon is down
+	outageResults []checkedReward
+}
+
+// checkedReward is the result of a check for the tracked reward of a user
+type checkedReward struct {
+	reward *db.TrackedReward
+	result patreon.RewardResult
+}
+
+// runUpdate checks the rewards that are due according to their schedule, within the request budget. Every
+// reward is fetched once, no matter how many users track it. The requests are spread across most of the interval
+// and results are processed as they come in. The run is cancelled once the interval is over, so runs never
+// overlap. With force set, all rewards are considered due.
+func runUpdate(ctx context.Context, force bool) *runSummary {
+	logging.Debug("Checking for available rewards")
+	now := time.Now()
+	summary := newRunSummary(now, force)
+	allowed, probe := breaker.allowRun(now, force)
+	if !allowed {
+		logging.Debug("Circuit breaker open, skipping update run")
+		summary.circuit = breaker.currentState()
+		return summary
+	}
+	runCtx, cancel := context.WithTimeout(ctx, baseCheckInterval)
+	defer cancel()
+
+	users := make([]db.User, 0)
+	// Skip users that blocked the bot, they will get reactivated once they start the bot again
+	db.Db().Preload("Rewards").Preload("CampaignBudgets").
+		Find(&users, "is_inactive = ? AND role IN ?", false, db.ActiveRoles)
+
+	var trackedRewards []db.TrackedReward
+	updates := make([]*userUpdate, 0, len(users))
+	trackers := make(map[patreon.RewardId][]*userUpdate)
+	// knownFailing holds the rewards whose last checks failed as not found or forbidden
+	knownFailing := make(map[patreon.RewardId]bool)
+	for i := range users {
+		user := &users[i]
+		update := &userUpdate{
+			user:      user,
+			digestDue: user.IsDigestDue(digestInterval),
+			results:   make(chan checkedReward, len(user.Rewards)),
+			done:      make(chan struct{}),
+		}
+		updates = append(updates, update)
+		trackedRewards = append(trackedRewards, user.Rewards...)
+		for j := range user.Rewards {
+			id := patreon.RewardId(user.Rewards[j].RewardId)
+			trackers[id] = append(trackers[id], update)
+			if user.Rewards[j].ErrorCount > 0 {
+				knownFailing[id] = true
+			}
 		}
+	}
 
-		if r.Status == patreon.RewardErrorRateLimit {
-			logging.Warnf("Got rate limited for reward: %d", r.Id)
-			continue
+	// Rewards due before the middle of the next run are checked now, so small delays don't skip a whole run
+	window := time.Duration(float64(baseCheckInterval) * staggerWindowRatio)
+	budget := runBudget(requestLimiter, window)
+	if probe {
+		budget = min(budget, breakerProbeSize)
+	}
+	rewardIds := selectDueRewards(trackedRewards, now.Add(baseCheckInterval/2), budget, force || probe)
+	summary.due = len(rewardIds)
+	if len(rewardIds) == 0 {
+		if probe {
+			// Nothing to probe with, the breaker stays open until there is
+			breaker.finishProbe(now)
 		}
+		summary.circuit = breaker.currentState()
+		summary.duration = time.Since(now)
+		recentRuns.add(summary)
+		logging.Debugf("Update run finished: %s", summary)
+		return summary
+	}
 
-		if r.Status != patreon.RewardFound {
-			if !tr.IsMissing {
-				tr.IsMissing = true
-				missingRewards = append(missingRewards, &r)
-				// Don't repeat the warning if the reward is known to be missing already
-				logging.Warnf("Reward %d not found: %s", r.Id, r.Status.Text())
+	delays := staggerDelays(len(rewardIds), window, rand.Float64)
+	logging.Debugf("Spreading %d reward checks over %.0f seconds (one every %.1f seconds on average)",
+		len(rewardIds), window.Seconds(), window.Seconds()/float64(len(rewardIds)))
+
+	c := patreon.NewClient(4, clientOptions...)
+	for _, update := range updates {
+		go update.processResults(runCtx, c, now)
+	}
+
+	// Requests are stopped early if the circuit breaker opens, without cutting the processing of results short
+	requestCtx, stopRequests := context.WithCancel(runCtx)
+	defer stopRequests()
+	results := c.FetchRewards(staggeredIds(requestCtx, rewardIds, now, delays), true, requestCtx)
+dispatch:
+	for {
+		select {
+		case <-requestCtx.Done():
+			// Requests still in flight have to be able to deliver their results
+			go func() {
+				for range results {
+				}
+			}()
+			break dispatch
+		case r, ok := <-results:
+			if !ok {
+				break dispatch
+			}
+			summary.recordResult(r.Status)
+			for _, update := range trackers[r.Id] {
+				update.dispatch(r)
+			}
+			if countsForBreaker(r.Status, knownFailing[r.Id]) && breaker.record(r.Status, time.Now()) {
+				stopRequests()
 			}
+		}
+	}
+	if probe {
+		breaker.finishProbe(time.Now())
+	}
+	summary.circuit = breaker.currentState()
+
+	for _, update := range updates {
+		close(update.results)
+	}
+	for _, update := range updates {
+		select {
+		case <-update.done:
+			summary.recordUser(update)
+		case <-runCtx.Done():
+			summary.recordUnfinishedUser()
+			// Processing gets cancelled along with the run. The run only ends once it stopped, so the next
+			// run can't process the same rewards at the same time.
+			<-update.done
+		}
+	}
+
+	summary.deadlineExceeded = errors.Is(runCtx.Err(), context.DeadlineExceeded)
+	summary.duration = time.Since(now)
+	recentRuns.add(summary)
+	logging.Infof("Update run finished: %s", summary)
+	return summary
+}
+
+// dispatch hands the result to the processing goroutine of the user for every reward of the user it belongs to
+func (uu *userUpdate) dispatch(r patreon.RewardResult) {
+	for i := range uu.user.Rewards {
+		if patreon.RewardId(uu.user.Rewards[i].RewardId) == r.Id {
+			uu.results <- checkedReward{reward: &uu.user.Rewards[i], result: r}
+		}
+	}
+}
+
+// processResults processes the results of the user until all have been dispatched. Processing all results of a
+// user may take userProcessingTimeout at most, requests still running once it's used up get cancelled and the
+// remaining results are skipped, so the rewards stay due. The collected notifications are sent afterward.
+func (uu *userUpdate) processResults(ctx context.Context, c *patreon.Client, runStart time.Time) {
+	defer close(uu.done)
+	for checked := range uu.results {
+		uu.withProcessingTime(ctx, func(ctx context.Context) {
+			uu.process(ctx, checked.reward, checked.result, c, runStart)
+		})
+	}
+	if len(uu.outageResults) > 0 {
+		uu.withProcessingTime(ctx, func(ctx context.Context) {
+			uu.applyOutageResults(ctx, c, runStart)
+		})
+	}
+	if uu.timedOut {
+		logging.Warnf("Processing results for user %d took longer than %.0f seconds, skipped the remaining ones", uu.user.ID, userProcessingTimeout.Seconds())
+	}
+	uu.finish()
+}
+
+// withProcessingTime calls f with a context that is cancelled once the user used up their processing time.
+// f is skipped if the processing time is used up already.
+func (uu *userUpdate) withProcessingTime(ctx context.Context, f func(ctx context.Context)) {
+	remaining := userProcessingTimeout - uu.processed
+	if remaining <= 0 || ctx.Err() != nil {
+		uu.timedOut = true
+		return
+	}
+	processCtx, cancel := context.WithTimeout(ctx, remaining)
+	defer cancel()
+	start := time.Now()
+	f(processCtx)
+	uu.processed += time.Since(start)
+}
+
+// process applies the result of a check to the tracked reward of the user, notifying them about available
+// rewards right away. The user needs to have its CampaignBudgets preloaded.
+func (uu *userUpdate) process(ctx context.Context, tr *db.TrackedReward, r patreon.RewardResult, c *patreon.Client, runStart time.Time) {
+	if r.Status == patreon.RewardErrorRateLimit {
+		logging.Warnf("Got rate limited for reward: %d", r.Id)
+		return
+	}
+	if isOutageStatus(r.Status) && countsForBreaker(r.Status, tr.ErrorCount > 0) {
+		uu.outageResults = append(uu.outageResults, checkedReward{reward: tr, result: r})
+		return
+	}
+	uu.apply(ctx, tr, r, c, runStart)
+}
+
+// apply updates the tracked reward with the result of the check and saves it. As checks are spread across the
+// run, the tracked reward is reloaded first, so changes the user made since the run started are respected.
+func (uu *userUpdate) apply(ctx context.Context, tr *db.TrackedReward, r patreon.RewardResult, c *patreon.Client, runStart time.Time) {
+	current := &db.TrackedReward{}
+	if err := db.Db().First(current, tr.ID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			logging.Debugf("Tracked reward %d of user %d was removed during the update run", tr.RewardId, uu.user.ID)
 		} else {
-			tr.IsMissing = false
+			logging.Errorf("Error loading tracked reward %d of user %d: %v", tr.RewardId, uu.user.ID, err)
+		}
+		return
+	}
+	*tr = *current
+
+	if r.Status != patreon.RewardFound {
+		if !tr.IsMissing {
+			tr.IsMissing = true
+			uu.missing = append(uu.missing, &r)
+			// Don't repeat the warning if the reward is known to be missing already
+			logging.Warnf("Reward %d not found: %s", r.Id, r.Status.Text())
 		}
+	} else {
+		tr.IsMissing = false
+	}
 
-		if r.IsPresent() {
-			if r.IsAvailable() {
-				onAvailable(user, &r, &tr, c)
-			} else {
-				tr.AvailableSince = nil
+	wasAvailable := tr.AvailableSince != nil
+	if r.IsPresent() {
+		if r.IsAvailable() {
+			if entry := uu.onAvailable(ctx, &r, tr, c); entry != nil {
+				uu.digest = append(uu.digest, entry)
 			}
+		} else {
+			tr.AvailableSince = nil
 		}
+	}
+	if !wasAvailable && tr.AvailableSince != nil {
+		tr.OpenCount++
+	}
+	scheduleNextCheck(tr, r.Status, baseCheckInterval, runStart)
 
-		tx.Save(&tr)
+	saved, err := saveCheckResult(tr)
+	if err != nil {
+		logging.Errorf("Error saving tracked reward %d of user %d: %v", tr.RewardId, uu.user.ID, err)
+	} else if !saved {
+		logging.Debugf("Tracked reward %d of user %d was removed during the update run", tr.RewardId, uu.user.ID)
 	}
-	telegram.NotifyMissing(user, missingRewards)
-	tx.Commit()
-	rollback = false
 }
 
-func onAvailable(user *db.User, r *patreon.RewardResult, tr *db.TrackedReward, client *patreon.Client) {
+// saveCheckResult saves the columns the update job owns. Settings like the note, tags or priority may have
+// been changed by the user in the meantime and are left alone. The acknowledgement and re-alerts are
+// updated when notifying instead, as the user may acknowledge at any time. Returns false if the tracked reward
+// has been removed since it was loaded, so it doesn't get recreated.
+func saveCheckResult(tr *db.TrackedReward) (bool, error) {
+	result := db.Db().Model(&db.TrackedReward{}).Where("id = ?", tr.ID).Updates(map[string]any{
+		"is_missing":      tr.IsMissing,
+		"available_since": util.ToUTC(tr.AvailableSince),
+		"last_notified":   util.ToUTC(tr.LastNotified),
+		"next_check":      util.ToUTC(tr.NextCheck),
+		"error_count":     tr.ErrorCount,
+		"open_count":      tr.OpenCount,
+	})
+	return result.RowsAffected > 0, result.Error
+}
+
+// applyOutageResults applies the results with outage statuses once all results are in. They are dropped while the
+// circuit breaker isn't closed, the rewards stay due and get checked again once Patreon works again.
+func (uu *userUpdate) applyOutageResults(ctx context.Context, c *patreon.Client, runStart time.Time) {
+	if breaker.currentState() != circuitClosed {
+		logging.Debugf("Ignoring %d failed checks of user %d during the outage", len(uu.outageResults), uu.user.ID)
+		return
+	}
+	for _, checked := range uu.outageResults {
+		uu.apply(ctx, checked.reward, checked.result, c, runStart)
+	}
+}
+
+// finish sends the notifications collected during the run. A digest is opened by the first low priority reward
+// becoming available and sent once the digest interval has passed, so rewards becoming available in the meantime
+// are batched.
+func (uu *userUpdate) finish() {
+	telegram.NotifyMissing(uu.user, uu.missing)
+	switch {
+	case uu.digestDue:
+		telegram.NotifyDigest(uu.user, uu.digest)
+		// Rewards that weren't checked during this run open the next digest once they are
+		db.Db().Model(&db.User{}).Where("id = ?", uu.user.ID).Update("digest_opened_at", nil)
+	case uu.digestPending && uu.user.DigestOpenedAt == nil:
+		db.Db().Model(&db.User{}).Where("id = ? AND digest_opened_at IS NULL", uu.user.ID).
+			Update("digest_opened_at", time.Now().UTC())
+	}
+}
+
+// resetAcknowledgement resets the acknowledgement and re-alerts before notifying about a reward that became
+// available again. This happens before sending the notification, so acknowledging it can't get overwritten.
+func resetAcknowledgement(tr *db.TrackedReward) {
+	tr.Acknowledged = false
+	tr.Realerts = 0
+	err := db.Db().Model(&db.TrackedReward{}).Where("id = ?", tr.ID).
+		Updates(map[string]any{"acknowledged": false, "realerts": 0}).Error
+	if err != nil {
+		logging.Errorf("Error resetting the acknowledgement of tracked reward %d: %v", tr.ID, err)
+	}
+}
+
+// claimRealert counts the next re-alert of the tracked reward. Returns false if the notification has been
+// acknowledged or re-alerted since the tracked reward was loaded, in which case no re-alert should be sent.
+func claimRealert(tr *db.TrackedReward) bool {
+	result := db.Db().Model(&db.TrackedReward{}).
+		Where("id = ? AND acknowledged = ? AND realerts = ?", tr.ID, false, tr.Realerts).
+		Update("realerts", gorm.Expr("realerts + 1"))
+	if result.Error != nil {
+		logging.Errorf("Error counting the re-alert of tracked reward %d: %v", tr.ID, result.Error)
+		return false
+	}
+	if result.RowsAffected == 0 {
+		return false
+	}
+	tr.Realerts++
+	return true
+}
+
+// onAvailable notifies the user about the available reward, if needed. Low priority rewards are only included in
+// digests, they are returned once the digest is due and open the digest otherwise.
+func (uu *userUpdate) onAvailable(ctx context.Context, r *patreon.RewardResult, tr *db.TrackedReward, client *patreon.Client) *tmpl.RewardAvailableData {
+	user := uu.user
 	logging.Debugf("Reward available: %d", r.Id)
 	now := time.Now()
 
@@ -181,20 +578,46 @@ func onAvailable(user *db.User, r *patreon.RewardResult, tr *db.TrackedReward, c
 	var campaign *patreon.Campaign
 	campaignId, _ := r.Reward.CampaignId()
 	if campaignId > 0 {
-		campaign, _ = client.FetchCampaign(campaignId, false)
+		campaign, _ = client.FetchCampaign(campaignId, false, ctx)
 	}
 
 	if campaign == nil {
 		r.Status = patreon.RewardErrorNoCampaign
-		return
+		return nil
+	}
+
+	if user.IsAboveBudget(int64(campaignId), r.Reward.Attributes.AmountCents, r.Reward.Attributes.Currency) {
+		logging.Debugf("Reward %d is above the budget of user %d, skipping notification", r.Id, user.ID)
+		return nil
 	}
 
-	if tr.LastNotified == nil || tr.AvailableSince.After(*tr.LastNotified) {
-		telegram.NotifyAvailable(user, r, campaign)
-		now := time.Now()
+	notified := tr.LastNotified != nil && !tr.AvailableSince.After(*tr.LastNotified)
+	switch {
+	case tr.Priority == db.PriorityLow:
+		if notified {
+			return nil
+		}
+		if !uu.digestDue {
+			uu.digestPending = true
+			return nil
+		}
+		tr.LastNotified = &now
+		return &tmpl.RewardAvailableData{Reward: r.Reward, Campaign: campaign, Note: tr.Note, Tags: tr.TagList()}
+	case !notified:
+		resetAcknowledgement(tr)
+		telegram.NotifyAvailable(user, r, tr, campaign)
+		uu.notifications++
 		tr.LastNotified = &now
 		if r.Status != patreon.RewardFound {
 			tr.IsMissing = true
 		}
+	case tr.Priority == db.PriorityHigh && !tr.Acknowledged && tr.Realerts < maxRealerts && now.Sub(*tr.LastNotified) >= realertInterval:
+		if !claimRealert(tr) {
+			return nil
+		}
+		telegram.NotifyAvailable(user, r, tr, campaign)
+		uu.notifications++
+		tr.LastNotified = &now
 	}
+	return nil
 }
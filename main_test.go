@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fanonwue/patreon-gobot/internal/db"
+	"github.com/fanonwue/patreon-gobot/internal/patreon"
+	"github.com/fanonwue/patreon-gobot/internal/tmpl"
+	"github.com/fanonwue/patreon-gobot/internal/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "patreon-gobot-test")
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv(util.PrefixEnvVar("DATABASE_PATH"), filepath.Join(dir, "test.db"))
+	db.CreateDatabase()
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func TestSaveCheckResult_KeepsUserSettings(t *testing.T) {
+	tr := &db.TrackedReward{UserID: 1, RewardId: 1001}
+	assert.NoError(t, db.Db().Create(tr).Error)
+
+	// The user changes the priority and adds a note while the run is checking it
+	assert.NoError(t, db.Db().Model(&db.TrackedReward{}).Where("id = ?", tr.ID).
+		Updates(map[string]any{"priority": db.PriorityHigh, "note": "changed during the run"}).Error)
+
+	now := time.Now()
+	tr.AvailableSince = &now
+	tr.OpenCount = 1
+	tr.ErrorCount = 2
+	saved, err := saveCheckResult(tr)
+	assert.NoError(t, err)
+	assert.True(t, saved)
+
+	stored := &db.TrackedReward{}
+	assert.NoError(t, db.Db().First(stored, tr.ID).Error)
+	assert.Equal(t, db.PriorityHigh, stored.Priority)
+	assert.Equal(t, "changed during the run", stored.Note)
+	assert.NotNil(t, stored.AvailableSince)
+	assert.Equal(t, 1, stored.OpenCount)
+	assert.Equal(t, 2, stored.ErrorCount)
+}
+
+func TestSaveCheckResult_SkipsRemovedRewards(t *testing.T) {
+	tr := &db.TrackedReward{UserID: 1, RewardId: 1002}
+	assert.NoError(t, db.Db().Create(tr).Error)
+	assert.NoError(t, db.Db().Unscoped().Delete(&db.TrackedReward{}, tr.ID).Error)
+
+	tr.IsMissing = true
+	saved, err := saveCheckResult(tr)
+	assert.NoError(t, err)
+	assert.False(t, saved)
+
+	var count int64
+	db.Db().Unscoped().Model(&db.TrackedReward{}).Where("id = ?", tr.ID).Count(&count)
+	assert.Zero(t, count)
+}
+
+func TestUserUpdate_ApplyReloadsTrackedReward(t *testing.T) {
+	user := &db.User{}
+	tr := db.TrackedReward{UserID: 2, RewardId: 1003}
+	assert.NoError(t, db.Db().Create(&tr).Error)
+	uu := &userUpdate{user: user}
+
+	// Changed after the run loaded the reward, so the change must be kept
+	assert.NoError(t, db.Db().Model(&db.TrackedReward{}).Where("id = ?", tr.ID).Update("note", "changed during the run").Error)
+	uu.apply(context.Background(), &tr, patreon.RewardResult{Id: 1003, Status: patreon.RewardErrorNotFound}, nil, time.Now())
+	assert.Equal(t, "changed during the run", tr.Note)
+	assert.True(t, tr.IsMissing)
+	assert.Len(t, uu.missing, 1)
+	uu.missing = nil
+
+	// Removed during the run, so it must not be recreated
+	removed := db.TrackedReward{UserID: 2, RewardId: 1004}
+	assert.NoError(t, db.Db().Create(&removed).Error)
+	assert.NoError(t, db.Db().Unscoped().Delete(&db.TrackedReward{}, removed.ID).Error)
+	uu.apply(context.Background(), &removed, patreon.RewardResult{Id: 1004, Status: patreon.RewardErrorNotFound}, nil, time.Now())
+	assert.Empty(t, uu.missing)
+
+	var count int64
+	db.Db().Unscoped().Model(&db.TrackedReward{}).Where("id = ?", removed.ID).Count(&count)
+	assert.Zero(t, count)
+}
+
+func TestUserUpdate_WithProcessingTime(t *testing.T) {
+	uu := &userUpdate{user: &db.User{}, processed: userProcessingTimeout - 50*time.Millisecond}
+
+	// A hanging request gets cancelled once the processing time is used up
+	var processErr error
+	uu.withProcessingTime(context.Background(), func(ctx context.Context) {
+		<-ctx.Done()
+		processErr = ctx.Err()
+	})
+	assert.ErrorIs(t, processErr, context.DeadlineExceeded)
+	assert.False(t, uu.timedOut)
+
+	called := false
+	uu.withProcessingTime(context.Background(), func(ctx context.Context) {
+		called = true
+	})
+	assert.False(t, called)
+	assert.True(t, uu.timedOut)
+}
+
+// testCampaignClient creates a client that finds the campaign of every reward
+func testCampaignClient(t *testing.T) *patreon.Client {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "test/stubs/campaigns/3876079.json")
+	}))
+	t.Cleanup(server.Close)
+	serverUrl, _ := url.Parse(server.URL)
+	return patreon.NewClient(1, patreon.WithBaseUrl(serverUrl))
+}
+
+func availableResult(id patreon.RewardId) *patreon.RewardResult {
+	reward := &patreon.Reward{Id: id, Attributes: patreon.RewardAttributes{Remaining: 1}}
+	reward.Relationships.Campaign.Data.Id = 3876079
+	return &patreon.RewardResult{Id: id, Reward: reward}
+}
+
+func pendingMessages(t *testing.T, chatId int64) int64 {
+	var count int64
+	assert.NoError(t, db.Db().Model(&db.PendingMessage{}).Where("chat_id = ?", chatId).Count(&count).Error)
+	return count
+}
+
+func TestUserUpdate_OnAvailableDigest(t *testing.T) {
+	client := testCampaignClient(t)
+	uu := &userUpdate{user: &db.User{TelegramChatId: 3001}, digestDue: false}
+	tr := &db.TrackedReward{RewardId: 2001, Priority: db.PriorityLow, Note: "note", Tags: "art,comics"}
+
+	// Low priority rewards wait for the next digest
+	assert.Nil(t, uu.onAvailable(context.Background(), availableResult(2001), tr, client))
+	assert.Nil(t, tr.LastNotified)
+	assert.True(t, uu.digestPending)
+
+	uu.digestDue = true
+	entry := uu.onAvailable(context.Background(), availableResult(2001), tr, client)
+	if assert.NotNil(t, entry) {
+		assert.Equal(t, "note", entry.Note)
+		assert.Equal(t, []string{"art", "comics"}, entry.Tags)
+		assert.NotNil(t, entry.Campaign)
+	}
+	assert.NotNil(t, tr.LastNotified)
+	assert.Zero(t, uu.notifications)
+	assert.Zero(t, pendingMessages(t, 3001))
+
+	// Only included in a single digest while it stays available
+	assert.Nil(t, uu.onAvailable(context.Background(), availableResult(2001), tr, client))
+}
+
+func TestUserUpdate_FinishDigestWindow(t *testing.T) {
+	user := &db.User{TelegramChatId: 3004, Role: db.RoleUser}
+	assert.NoError(t, db.Db().Create(user).Error)
+	storedUser := func() *db.User {
+		stored := &db.User{}
+		assert.NoError(t, db.Db().First(stored, user.ID).Error)
+		return stored
+	}
+
+	// The first low priority reward opens the digest instead of being sent on its own
+	(&userUpdate{user: user, digestPending: true}).finish()
+	openedAt := storedUser().DigestOpenedAt
+	if !assert.NotNil(t, openedAt) {
+		return
+	}
+	assert.Zero(t, pendingMessages(t, 3004))
+	assert.False(t, storedUser().IsDigestDue(digestInterval))
+
+	// Further rewards don't move the window
+	(&userUpdate{user: storedUser(), digestPending: true}).finish()
+	assert.True(t, openedAt.Equal(*storedUser().DigestOpenedAt))
+
+	uu := &userUpdate{user: storedUser(), digestDue: true}
+	reward := &patreon.Reward{Id: 2004, Attributes: patreon.RewardAttributes{Remaining: 1}}
+	uu.digest = []*tmpl.RewardAvailableData{{Reward: reward, Campaign: &patreon.Campaign{}}}
+	uu.finish()
+	assert.Equal(t, int64(1), pendingMessages(t, 3004))
+	assert.Nil(t, storedUser().DigestOpenedAt)
+}
+
+// createTrackedReward stores a high priority reward that has been available for an hour
+func createTrackedReward(t *testing.T, rewardId int64) *db.TrackedReward {
+	availableSince := time.Now().Add(-time.Hour)
+	tr := &db.TrackedReward{UserID: 3, RewardId: rewardId, Priority: db.PriorityHigh, AvailableSince: &availableSince}
+	assert.NoError(t, db.Db().Create(tr).Error)
+	return tr
+}
+
+func TestUserUpdate_OnAvailableRealerts(t *testing.T) {
+	client := testCampaignClient(t)
+	uu := &userUpdate{user: &db.User{TelegramChatId: 3002}}
+	tr := createTrackedReward(t, 2002)
+
+	assert.Nil(t, uu.onAvailable(context.Background(), availableResult(2002), tr, client))
+	assert.Equal(t, 1, uu.notifications)
+	assert.Equal(t, int64(1), pendingMessages(t, 3002))
+
+	// No reminder before the interval passed
+	uu.onAvailable(context.Background(), availableResult(2002), tr, client)
+	assert.Equal(t, 1, uu.notifications)
+
+	for i := 1; i <= maxRealerts+1; i++ {
+		lastNotified := tr.LastNotified.Add(-realertInterval)
+		tr.LastNotified = &lastNotified
+		uu.onAvailable(context.Background(), availableResult(2002), tr, client)
+		assert.Equal(t, min(i, maxRealerts), tr.Realerts)
+	}
+	assert.Equal(t, 1+maxRealerts, uu.notifications)
+	assert.Equal(t, int64(1+maxRealerts), pendingMessages(t, 3002))
+
+	stored := &db.TrackedReward{}
+	assert.NoError(t, db.Db().First(stored, tr.ID).Error)
+	assert.Equal(t, maxRealerts, stored.Realerts)
+}
+
+func TestUserUpdate_OnAvailableAcknowledged(t *testing.T) {
+	client := testCampaignClient(t)
+	uu := &userUpdate{user: &db.User{TelegramChatId: 3003}}
+	tr := createTrackedReward(t, 2003)
+
+	uu.onAvailable(context.Background(), availableResult(2003), tr, client)
+	// Acknowledged while the run is checking the reward, after it has been loaded
+	assert.NoError(t, db.Db().Model(&db.TrackedReward{}).Where("id = ?", tr.ID).Update("acknowledged", true).Error)
+	lastNotified := tr.LastNotified.Add(-realertInterval)
+	tr.LastNotified = &lastNotified
+	uu.onAvailable(context.Background(), availableResult(2003), tr, client)
+	assert.Zero(t, tr.Realerts)
+	assert.Equal(t, 1, uu.notifications)
+
+	// Saving the result of the run keeps the acknowledgement
+	_, err := saveCheckResult(tr)
+	assert.NoError(t, err)
+	stored := &db.TrackedReward{}
+	assert.NoError(t, db.Db().First(stored, tr.ID).Error)
+	assert.True(t, stored.Acknowledged)
+
+	// Becoming available again notifies right away, even if the last notification was acknowledged
+	availableSince := time.Now()
+	tr.AvailableSince = &availableSince
+	tr.Acknowledged = true
+	uu.onAvailable(context.Background(), availableResult(2003), tr, client)
+	assert.False(t, tr.Acknowledged)
+	assert.Equal(t, 2, uu.notifications)
+	assert.Equal(t, int64(2), pendingMessages(t, 3003))
+	assert.NoError(t, db.Db().First(stored, tr.ID).Error)
+	assert.False(t, stored.Acknowledged)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fanonwue/patreon-gobot/internal/patreon"
+	"github.com/fanonwue/patreon-gobot/internal/tmpl"
+)
+
+const (
+	// runHistorySize is the number of run summaries kept for /runs
+	runHistorySize = 20
+	// userProcessingTimeout limits the time spent processing the results of a single user during a run, e.g.
+	// because fetching campaigns hangs. Remaining results of the user are skipped and checked again next run.
+	userProcessingTimeout = 30 * time.Second
+)
+
+var errUpdateRunning = errors.New("an update run is already in progress")
+
+type (
+	// runSummary describes the outcome of a single update run
+	runSummary struct {
+		mu               sync.Mutex
+		start            time.Time
+		duration         time.Duration
+		forced           bool
+		due              int
+		checked          int
+		statuses         map[patreon.RewardStatus]int
+		notifications    int
+		missing          int
+		digests          int
+		timedOutUsers    int
+		deadlineExceeded bool
+		// circuit is the state of the circuit breaker at the end of the run
+		circuit circuitState
+	}
+
+	// runHistory retains the summaries of the most recent runs
+	runHistory struct {
+		mu   sync.Mutex
+		runs []*runSummary
+	}
+)
+
+var updateRunMu sync.Mutex
+var recentRuns = &runHistory{}
+
+func newRunSummary(start time.Time, forced bool) *runSummary {
+	return &runSummary{start: start, forced: forced, statuses: make(map[patreon.RewardStatus]int)}
+}
+
+func (rs *runSummary) recordResult(status patreon.RewardStatus) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.checked++
+	rs.statuses[status]++
+}
+
+// recordUser adds the outcome of a user's update to the summary, once its processing has finished
+func (rs *runSummary) recordUser(uu *userUpdate) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.notifications += uu.notifications
+	if len(uu.missing) > 0 {
+		rs.missing++
+	}
+	if len(uu.digest) > 0 {
+		rs.digests++
+	}
+	if uu.timedOut {
+		rs.timedOutUsers++
+	}
+}
+
+// recordUnfinishedUser counts a user whose results were still being processed once the run was over
+func (rs *runSummary) recordUnfinishedUser() {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.timedOutUsers++
+}
+
+func (rs *runSummary) statusText() string {
+	statuses := slices.SortedFunc(maps.Keys(rs.statuses), func(a, b patreon.RewardStatus) int {
+		return cmp.Compare(a, b)
+	})
+	parts := make([]string, 0, len(statuses))
+	for _, status := range statuses {
+		name := status.Text()
+		if status == patreon.RewardFound {
+			name = "Found"
+		}
+		parts = append(parts, fmt.Sprintf("%s: %d", name, rs.statuses[status]))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// String formats the summary as single log line
+func (rs *runSummary) String() string {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return fmt.Sprintf("duration=%.1fs forced=%t due=%d checked=%d statuses=[%s] notifications=%d missing=%d digests=%d timed_out_users=%d deadline_exceeded=%t circuit=%s",
+		rs.duration.Seconds(), rs.forced, rs.due, rs.checked, rs.statusText(), rs.notifications, rs.missing, rs.digests,
+		rs.timedOutUsers, rs.deadlineExceeded, rs.circuit)
+}
+
+func (rs *runSummary) templateData() *tmpl.RunSummary {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return &tmpl.RunSummary{
+		Start:            rs.start,
+		Duration:         rs.duration.Round(100 * time.Millisecond).String(),
+		Forced:           rs.forced,
+		Due:              rs.due,
+		Checked:          rs.checked,
+		Statuses:         rs.statusText(),
+		Notifications:    rs.notifications,
+		TimedOutUsers:    rs.timedOutUsers,
+		DeadlineExceeded: rs.deadlineExceeded,
+		Circuit:          rs.circuit.String(),
+	}
+}
+
+func (rh *runHistory) add(rs *runSummary) {
+	rh.mu.Lock()
+	defer rh.mu.Unlock()
+	rh.runs = append(rh.runs, rs)
+	if len(rh.runs) > runHistorySize {
+		rh.runs = slices.Delete(rh.runs, 0, len(rh.runs)-runHistorySize)
+	}
+}
+
+// recent returns the retained summaries, most recent first
+func (rh *runHistory) recent() []*tmpl.RunSummary {
+	rh.mu.Lock()
+	defer rh.mu.Unlock()
+	summaries := make([]*tmpl.RunSummary, 0, len(rh.runs))
+	for _, rs := range slices.Backward(rh.runs) {
+		summaries = append(summaries, rs.templateData())
+	}
+	return summaries
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fanonwue/patreon-gobot/internal/db"
+	"github.com/fanonwue/patreon-gobot/internal/patreon"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunHistory_KeepsMostRecent(t *testing.T) {
+	history := &runHistory{}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := range runHistorySize + 5 {
+		history.add(newRunSummary(start.Add(time.Duration(i)*time.Minute), false))
+	}
+
+	recent := history.recent()
+	assert.Len(t, recent, runHistorySize)
+	assert.Equal(t, start.Add((runHistorySize+4)*time.Minute), recent[0].Start)
+	assert.Equal(t, start.Add(5*time.Minute), recent[len(recent)-1].Start)
+}
+
+func TestRunSummary(t *testing.T) {
+	summary := newRunSummary(time.Now(), true)
+	summary.due = 3
+	summary.duration = 1500 * time.Millisecond
+	summary.recordResult(patreon.RewardFound)
+	summary.recordResult(patreon.RewardFound)
+	summary.recordResult(patreon.RewardErrorNotFound)
+	summary.recordUser(&userUpdate{
+		user:          &db.User{},
+		notifications: 2,
+		missing:       []*patreon.RewardResult{{}},
+	})
+	summary.recordUser(&userUpdate{user: &db.User{}, timedOut: true})
+	summary.recordUnfinishedUser()
+
+	data := summary.templateData()
+	assert.True(t, data.Forced)
+	assert.Equal(t, 3, data.Due)
+	assert.Equal(t, 3, data.Checked)
+	assert.Equal(t, 2, data.Notifications)
+	assert.Equal(t, 2, data.TimedOutUsers)
+	assert.Equal(t, "1.5s", data.Duration)
+	assert.Contains(t, data.Statuses, "Found: 2")
+
+	line := summary.String()
+	assert.Contains(t, line, "checked=3")
+	assert.Contains(t, line, "missing=1")
+	assert.Contains(t, line, "timed_out_users=2")
+}
+
+func TestUpdateJob_SingleFlight(t *testing.T) {
+	updateRunMu.Lock()
+	defer updateRunMu.Unlock()
+
+	_, err := UpdateJob(t.Context(), false)
+	assert.ErrorIs(t, err, errUpdateRunning)
+	assert.ErrorIs(t, startForcedUpdate(t.Context()), errUpdateRunning)
+}
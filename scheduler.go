@@ -0,0 +1,214 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"iter"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/fanonwue/goutils/logging"
+	"github.com/fanonwue/patreon-gobot/internal/db"
+	"github.com/fanonwue/patreon-gobot/internal/patreon"
+	"github.com/fanonwue/patreon-gobot/internal/util"
+)
+
+const (
+	// defaultRequestBudget is the default maximum number of reward requests per minute
+	defaultRequestBudget = 120
+	// maxCheckInterval is the longest a reward goes unchecked, unless it keeps failing
+	maxCheckInterval = time.Hour
+	// maxErrorBackoff is the longest a reward that keeps failing goes unchecked
+	maxErrorBackoff = 6 * time.Hour
+	// historyWindow is the time a reward needs to be tracked before its history is taken into account
+	historyWindow = 7 * 24 * time.Hour
+	week          = 7 * 24 * time.Hour
+	// staggerWindowRatio is the part of the update interval the requests of a run are spread across, leaving
+	// some time for slow requests before the next run starts
+	staggerWindowRatio = 0.8
+)
+
+// requestLimiter limits the requests to Patreon of all clients, including the ones used for commands
+var requestLimiter = patreon.NewRequestLimiter(defaultRequestBudget)
+
+func requestBudgetFromEnv() int {
+	budget, err := strconv.Atoi(os.Getenv(util.PrefixEnvVar("REQUEST_BUDGET")))
+	if err != nil || budget <= 0 {
+		return defaultRequestBudget
+	}
+	return budget
+}
+
+// runBudget returns the number of rewards that may be checked in a run spreading its requests across the window.
+// Requests sent for commands use up the same budget, so runs get smaller while the bot is busy.
+func runBudget(limiter *patreon.RequestLimiter, window time.Duration) int {
+	return max(1, limiter.Available(window))
+}
+
+func priorityRank(p db.Priority) int {
+	switch p {
+	case db.PriorityHigh:
+		return 2
+	case db.PriorityLow:
+		return 0
+	default:
+		return 1
+	}
+}
+
+// priorityFactor slows down checks of low priority rewards
+func priorityFactor(p db.Priority) int {
+	if p == db.PriorityLow {
+		return 4
+	}
+	return 1
+}
+
+// historyFactor slows down checks of rewards whose slots rarely open. High priority rewards and rewards that have
+// not been tracked long enough are not slowed down.
+func historyFactor(tr *db.TrackedReward, now time.Time) int {
+	tracked := now.Sub(tr.CreatedAt)
+	if tr.Priority == db.PriorityHigh || tracked < historyWindow {
+		return 1
+	}
+
+	opensPerWeek := float64(tr.OpenCount) / (float64(tracked) / float64(week))
+	switch {
+	case opensPerWeek >= 1:
+		return 1
+	case tr.OpenCount > 0:
+		return 2
+	default:
+		return 4
+	}
+}
+
+// isPersistentError checks whether the status indicates the reward won't come back soon, e.g. because it
+// has been deleted or made private
+func isPersistentError(status patreon.RewardStatus) bool {
+	return status == patreon.RewardErrorNotFound || status == patreon.RewardErrorForbidden
+}
+
+// checkInterval returns the time until the reward should be checked again. Rewards that keep failing back off
+// exponentially, all others are checked based on their priority and how often their slots opened in the past.
+func checkInterval(tr *db.TrackedReward, base time.Duration, now time.Time) time.Duration {
+	if tr.ErrorCount > 0 {
+		return min(base<<min(tr.ErrorCount, 16), maxErrorBackoff)
+	}
+	interval := base * time.Duration(priorityFactor(tr.Priority)*historyFactor(tr, now))
+	return max(base, min(interval, maxCheckInterval))
+}
+
+// scheduleNextCheck updates the scheduling state of the reward after it has been checked
+func scheduleNextCheck(tr *db.TrackedReward, status patreon.RewardStatus, base time.Duration, now time.Time) {
+	if isPersistentError(status) {
+		tr.ErrorCount++
+	} else if status == patreon.RewardFound {
+		tr.ErrorCount = 0
+	}
+	nextCheck := now.Add(checkInterval(tr, base, now))
+	tr.NextCheck = &nextCheck
+}
+
+// isDue checks whether the reward is scheduled to be checked before the given time
+func isDue(tr *db.TrackedReward, dueBefore time.Time) bool {
+	return tr.NextCheck == nil || !tr.NextCheck.After(dueBefore)
+}
+
+// selectDueRewards returns the IDs of the rewards due before the given time, at most budget many. Rewards
+// tracked by multiple users are only checked once. If there are more due rewards than the budget allows,
+// higher priorities and rewards that are overdue the longest go first, the rest stays due for the next run.
+// With force set, all rewards are considered due.
+func selectDueRewards(trackedRewards []db.TrackedReward, dueBefore time.Time, budget int, force bool) []patreon.RewardId {
+	type dueReward struct {
+		id        patreon.RewardId
+		rank      int
+		nextCheck time.Time
+	}
+
+	// The highest priority any user assigned to a reward counts, even if the reward is not due for that user
+	ranks := make(map[patreon.RewardId]int)
+	for _, tr := range trackedRewards {
+		id := patreon.RewardId(tr.RewardId)
+		ranks[id] = max(ranks[id], priorityRank(tr.Priority))
+	}
+
+	dueRewards := make(map[patreon.RewardId]*dueReward)
+	for i := range trackedRewards {
+		tr := &trackedRewards[i]
+		if !force && !isDue(tr, dueBefore) {
+			continue
+		}
+		var nextCheck time.Time
+		if tr.NextCheck != nil {
+			nextCheck = *tr.NextCheck
+		}
+
+		id := patreon.RewardId(tr.RewardId)
+		due, found := dueRewards[id]
+		if !found {
+			dueRewards[id] = &dueReward{id: id, rank: ranks[id], nextCheck: nextCheck}
+		} else if nextCheck.Before(due.nextCheck) {
+			due.nextCheck = nextCheck
+		}
+	}
+
+	sorted := slices.SortedFunc(maps.Values(dueRewards), func(a, b *dueReward) int {
+		if result := cmp.Compare(b.rank, a.rank); result != 0 {
+			return result
+		}
+		if result := a.nextCheck.Compare(b.nextCheck); result != 0 {
+			return result
+		}
+		return cmp.Compare(a.id, b.id)
+	})
+
+	if len(sorted) > budget {
+		logging.Infof("%d rewards are due, but the request budget only allows checking %d", len(sorted), budget)
+		sorted = sorted[:budget]
+	}
+
+	ids := make([]patreon.RewardId, 0, len(sorted))
+	for _, due := range sorted {
+		ids = append(ids, due.id)
+	}
+	return ids
+}
+
+// staggerDelays spreads n requests evenly across the window. The window is split into n equally sized slots,
+// every request is placed at a random point within its slot, so the request rate stays smooth without
+// following a recognizable pattern. randFloat returns random numbers in [0, 1).
+func staggerDelays(n int, window time.Duration, randFloat func() float64) []time.Duration {
+	delays := make([]time.Duration, n)
+	if n == 0 {
+		return delays
+	}
+	slot := float64(window) / float64(n)
+	for i := range delays {
+		delays[i] = time.Duration((float64(i) + randFloat()) * slot)
+	}
+	return delays
+}
+
+// staggeredIds yields the IDs once their delay, counted from start, has passed. Stops early if the context
+// is cancelled.
+func staggeredIds(ctx context.Context, ids []patreon.RewardId, start time.Time, delays []time.Duration) iter.Seq[patreon.RewardId] {
+	return func(yield func(patreon.RewardId) bool) {
+		timer := time.NewTimer(0)
+		defer timer.Stop()
+		for i, id := range ids {
+			timer.Reset(time.Until(start.Add(delays[i])))
+			select {
+			case <-ctx.Done():
+				return
+			case <-timer.C:
+			}
+			if !yield(id) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/fanonwue/patreon-gobot/internal/db"
+	"github.com/fanonwue/patreon-gobot/internal/patreon"
+	"github.com/stretchr/testify/assert"
+)
+
+func trackedReward(rewardId int64, priority db.Priority, nextCheck *time.Time) db.TrackedReward {
+	tr := db.TrackedReward{RewardId: rewardId, Priority: priority, NextCheck: nextCheck}
+	tr.CreatedAt = time.Now()
+	return tr
+}
+
+func TestCheckInterval(t *testing.T) {
+	now := time.Now()
+	base := 2 * time.Minute
+
+	tr := trackedReward(1, db.PriorityNormal, nil)
+	assert.Equal(t, base, checkInterval(&tr, base, now))
+
+	tr.Priority = db.PriorityLow
+	assert.Equal(t, 4*base, checkInterval(&tr, base, now))
+
+	// Rewards that never opened in a month are checked less often, unless they have a high priority
+	tr.Priority = db.PriorityNormal
+	tr.CreatedAt = now.Add(-30 * 24 * time.Hour)
+	assert.Equal(t, 4*base, checkInterval(&tr, base, now))
+	tr.OpenCount = 1
+	assert.Equal(t, 2*base, checkInterval(&tr, base, now))
+	tr.OpenCount = 10
+	assert.Equal(t, base, checkInterval(&tr, base, now))
+	tr.OpenCount = 0
+	tr.Priority = db.PriorityHigh
+	assert.Equal(t, base, checkInterval(&tr, base, now))
+
+	tr.Priority = db.PriorityLow
+	assert.Equal(t, maxCheckInterval, checkInterval(&tr, 30*time.Minute, now))
+}
+
+func TestScheduleNextCheck_Backoff(t *testing.T) {
+	now := time.Now()
+	base := time.Minute
+	tr := trackedReward(1, db.PriorityNormal, nil)
+
+	scheduleNextCheck(&tr, patreon.RewardErrorNotFound, base, now)
+	assert.Equal(t, now.Add(2*base), *tr.NextCheck)
+	scheduleNextCheck(&tr, patreon.RewardErrorForbidden, base, now)
+	assert.Equal(t, now.Add(4*base), *tr.NextCheck)
+
+	// Temporary errors neither increase nor reset the backoff
+	scheduleNextCheck(&tr, patreon.RewardErrorGatewayError, base, now)
+	assert.Equal(t, 2, tr.ErrorCount)
+
+	tr.ErrorCount = 100
+	scheduleNextCheck(&tr, patreon.RewardErrorNotFound, base, now)
+	assert.Equal(t, now.Add(maxErrorBackoff), *tr.NextCheck)
+
+	scheduleNextCheck(&tr, patreon.RewardFound, base, now)
+	assert.Equal(t, 0, tr.ErrorCount)
+	assert.Equal(t, now.Add(base), *tr.NextCheck)
+}
+
+func TestSelectDueRewards(t *testing.T) {
+	now := time.Now()
+	earlier := now.Add(-time.Minute)
+	later := now.Add(time.Minute)
+	trackedRewards := []db.TrackedReward{
+		trackedReward(1, db.PriorityLow, nil),
+		trackedReward(2, db.PriorityNormal, &earlier),
+		trackedReward(3, db.PriorityNormal, &later),
+		trackedReward(4, db.PriorityNormal, &now),
+		// Tracked by another user with a higher priority
+		trackedReward(4, db.PriorityHigh, &later),
+	}
+
+	assert.Equal(t, []patreon.RewardId{4, 2, 1}, selectDueRewards(trackedRewards, now, 10, false))
+	assert.Equal(t, []patreon.RewardId{4, 2}, selectDueRewards(trackedRewards, now, 2, false))
+	assert.Equal(t, []patreon.RewardId{4, 2, 3, 1}, selectDueRewards(trackedRewards, now, 10, true))
+}
+
+func TestRunBudget(t *testing.T) {
+	limiter := patreon.NewRequestLimiter(60)
+	assert.GreaterOrEqual(t, runBudget(limiter, time.Minute), 120)
+
+	// Requests sent for commands leave less for the next run, but there's always room for one check
+	client := patreon.NewClient(1, patreon.WithRequestLimiter(limiter), patreon.WithBaseUrl(&url.URL{Scheme: "http", Host: "127.0.0.1:1"}))
+	for range 60 {
+		_, _ = client.FetchCampaign(1, true, context.Background())
+	}
+	assert.Equal(t, 1, runBudget(limiter, 0))
+}
+
+func TestStaggerDelays(t *testing.T) {
+	window := 10 * time.Second
+	assert.Equal(t, []time.Duration{0, 2 * time.Second, 4 * time.Second, 6 * time.Second, 8 * time.Second},
+		staggerDelays(5, window, func() float64 { return 0 }))
+
+	// Every delay stays within its own slot, no matter the jitter
+	for i, delay := range staggerDelays(5, window, func() float64 { return 0.999 }) {
+		assert.GreaterOrEqual(t, delay, time.Duration(i)*2*time.Second)
+		assert.Less(t, delay, time.Duration(i+1)*2*time.Second)
+	}
+	assert.Empty(t, staggerDelays(0, window, func() float64 { return 0 }))
+}
+
+func TestStaggeredIds(t *testing.T) {
+	ids := []patreon.RewardId{1, 2, 3}
+	delays := []time.Duration{0, 20 * time.Millisecond, 40 * time.Millisecond}
+	start := time.Now()
+
+	var yielded []patreon.RewardId
+	for id := range staggeredIds(context.Background(), ids, start, delays) {
+		yielded = append(yielded, id)
+	}
+	assert.Equal(t, ids, yielded)
+	assert.GreaterOrEqual(t, time.Since(start), 40*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	yielded = nil
+	for id := range staggeredIds(ctx, ids, time.Now().Add(time.Hour), delays) {
+		yielded = append(yielded, id)
+	}
+	assert.Empty(t, yielded)
+}